@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrSiteDown is returned, wrapped in a PermanentError, for every request
+// once the circuit breaker has given up on the site.
+var ErrSiteDown = errors.New("the site seems to be down")
+
+type breakerState int
+
+const (
+	// breakerClosed lets requests through.
+	breakerClosed breakerState = iota
+	// breakerOpen holds every request back until the cool-down is over.
+	breakerOpen
+	// breakerProbing lets a single request through to see whether the
+	// site has recovered; the others keep waiting.
+	breakerProbing
+	// breakerBroken fails every request: the probe failed too.
+	breakerBroken
+)
+
+// BreakerEvent describes a change of a CircuitBreaker's state.
+type BreakerEvent struct {
+	State breakerState
+	// Failures is how many requests in a row have failed.
+	Failures int
+	// CoolDown is how long requests are held back when the breaker opens.
+	CoolDown time.Duration
+	// Err is the last failure.
+	Err error
+}
+
+// CircuitBreaker stops a run from hammering a site that is down. It is
+// shared by every request of the run: after Threshold failed requests in a
+// row it holds all of them back for CoolDown, then lets a single probe
+// through. If the probe succeeds the run carries on; if it fails, every
+// request from then on fails with ErrSiteDown, so the run ends instead of
+// retrying page after page.
+type CircuitBreaker struct {
+	Threshold int
+	CoolDown  time.Duration
+	// OnChange, if set, is told about every change of state so the UI can
+	// narrate it. It is called with the breaker locked.
+	OnChange func(BreakerEvent)
+
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	lastErr   error
+	openUntil time.Time
+	// changed is closed and replaced whenever the state changes, waking
+	// the requests waiting for it.
+	changed chan struct{}
+}
+
+var defaultBreaker = CircuitBreaker{Threshold: 20, CoolDown: time.Minute}
+
+// addBreakerFlags registers the flags that configure the circuit breaker
+// and returns a function that builds it once the flag set has been parsed.
+// The function returns a nil breaker when it is turned off.
+func addBreakerFlags(flags *flag.FlagSet) func() (*CircuitBreaker, error) {
+	failures := flags.Int("breaker-failures", defaultBreaker.Threshold, "pause all downloads after this many failed requests in a row (0 never pauses)")
+	coolDown := flags.Duration("breaker-cooldown", defaultBreaker.CoolDown, "how long to pause before checking whether the site is back")
+	return func() (*CircuitBreaker, error) {
+		if *failures < 0 {
+			return nil, fmt.Errorf("-breaker-failures must not be negative, got %d", *failures)
+		}
+		if *coolDown <= 0 {
+			return nil, fmt.Errorf("-breaker-cooldown must be positive, got %v", *coolDown)
+		}
+		if *failures == 0 {
+			return nil, nil
+		}
+		return &CircuitBreaker{Threshold: *failures, CoolDown: *coolDown}, nil
+	}
+}
+
+// setState moves the breaker to state, wakes the waiting requests and
+// tells OnChange; b.mu must be held.
+func (b *CircuitBreaker) setState(state breakerState) {
+	b.state = state
+	b.wake()
+	if b.OnChange != nil {
+		b.OnChange(BreakerEvent{State: state, Failures: b.failures, CoolDown: b.CoolDown, Err: b.lastErr})
+	}
+}
+
+// wake wakes the requests waiting for a change of state; b.mu must be
+// held.
+func (b *CircuitBreaker) wake() {
+	if b.changed != nil {
+		close(b.changed)
+	}
+	b.changed = make(chan struct{})
+}
+
+// wait returns a channel that is closed on the next change of state; b.mu
+// must be held.
+func (b *CircuitBreaker) wait() <-chan struct{} {
+	if b.changed == nil {
+		b.changed = make(chan struct{})
+	}
+	return b.changed
+}
+
+// acquire blocks until a request may be sent. probe reports whether the
+// request is the one that tests a recovering site; its outcome must then be
+// passed to record, or to abandon. A nil breaker lets everything through.
+func (b *CircuitBreaker) acquire(ctx context.Context) (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	for {
+		switch b.state {
+		case breakerClosed:
+			b.mu.Unlock()
+			return false, nil
+		case breakerBroken:
+			err := b.errLocked()
+			b.mu.Unlock()
+			return false, err
+		case breakerOpen:
+			if wait := time.Until(b.openUntil); wait > 0 {
+				changed := b.wait()
+				b.mu.Unlock()
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-changed:
+					timer.Stop()
+				case <-ctx.Done():
+					timer.Stop()
+					return false, ctx.Err()
+				}
+				b.mu.Lock()
+				continue
+			}
+			b.setState(breakerProbing)
+			b.mu.Unlock()
+			return true, nil
+		case breakerProbing:
+			changed := b.wait()
+			b.mu.Unlock()
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return false, ctx.Err()
+			}
+			b.mu.Lock()
+		}
+	}
+}
+
+// record reports the outcome of a request acquire let through: err is nil
+// when the site answered, even if only to refuse the request.
+func (b *CircuitBreaker) record(probe bool, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		if probe {
+			b.setState(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	switch {
+	case probe:
+		b.setState(breakerBroken)
+	case b.state == breakerClosed && b.failures >= b.Threshold:
+		b.openUntil = time.Now().Add(b.CoolDown)
+		b.setState(breakerOpen)
+	}
+}
+
+// abandon reports that a request acquire let through ended without saying
+// anything about the site: the caller gave up, for example. A probe hands
+// its turn to the next waiting request; the failures so far still count.
+func (b *CircuitBreaker) abandon(probe bool) {
+	if b == nil || !probe {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerProbing {
+		// Back to open with the cool-down over, without telling OnChange:
+		// nothing about the site has changed.
+		b.state = breakerOpen
+		b.wake()
+	}
+}
+
+// Err returns why the breaker gave up on the site, or nil if it has not.
+func (b *CircuitBreaker) Err() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerBroken {
+		return nil
+	}
+	return b.errLocked()
+}
+
+func (b *CircuitBreaker) errLocked() error {
+	return fmt.Errorf("%w: %d requests in a row failed, the last one after a %v pause (%v)", ErrSiteDown, b.failures, b.CoolDown, b.lastErr)
+}
+
+// Reset closes the breaker again, for example before a watch checks the
+// site the next time.
+func (b *CircuitBreaker) Reset() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.lastErr = nil
+	b.state = breakerClosed
+	b.wake()
+}
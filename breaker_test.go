@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tripBreaker records enough failures to open b.
+func tripBreaker(b *CircuitBreaker) {
+	for i := 0; i < b.Threshold; i++ {
+		b.record(false, errors.New("HTTP 503"))
+	}
+}
+
+func TestCircuitBreakerSendsASingleProbe(t *testing.T) {
+	var events []breakerState
+	b := &CircuitBreaker{Threshold: 3, CoolDown: 30 * time.Millisecond}
+	b.OnChange = func(e BreakerEvent) { events = append(events, e.State) }
+
+	b.record(false, errors.New("HTTP 503"))
+	b.record(false, nil) // a success in between starts the count again
+	tripBreaker(b)
+	start := time.Now()
+
+	const requests = 5
+	var probes atomic.Int32
+	var wg sync.WaitGroup
+	released := make(chan bool, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probe, err := b.acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if probe {
+				probes.Add(1)
+				// The others must still be waiting while the probe is out.
+				time.Sleep(20 * time.Millisecond)
+				released <- probe
+				b.record(true, nil)
+				return
+			}
+			released <- probe
+		}()
+	}
+	wg.Wait()
+	close(released)
+
+	if elapsed := time.Since(start); elapsed < b.CoolDown {
+		t.Fatalf("requests went through after %v, before the %v cool-down", elapsed, b.CoolDown)
+	}
+	if probes.Load() != 1 {
+		t.Fatalf("%d probes, want 1", probes.Load())
+	}
+	if first := <-released; !first {
+		t.Fatal("a request went through before the probe succeeded")
+	}
+	want := []breakerState{breakerOpen, breakerProbing, breakerClosed}
+	if !equalStates(events, want) {
+		t.Fatalf("events %v, want %v", events, want)
+	}
+	if b.Err() != nil {
+		t.Fatalf("Err = %v after the site recovered", b.Err())
+	}
+}
+
+func TestCircuitBreakerGivesUpWhenTheProbeFails(t *testing.T) {
+	b := &CircuitBreaker{Threshold: 2, CoolDown: time.Millisecond}
+	tripBreaker(b)
+
+	probe, err := b.acquire(context.Background())
+	if err != nil || !probe {
+		t.Fatalf("acquire after the cool-down = %v, %v; want the probe", probe, err)
+	}
+	b.record(true, errors.New("HTTP 503"))
+
+	if _, err := b.acquire(context.Background()); !errors.Is(err, ErrSiteDown) {
+		t.Fatalf("acquire after a failed probe = %v, want ErrSiteDown", err)
+	}
+	if !errors.Is(b.Err(), ErrSiteDown) {
+		t.Fatalf("Err = %v, want ErrSiteDown", b.Err())
+	}
+
+	b.Reset()
+	if probe, err := b.acquire(context.Background()); err != nil || probe {
+		t.Fatalf("acquire after Reset = %v, %v", probe, err)
+	}
+}
+
+func TestCircuitBreakerProbeGivenUpByTheCaller(t *testing.T) {
+	var events []breakerState
+	b := &CircuitBreaker{Threshold: 2, CoolDown: time.Millisecond}
+	tripBreaker(b)
+	b.OnChange = func(e BreakerEvent) { events = append(events, e.State) }
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	// The probe's caller gives up before the site answers.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if _, err := NewNetworkClient(defaultTransportOptions).UseCircuitBreaker(b).FetchWithRetries(req, nil); err == nil {
+		t.Fatal("FetchWithRetries succeeded after its context ended")
+	}
+
+	// That proves nothing: the breaker is open again, not closed, and the
+	// next request is the probe.
+	if probe, err := b.acquire(context.Background()); err != nil || !probe {
+		t.Fatalf("acquire after an abandoned probe = %v, %v; want the next probe", probe, err)
+	}
+	want := []breakerState{breakerProbing, breakerProbing}
+	if !equalStates(events, want) {
+		t.Fatalf("events %v, want %v", events, want)
+	}
+}
+
+func TestCircuitBreakerWaitHonoursContext(t *testing.T) {
+	b := &CircuitBreaker{Threshold: 1, CoolDown: time.Hour}
+	tripBreaker(b)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire = %v, want the context's error", err)
+	}
+}
+
+func TestFetchWithRetriesStopsWhenTheSiteIsDown(t *testing.T) {
+	old := baseDelay
+	baseDelay = time.Millisecond
+	t.Cleanup(func() { baseDelay = old })
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	b := &CircuitBreaker{Threshold: 2, CoolDown: 5 * time.Millisecond}
+	client := NewNetworkClient(defaultTransportOptions).UseCircuitBreaker(b)
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	_, err := client.FetchWithRetries(req, nil)
+	if !errors.Is(err, ErrSiteDown) || !IsPermanent(err) {
+		t.Fatalf("err = %v, want a permanent ErrSiteDown", err)
+	}
+	// Two failures trip the breaker and one probe fails; nothing else.
+	if calls.Load() != 3 {
+		t.Fatalf("server called %d times, want 3", calls.Load())
+	}
+}
+
+func equalStates(a, b []breakerState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
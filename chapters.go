@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pageFilePattern matches the page files written by deobfuscateAndSave.
+var pageFilePattern = regexp.MustCompile(`^(\d{3,})\.(?:png|jpg|webp)$`)
+
+// LocalChapter is a finished chapter folder found under an output root.
+type LocalChapter struct {
+	// ID is a stable, URL-safe identifier derived from Dir, so that paths
+	// never have to round-trip through URLs.
+	ID string
+	// Dir is the folder's path relative to the output root.
+	Dir string
+	// Pages lists the page file names in reading order.
+	Pages   []string
+	ModTime time.Time
+	// Manifest is the chapter's manifest, or nil for folders written before
+	// manifests existed.
+	Manifest *Manifest
+}
+
+// Title is the chapter's display title, falling back to its folder name.
+func (c LocalChapter) Title() string {
+	if c.Manifest != nil {
+		if title := c.Manifest.DisplayTitle(); title != "" {
+			return title
+		}
+	}
+	return filepath.ToSlash(c.Dir)
+}
+
+// Path joins the output root the chapter was found under, the chapter
+// folder and a page file name.
+func (c LocalChapter) Path(root, name string) string {
+	return filepath.Join(root, c.Dir, name)
+}
+
+// chapterID derives a LocalChapter ID from its root-relative directory.
+func chapterID(dir string) string {
+	sum := sha256.Sum256([]byte(filepath.ToSlash(dir)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// maxChapterDepth bounds how deep scanChapters looks for chapter folders;
+// output templates nest chapters a few levels below the root at most.
+const maxChapterDepth = 4
+
+// scanChapters lists the chapter folders under root, newest first. A folder
+// counts as a chapter when it contains at least one page file; folders
+// nested inside a chapter are not searched.
+func scanChapters(root string) ([]LocalChapter, error) {
+	if _, err := os.ReadDir(root); err != nil {
+		return nil, fmt.Errorf("could not read output directory: %w", err)
+	}
+
+	var chapters []LocalChapter
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || path == root {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return filepath.SkipDir
+		}
+		chapter, ok := readLocalChapter(path, rel)
+		if ok {
+			if info, err := entry.Info(); err == nil {
+				chapter.ModTime = info.ModTime()
+			}
+			chapters = append(chapters, chapter)
+			return filepath.SkipDir
+		}
+		if strings.Count(filepath.ToSlash(rel), "/")+1 >= maxChapterDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read output directory: %w", err)
+	}
+
+	sort.SliceStable(chapters, func(i, j int) bool {
+		return chapters[i].ModTime.After(chapters[j].ModTime)
+	})
+	return chapters, nil
+}
+
+// readLocalChapter describes the chapter in dir, whose path relative to the
+// output root is rel. It reports false when dir holds no pages.
+func readLocalChapter(dir, rel string) (LocalChapter, bool) {
+	chapter := LocalChapter{ID: chapterID(rel), Dir: rel}
+	if m, err := readManifest(dir); err == nil {
+		chapter.Manifest = &m
+	}
+	pages, err := chapterPageFiles(dir, chapter.Manifest)
+	if err != nil || len(pages) == 0 {
+		return LocalChapter{}, false
+	}
+	chapter.Pages = pages
+	return chapter, true
+}
+
+// chapterPageFiles returns the page files present in dir in reading order:
+// those named by the manifest when there is one, otherwise the numbered
+// page files.
+func chapterPageFiles(dir string, m *Manifest) ([]string, error) {
+	if m == nil {
+		return listPageFiles(dir)
+	}
+	var pages []string
+	for _, p := range m.Pages {
+		if p.File == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, p.File)); err == nil {
+			pages = append(pages, p.File)
+		}
+	}
+	return pages, nil
+}
+
+// isChapterDir reports whether dir has a manifest or at least one page file.
+func isChapterDir(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, manifestFile)); err == nil {
+		return true
+	}
+	pages, err := listPageFiles(dir)
+	return err == nil && len(pages) > 0
+}
+
+// findChapter looks a chapter up by its ID.
+func findChapter(root, id string) (LocalChapter, bool) {
+	chapters, err := scanChapters(root)
+	if err != nil {
+		return LocalChapter{}, false
+	}
+	for _, c := range chapters {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return LocalChapter{}, false
+}
+
+// listPageFiles returns the page files in dir sorted by page number. Numbers
+// are compared numerically so that a 1000th page sorts after 999.png.
+func listPageFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type numbered struct {
+		name string
+		num  int
+	}
+	var pages []numbered
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		m := pageFilePattern.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		num, err := strconv.Atoi(m[1])
+		if err != nil {
+			continue
+		}
+		pages = append(pages, numbered{name: entry.Name(), num: num})
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].num < pages[j].num })
+
+	names := make([]string, len(pages))
+	for i, p := range pages {
+		names[i] = p.name
+	}
+	return names, nil
+}
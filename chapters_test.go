@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScanChaptersSortsPagesNumerically(t *testing.T) {
+	root := t.TempDir()
+	chapter := filepath.Join(root, "2025-01-01-00-00-00-123")
+	writeTestFiles(t, chapter, "001.png", "999.png", "1000.png", "notes.txt", ".tmp-1.png")
+	writeTestFiles(t, filepath.Join(root, "empty"), "readme.txt")
+
+	chapters, err := scanChapters(root)
+	if err != nil {
+		t.Fatalf("scanChapters returned error: %v", err)
+	}
+	if len(chapters) != 1 {
+		t.Fatalf("len(chapters) = %d, want 1", len(chapters))
+	}
+	want := []string{"001.png", "999.png", "1000.png"}
+	if !reflect.DeepEqual(chapters[0].Pages, want) {
+		t.Fatalf("pages = %v, want %v", chapters[0].Pages, want)
+	}
+	if chapters[0].ID != chapterID("2025-01-01-00-00-00-123") {
+		t.Fatalf("ID = %q, want the ID of its directory", chapters[0].ID)
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
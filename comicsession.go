@@ -28,53 +28,99 @@ type ComicSession struct {
 	NetworkClient *NetworkClient
 	URL           string
 	Doc           *goquery.Document
+	Episode       Episode
 	Pages         []Page
-	OutDir        string
+	Output        ChapterOutput
 }
 
-func NewComicSession(cookieFile string) (*ComicSession, error) {
-	cookies, err := NewFileCookieLoader(cookieFile).Load()
-	reportCookieLoad(cookies, err)
+// SessionOptions configures NewComicSession.
+type SessionOptions struct {
+	CookieFile string
+	// URL is the chapter to download. When empty the user is prompted for
+	// one on stdin.
+	URL string
+	// OutRoot is the directory the chapter's output folder is created in.
+	OutRoot string
+	// Template lays out the chapter folder and page names inside OutRoot;
+	// nil keeps the classic timestamped folder of 001.png files.
+	Template *OutputTemplate
+	// Format is the encoding pages are saved in.
+	Format ImageFormat
+	// KeepOriginals also keeps every image as the server sent it.
+	KeepOriginals bool
+	// Scramble, when set, overrides the scrambling of the site for this
+	// episode's pages.
+	Scramble *ScrambleSpec
+	// Cache, when set, is used for every request of the session.
+	Cache *HTTPCache
+	// Fixtures, when set, records or replays every request of the session.
+	Fixtures *HTTPFixtures
+	// Proxies, when set, chooses the proxy of every request of the session.
+	Proxies *Proxies
+	// Transport sets the session's timeouts and HTTP version.
+	Transport TransportOptions
+	// Breaker, when set, pauses and then ends the session if the site
+	// stops answering.
+	Breaker *CircuitBreaker
+	// Library, when set, is consulted to skip episodes that were already
+	// downloaded, unless Force is set.
+	Library *Library
+	Force   bool
+}
+
+func NewComicSession(opts SessionOptions) (*ComicSession, error) {
+	cookies, err := NewFileCookieLoader(opts.CookieFile).Load()
+	reportCookieLoad(opts.CookieFile, cookies, err)
 	// A missing/broken cookie file is not fatal — the session simply
 	// continues unauthenticated, which reportCookieLoad already explained.
 
-	url, err := readComicDaysURL()
+	var url string
+	if opts.URL != "" {
+		url, err = normalizeComicDaysURL(opts.URL)
+	} else {
+		url, err = readComicDaysURL()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	networkClient := NewNetworkClient(15 * time.Second)
+	networkClient := NewNetworkClient(opts.Transport).UseProxies(opts.Proxies).UseCircuitBreaker(opts.Breaker).UseFixtures(opts.Fixtures).UseCache(opts.Cache)
 
 	doc, err := fetchComicHTMLWithRetry(url, cookies, networkClient)
 	if err != nil {
 		return nil, err
 	}
 
-	jsonData, err := extractEpisodeJSON(doc)
-	if err != nil {
-		return nil, err
-	}
-
-	pages, err := parsePages(jsonData)
+	episode, pages, err := loadEpisode(doc, url)
 	if err != nil {
 		return nil, err
 	}
 	pterm.Success.Printfln("📖 Parsed episode data — %d page(s) found", len(pages))
+	if opts.Scramble != nil {
+		for i := range pages {
+			pages[i].Scramble = *opts.Scramble
+		}
+	}
+	if entry, ok := opts.Library.Has(episode); ok && !opts.Force {
+		return nil, &AlreadyDownloadedError{Entry: entry}
+	}
 
-	outDir, err := createOutputDir()
+	output, err := prepareChapterDir(opts.OutRoot, opts.Template, opts.Format, episode, pages)
 	if err != nil {
 		return nil, err
 	}
+	output.KeepOriginals = opts.KeepOriginals
 
-	printSessionSummary(len(pages), outDir, len(cookies))
+	printSessionSummary(len(pages), output.Dir, len(cookies), opts.Proxies.Describe(url))
 
 	return &ComicSession{
 		Cookies:       cookies,
 		NetworkClient: networkClient,
 		URL:           url,
 		Doc:           doc,
+		Episode:       episode,
 		Pages:         pages,
-		OutDir:        outDir,
+		Output:        output,
 	}, nil
 }
 
@@ -144,6 +190,20 @@ func fetchComicHTML(url string, cookies []Cookie, networkClient HTTPFetcher, onR
 	return doc, nil
 }
 
+// loadEpisode extracts and parses the metadata and page list embedded in
+// the chapter page fetched from url.
+func loadEpisode(doc *goquery.Document, url string) (Episode, []Page, error) {
+	jsonData, err := extractEpisodeJSON(doc)
+	if err != nil {
+		return Episode{}, nil, err
+	}
+	pages, err := parsePages(jsonData)
+	if err != nil {
+		return Episode{}, nil, err
+	}
+	return parseEpisode(jsonData, url), pages, nil
+}
+
 func extractEpisodeJSON(doc *goquery.Document) (string, error) {
 	jsonData, exists := doc.Find("#episode-json").Attr("data-value")
 	if !exists {
@@ -185,7 +245,9 @@ func parsePages(jsonData string) ([]Page, error) {
 		if err := validatePageDimensions(p.Width, p.Height); err != nil {
 			return nil, fmt.Errorf("invalid page %d dimensions: %w", i+1, err)
 		}
-		validPages = append(validPages, NewPage(src, p.Width, p.Height))
+		page := NewPage(src, p.Width, p.Height)
+		page.Scramble = scrambleSpecForURL(src)
+		validPages = append(validPages, page)
 	}
 	if len(validPages) == 0 {
 		return nil, fmt.Errorf("episode contains no pages")
@@ -196,14 +258,60 @@ func parsePages(jsonData string) ([]Page, error) {
 	return validPages, nil
 }
 
+// Episode is the descriptive metadata of a chapter, used to organise
+// downloads once they are on disk.
+type Episode struct {
+	ID          string `json:"id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Number      int    `json:"number,omitempty"`
+	SeriesID    string `json:"seriesId,omitempty"`
+	SeriesTitle string `json:"seriesTitle,omitempty"`
+	URL         string `json:"url"`
+	PublishedAt string `json:"publishedAt,omitempty"`
+}
+
+// parseEpisode extracts the chapter metadata from the episode JSON. Unlike
+// the page list none of it is required to download the chapter, so missing
+// or malformed fields are simply left empty.
+func parseEpisode(jsonData, url string) Episode {
+	episode := Episode{URL: url}
+	var data episodeJSON
+	// A field of an unexpected type only leaves that field empty:
+	// json.Unmarshal keeps decoding the rest before reporting the error.
+	_ = json.Unmarshal([]byte(jsonData), &data)
+	if data.ReadableProduct == nil {
+		return episode
+	}
+	rp := data.ReadableProduct
+	episode.ID = rp.ID
+	episode.Title = strings.TrimSpace(rp.Title)
+	episode.Number = rp.Number
+	episode.PublishedAt = rp.PublishedAt
+	if rp.Series != nil {
+		episode.SeriesID = rp.Series.ID
+		episode.SeriesTitle = strings.TrimSpace(rp.Series.Title)
+	}
+	return episode
+}
+
 type episodeJSON struct {
 	ReadableProduct *readableProductJSON `json:"readableProduct"`
 }
 
 type readableProductJSON struct {
+	ID            string             `json:"id"`
+	Title         string             `json:"title"`
+	Number        int                `json:"number"`
+	PublishedAt   string             `json:"publishedAt"`
+	Series        *seriesJSON        `json:"series"`
 	PageStructure *pageStructureJSON `json:"pageStructure"`
 }
 
+type seriesJSON struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+}
+
 type pageStructureJSON struct {
 	Pages []pageJSON `json:"pages"`
 }
@@ -215,8 +323,15 @@ type pageJSON struct {
 	Height int    `json:"height"`
 }
 
-func createOutputDir() (string, error) {
-	dir, err := os.MkdirTemp(".", time.Now().Format("2006-01-02-15-04-05")+"-")
+// createOutputDir creates a new, uniquely named chapter folder inside root.
+func createOutputDir(root string) (string, error) {
+	if root == "" {
+		root = "."
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %v", err)
+	}
+	dir, err := os.MkdirTemp(root, time.Now().Format("2006-01-02-15-04-05")+"-")
 	if err != nil {
 		return "", fmt.Errorf("failed to create output directory: %v", err)
 	}
@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestParsePagesValidatesAndKeepsOrder(t *testing.T) {
 	jsonData := `{
@@ -63,3 +67,98 @@ func TestParsePagesRejectsInvalidDimensions(t *testing.T) {
 		t.Fatal("parsePages accepted invalid dimensions")
 	}
 }
+
+func TestParseEpisodeReadsMetadata(t *testing.T) {
+	jsonData := `{
+		"readableProduct": {
+			"id": "3269754496306260262",
+			"title": " 第1話 ",
+			"number": 1,
+			"series": {"id": "13933686331623812157", "title": "作品名"},
+			"pageStructure": {"pages": []}
+		}
+	}`
+
+	got := parseEpisode(jsonData, "https://comic-days.com/episode/3269754496306260262")
+	want := Episode{
+		ID:          "3269754496306260262",
+		Title:       "第1話",
+		Number:      1,
+		SeriesID:    "13933686331623812157",
+		SeriesTitle: "作品名",
+		URL:         "https://comic-days.com/episode/3269754496306260262",
+	}
+	if got != want {
+		t.Fatalf("parseEpisode() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseEpisodeToleratesUnexpectedFieldTypes(t *testing.T) {
+	jsonData := `{"readableProduct": {"title": "第2話", "number": "two"}}`
+
+	got := parseEpisode(jsonData, "https://comic-days.com/episode/2")
+	if got.Title != "第2話" || got.Number != 0 {
+		t.Fatalf("parseEpisode() = %+v, want the title kept and the number left empty", got)
+	}
+}
+
+// FuzzParsePages feeds parsePages arbitrary episode JSON, seeded with the
+// hand-written episodes in testdata/episodes. They are synthetic, not
+// captured from the site: their shape follows #episode-json, but titles and
+// IDs are made up. parsePages must never panic, and every page it returns
+// must be usable: a trusted https image with positive dimensions within the
+// pixel limit and a valid scramble spec.
+func FuzzParsePages(f *testing.F) {
+	seeds, err := filepath.Glob(filepath.Join("testdata", "episodes", "*.json"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range seeds {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(string(data))
+	}
+	for _, seed := range []string{
+		`{"readableProduct":{"pageStructure":{"pages":[{"src":"//cdn-img.comic-days.com/public/page/2/1","width":2,"height":3}]}}}`,
+		`{"readableProduct":{"pageStructure":{"pages":[{"src":"https://cdn-img.comic-days.com/public/page/2/1","width":-1,"height":-3}]}}}`,
+		`{"readableProduct":{"pageStructure":{"pages":[{"src":"https://cdn-img.comic-days.com/public/page/2/1","width":100000,"height":100000}]}}}`,
+		`{"readableProduct":{"pageStructure":{"pages":[{"src":"https://example.com/1","width":2,"height":3}]}}}`,
+		`{"readableProduct":{"pageStructure":{"pages":[{"type":"main","src":1e3,"width":"2"}]}}}`,
+		`{"readableProduct":{"pageStructure":{"pages":[]}}}`,
+		`{"readableProduct":{"pageStructure":{"pages":null}}}`,
+		`{"readableProduct":null}`,
+		`[]`,
+		``,
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, jsonData string) {
+		pages, err := parsePages(jsonData)
+		if err != nil {
+			if pages != nil {
+				t.Fatalf("parsePages returned pages along with error %v", err)
+			}
+			return
+		}
+		if len(pages) == 0 {
+			t.Fatal("parsePages returned no pages and no error")
+		}
+		for i, p := range pages {
+			if p.Width <= 0 || p.Height <= 0 {
+				t.Fatalf("page %d has dimensions %dx%d", i+1, p.Width, p.Height)
+			}
+			if p.Width > imageLimits.MaxPixels/p.Height {
+				t.Fatalf("page %d (%dx%d) exceeds the pixel limit", i+1, p.Width, p.Height)
+			}
+			if src, err := normalizeComicDaysAssetURL(p.Src); err != nil || src != p.Src {
+				t.Fatalf("page %d src %q is not a normalized trusted URL (%q, %v)", i+1, p.Src, src, err)
+			}
+			if err := p.scrambleSpec().Validate(); err != nil {
+				t.Fatalf("page %d has an invalid scramble spec: %v", i+1, err)
+			}
+		}
+	})
+}
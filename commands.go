@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const appName = "ComicDaysGoDownloader"
+
+// command is a named subcommand such as `serve`. Running the program without
+// one downloads a single chapter (see runDownload in main.go).
+type command struct {
+	Name    string
+	Summary string
+	Run     func(args []string) error
+}
+
+// commandList returns every subcommand. It is a function rather than a
+// package variable because the commands' usage text refers back to it.
+func commandList() []command {
+	return []command{
+		{Name: "library", Summary: "list, show or remove downloaded episodes", Run: runLibrary},
+		{Name: "descramble", Summary: "restore scrambled images that are already on disk", Run: runDescramble},
+		{Name: "verify", Summary: "check downloaded chapters for missing or corrupted pages", Run: runVerify},
+		{Name: "watch", Summary: "poll series for new episodes and download them", Run: runWatch},
+		{Name: "serve", Summary: "run the web UI for queueing and reading downloads", Run: runServe},
+		{Name: "cache", Summary: "show or clear the cache of downloaded pages and images", Run: runCache},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commandList() {
+		if cmd.Name == name {
+			return &cmd
+		}
+	}
+	return nil
+}
+
+// newFlagSet returns a FlagSet that reports parse errors instead of exiting,
+// with a usage message built from name and synopsis. The top-level flag set
+// also lists the available subcommands.
+func newFlagSet(name, synopsis string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s %s\n", name, synopsis)
+		if name == appName {
+			fmt.Fprintf(out, "\nCommands:\n")
+			for _, cmd := range commandList() {
+				fmt.Fprintf(out, "  %-10s %s\n", cmd.Name, cmd.Summary)
+			}
+			fmt.Fprintf(out, "\nWithout a command, downloads a single chapter.\n")
+		}
+		fmt.Fprintf(out, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.SetOutput(os.Stderr)
+	return fs
+}
+
+// parseTemplateFlag parses an -output-template value; an empty value means
+// no template.
+func parseTemplateFlag(raw string) (*OutputTemplate, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	return ParseOutputTemplate(raw)
+}
+
+// addImageFormatFlags registers the flags that choose how pages are encoded
+// and returns a function that parses them once the flag set has been parsed.
+func addImageFormatFlags(flags *flag.FlagSet) func() (ImageFormat, error) {
+	format := flags.String("format", "png", "image format pages are saved in: png, jpeg, jpeg-lossless (the server's JPEG, unscrambled without re-encoding) or webp (lossless)")
+	quality := flags.Int("quality", defaultJPEGQuality, "JPEG quality (1-100)")
+	gray := flags.String("grayscale", grayAuto, "save black and white pages as grayscale: auto, off, or 4bit (16 levels, for e-ink)")
+	compression := flags.String("png-compression", "default", "PNG compression level: none, fast, default or best")
+	return func() (ImageFormat, error) {
+		// ParseImageFormat reads 0 as the default; on the command line it
+		// is just out of range.
+		if *quality < 1 {
+			return ImageFormat{}, fmt.Errorf("JPEG quality must be between 1 and 100, got %d", *quality)
+		}
+		return ParseImageFormat(*format, *quality, *gray, *compression)
+	}
+}
+
+// addKeepOriginalFlag registers -keep-original, which keeps the server's
+// images next to the pages (see original.go).
+func addKeepOriginalFlag(flags *flag.FlagSet) *bool {
+	return flags.Bool("keep-original", false, "also save every image exactly as the server sent it next to its page, e.g. 001.original.jpg")
+}
+
+// subcommandFlagSet is newFlagSet for a named subcommand.
+func subcommandFlagSet(name, synopsis string) *flag.FlagSet {
+	return newFlagSet(appName+" "+name, synopsis)
+}
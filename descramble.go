@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/disintegration/imaging"
+	"github.com/pterm/pterm"
+)
+
+// descrambleInputExts are the image files a directory argument of the
+// descramble command picks up.
+var descrambleInputExts = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".webp": true, ".gif": true, ".bmp": true,
+}
+
+func runDescramble(args []string) error {
+	flags := subcommandFlagSet("descramble", "[flags] <file|dir|glob>...")
+	outDir := flags.String("out", "descrambled", "directory the restored images are written to")
+	scramble := flags.String("scramble", "transpose", "how the images are scrambled: none, transpose, or COLSxROWS/MULTIPLE[:PERMUTATION]")
+	detect := flags.Bool("detect", true, "check each image and leave it as it is when it is not scrambled")
+	jobs := flags.Int("jobs", runtime.NumCPU(), "how many images to process at once")
+	imageFormatFlag := addImageFormatFlags(flags)
+	applyImageLimits := addImageLimitFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no images given: pass files, directories or glob patterns")
+	}
+
+	spec, err := ParseScrambleSpec(*scramble)
+	if err != nil {
+		return err
+	}
+	format, err := imageFormatFlag()
+	if err != nil {
+		return err
+	}
+	if err := applyImageLimits(); err != nil {
+		return err
+	}
+	inputs, err := expandDescrambleInputs(flags.Args())
+	if err != nil {
+		return err
+	}
+	tasks, err := planDescramble(inputs, *outDir, format)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	pterm.Info.Printfln("Restoring %d image(s) into %s (%s)", len(tasks), *outDir, spec)
+	failed := runDescrambleTasks(tasks, spec, *detect, format, *jobs)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d image(s) failed", failed, len(tasks))
+	}
+	pterm.Success.Printfln("All %d image(s) restored", len(tasks))
+	return nil
+}
+
+// expandDescrambleInputs turns the command's arguments into a sorted list of
+// image files. Arguments may be files, directories (whose images are taken,
+// without descending further) or glob patterns.
+func expandDescrambleInputs(args []string) ([]string, error) {
+	seen := map[string]bool{}
+	var files []string
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+
+	for _, arg := range args {
+		matches := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			var err error
+			matches, err = filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("%s matches no files", arg)
+			}
+		}
+		for _, path := range matches {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(path)
+				continue
+			}
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s: %v", path, err)
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() && descrambleInputExts[strings.ToLower(filepath.Ext(entry.Name()))] {
+					add(filepath.Join(path, entry.Name()))
+				}
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no images found")
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// descrambleTask is one image to restore.
+type descrambleTask struct {
+	in, out string
+}
+
+// planDescramble names the output file of every input: its base name with
+// the extension of format, inside outDir. Two inputs with the same base name
+// or an output that would overwrite its input are refused up front rather
+// than discovered halfway through.
+func planDescramble(inputs []string, outDir string, format ImageFormat) ([]descrambleTask, error) {
+	absOut, err := filepath.Abs(outDir)
+	if err != nil {
+		return nil, err
+	}
+	from := map[string]string{}
+	var tasks []descrambleTask
+	for _, in := range inputs {
+		base := strings.TrimSuffix(filepath.Base(in), filepath.Ext(in))
+		out := filepath.Join(outDir, base+"."+format.Ext())
+		names := []string{out}
+		if format.keepsJPEG() {
+			// The PNG an image may fall back to is claimed too.
+			names = append(names, descrambleFallbackPath(out, format))
+		}
+		for _, name := range names {
+			if prev, ok := from[name]; ok {
+				return nil, fmt.Errorf("%s and %s would both be written to %s", prev, in, name)
+			}
+			from[name] = in
+		}
+		if absIn, err := filepath.Abs(in); err == nil && absIn == filepath.Join(absOut, filepath.Base(out)) {
+			return nil, fmt.Errorf("%s would be overwritten; choose another -out directory", in)
+		}
+		tasks = append(tasks, descrambleTask{in: in, out: out})
+	}
+	return tasks, nil
+}
+
+// runDescrambleTasks restores tasks on up to jobs goroutines, printing one
+// line per image, and returns how many failed.
+func runDescrambleTasks(tasks []descrambleTask, spec ScrambleSpec, detect bool, format ImageFormat, jobs int) int {
+	if jobs < 1 {
+		jobs = 1
+	}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		done   int
+		failed int
+		queue  = make(chan descrambleTask)
+	)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				res, err := descrambleFile(t.in, t.out, spec, detect, format)
+				mu.Lock()
+				done++
+				if err != nil {
+					failed++
+					pterm.Error.Printfln("[%d/%d] %s: %v", done, len(tasks), t.in, err)
+				} else {
+					detection := res.detection
+					pterm.Success.Printfln("[%d/%d] %s → %s · %s", done, len(tasks), t.in, res.out, detection.Describe())
+					if res.fallback != nil {
+						pterm.Warning.Printfln("%s could not be restored as lossless JPEG (%v) and was saved as PNG", t.in, res.fallback)
+					}
+					if !detection.Certain {
+						pterm.Warning.Printfln("could not tell how %s was scrambled — check that it looks right", t.in)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, t := range tasks {
+		queue <- t
+	}
+	close(queue)
+	wg.Wait()
+	return failed
+}
+
+// descrambled is the outcome of descrambleFile.
+type descrambled struct {
+	detection scrambleDetection
+	// out is the file written, which differs from the planned one when a
+	// lossless JPEG had to fall back to PNG.
+	out string
+	// fallback is why the lossless JPEG restore was impossible, if it was.
+	fallback error
+}
+
+// descrambleFallbackPath is where the restored image planned for out goes
+// when the jpeg-lossless format falls back to pixels.
+func descrambleFallbackPath(out string, format ImageFormat) string {
+	return strings.TrimSuffix(out, filepath.Ext(out)) + "." + format.pixelFallback().Ext()
+}
+
+// descrambleFile restores the image in the file in and writes it to out.
+// With detect set, the image is first checked (see detectScramble) and only
+// restored when it is actually scrambled.
+func descrambleFile(in, out string, spec ScrambleSpec, detect bool, format ImageFormat) (descrambled, error) {
+	f, err := os.Open(in)
+	if err != nil {
+		return descrambled{}, err
+	}
+	size := int64(-1)
+	if st, err := f.Stat(); err == nil {
+		size = st.Size()
+	}
+	raw, err := readImage(f, size, validatePageDimensions)
+	f.Close()
+	if err != nil {
+		return descrambled{}, err
+	}
+	img, err := imaging.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return descrambled{}, fmt.Errorf("could not decode: %v", err)
+	}
+	b := img.Bounds()
+
+	res := descrambled{detection: scrambleDetection{Spec: spec, Certain: true}, out: out}
+	if detect {
+		res.detection = detectScramble(img, b.Dx(), b.Dy(), spec)
+	}
+	ip := NewImageContext(img)
+	ip.Raw = raw
+	ip.Spec = res.detection.Spec
+	ip.Format = format
+	if format.keepsJPEG() {
+		data, err := ip.RestoreJPEG()
+		if err == nil {
+			if err := writeFileAtomic(out, data); err != nil {
+				return descrambled{}, fmt.Errorf("could not save %s: %v", out, err)
+			}
+			return res, nil
+		}
+		res.fallback = err
+		res.out = descrambleFallbackPath(out, format)
+		ip.Format = format.pixelFallback()
+	}
+	ip.Deobfuscate(b.Dx(), b.Dy())
+	if err := ip.SaveImage(res.out); err != nil {
+		return descrambled{}, fmt.Errorf("could not save %s: %v", res.out, err)
+	}
+	return res, nil
+}
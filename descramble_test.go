@@ -0,0 +1,84 @@
+package main
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestImage(t *testing.T, path string, img image.Image) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunDescrambleRestoresGlobbedFiles(t *testing.T) {
+	in := t.TempDir()
+	out := filepath.Join(t.TempDir(), "restored")
+	art := testArtwork(330, 470)
+	writeTestImage(t, filepath.Join(in, "a.png"), scrambleWith(art, comicDaysScramble))
+	writeTestImage(t, filepath.Join(in, "b.png"), art)
+	writeTestFiles(t, in, "notes.txt")
+
+	err := runDescramble([]string{"-out", out, "-grayscale", "off", "-jobs", "2", filepath.Join(in, "*.png")})
+	if err != nil {
+		t.Fatalf("runDescramble returned error: %v", err)
+	}
+	for _, name := range []string{"a.png", "b.png"} {
+		f, err := os.Open(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < 470; y++ {
+			for x := 0; x < 330; x++ {
+				if got.At(x, y) != art.At(x, y) {
+					t.Fatalf("%s: pixel (%d,%d) = %v, want %v", name, x, y, got.At(x, y), art.At(x, y))
+				}
+			}
+		}
+	}
+}
+
+func TestExpandDescrambleInputs(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, "2.jpg", "1.PNG", "x.txt")
+	writeTestFiles(t, filepath.Join(dir, "sub"), "3.png")
+
+	files, err := expandDescrambleInputs([]string{dir, filepath.Join(dir, "*.jpg")})
+	if err != nil {
+		t.Fatalf("expandDescrambleInputs returned error: %v", err)
+	}
+	if len(files) != 2 || files[0] != filepath.Join(dir, "1.PNG") || files[1] != filepath.Join(dir, "2.jpg") {
+		t.Fatalf("files = %v", files)
+	}
+	if _, err := expandDescrambleInputs([]string{filepath.Join(dir, "*.gif")}); err == nil {
+		t.Fatal("a pattern matching nothing was accepted")
+	}
+}
+
+func TestPlanDescrambleRefusesCollisions(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := planDescramble([]string{filepath.Join(dir, "a", "1.jpg"), filepath.Join(dir, "b", "1.png")}, "out", ImageFormat{}); err == nil {
+		t.Fatal("two inputs mapped to the same output")
+	}
+	if _, err := planDescramble([]string{filepath.Join(dir, "1.png")}, dir, ImageFormat{}); err == nil {
+		t.Fatal("an input would have been overwritten")
+	}
+	tasks, err := planDescramble([]string{filepath.Join(dir, "1.png")}, dir, ImageFormat{Name: "webp"})
+	if err != nil || tasks[0].out != filepath.Join(dir, "1.webp") {
+		t.Fatalf("tasks = %+v, %v", tasks, err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"sort"
+)
+
+// Pages are not always scrambled the way their site usually scrambles them:
+// some chapters (or single pages, such as ads) are served as they are, and
+// "restoring" those would scramble them instead. detectScramble therefore
+// looks at each page before it is restored. In a correctly arranged picture
+// the pixels on either side of a cell boundary are nearly as similar as any
+// other neighbouring pixels, while a wrong arrangement puts unrelated image
+// content side by side. So every candidate arrangement is scored by the
+// average difference across the cell seams it would produce, and the
+// smoothest one wins.
+
+// flatSeamCost is the seam score below which every arrangement looks the
+// same, as on blank or nearly blank pages. Which one is picked then makes
+// no visible difference.
+const flatSeamCost = 2.0
+
+// confidentSeamRatio is how much smoother the best arrangement must be than
+// the runner-up for the choice to count as certain.
+const confidentSeamRatio = 0.75
+
+// scrambleDetection is the outcome of detectScramble for one page.
+type scrambleDetection struct {
+	// Spec is the arrangement the page is restored with.
+	Spec ScrambleSpec
+	// Certain is false when no arrangement was clearly better than the
+	// others, so the restored page may still be scrambled.
+	Certain bool
+}
+
+// Describe summarises the detection for the page's status line.
+func (d scrambleDetection) Describe() string {
+	s := "not scrambled"
+	if !d.Spec.IsIdentity() {
+		s = "unscrambled " + d.Spec.String()
+	}
+	if !d.Certain {
+		s += " (uncertain)"
+	}
+	return s
+}
+
+// detectScramble decides how img, a width x height page expected to be
+// scrambled as expected, is actually arranged. The candidates are expected
+// itself, its inverse, and no scrambling at all; when they cannot be told
+// apart, expected is assumed.
+func detectScramble(img image.Image, width, height int, expected ScrambleSpec) scrambleDetection {
+	cellWidth, cellHeight := expected.cellSize(width, height)
+	if expected.IsIdentity() || cellWidth == 0 || cellHeight == 0 {
+		return scrambleDetection{Spec: expected, Certain: true}
+	}
+
+	identity := expected
+	identity.Name = noScramble.Name
+	identity.Permutation = make([]int, len(expected.Permutation))
+	inverse := expected
+	inverse.Name = expected.String() + " (inverse)"
+	inverse.Permutation = make([]int, len(expected.Permutation))
+	for i, p := range expected.Permutation {
+		identity.Permutation[i] = i
+		inverse.Permutation[p] = i
+	}
+
+	candidates := []ScrambleSpec{expected, identity}
+	if !equalInts(inverse.Permutation, expected.Permutation) {
+		candidates = append(candidates, inverse)
+	}
+
+	type scored struct {
+		spec ScrambleSpec
+		cost float64
+	}
+	luma := lumaSampler(img)
+	var scores []scored
+	for _, c := range candidates {
+		scores = append(scores, scored{spec: c, cost: seamCost(luma, c, width, height)})
+	}
+	// The stable sort keeps expected first among equal scores.
+	sort.SliceStable(scores, func(i, j int) bool { return scores[i].cost < scores[j].cost })
+
+	best, runnerUp := scores[0], scores[1]
+	if runnerUp.cost < flatSeamCost {
+		return scrambleDetection{Spec: expected, Certain: true}
+	}
+	spec := best.spec
+	if spec.IsIdentity() {
+		spec = noScramble
+	}
+	return scrambleDetection{Spec: spec, Certain: best.cost < runnerUp.cost*confidentSeamRatio}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// seamCost is the mean absolute luma difference across the internal cell
+// boundaries of the picture that spec would restore from the scrambled
+// image, including the boundaries between the grid and the unscrambled
+// margins.
+func seamCost(luma func(x, y int) int, spec ScrambleSpec, width, height int) float64 {
+	cellWidth, cellHeight := spec.cellSize(width, height)
+	gridWidth, gridHeight := cellWidth*spec.Columns, cellHeight*spec.Rows
+
+	// origin returns where the content of picture cell i lies in the
+	// scrambled image.
+	origin := func(i int) (int, int) {
+		from := spec.Permutation[i]
+		return (from % spec.Columns) * cellWidth, (from / spec.Columns) * cellHeight
+	}
+
+	var total, count int
+	for i := range spec.Permutation {
+		col, row := i%spec.Columns, i/spec.Columns
+		x0, y0 := origin(i)
+
+		// The right edge of the cell against the next cell, or the margin.
+		nextX, nextY, ok := -1, -1, false
+		if col < spec.Columns-1 {
+			nextX, nextY = origin(i + 1)
+			ok = true
+		} else if gridWidth < width {
+			nextX, nextY = gridWidth, row*cellHeight
+			ok = true
+		}
+		if ok {
+			for y := 0; y < cellHeight; y++ {
+				total += absInt(luma(x0+cellWidth-1, y0+y) - luma(nextX, nextY+y))
+				count++
+			}
+		}
+
+		// The bottom edge of the cell against the cell below, or the margin.
+		ok = false
+		if row < spec.Rows-1 {
+			nextX, nextY = origin(i + spec.Columns)
+			ok = true
+		} else if gridHeight < height {
+			nextX, nextY = col*cellWidth, gridHeight
+			ok = true
+		}
+		if ok {
+			for x := 0; x < cellWidth; x++ {
+				total += absInt(luma(x0+x, y0+cellHeight-1) - luma(nextX+x, nextY))
+				count++
+			}
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return float64(total) / float64(count)
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// lumaSampler returns a function reading the luma (0-255) of img at x, y
+// relative to its top-left corner, with fast paths for the image types the
+// decoders produce.
+func lumaSampler(img image.Image) func(x, y int) int {
+	off := img.Bounds().Min
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return func(x, y int) int { return int(img.Y[img.YOffset(off.X+x, off.Y+y)]) }
+	case *image.Gray:
+		return func(x, y int) int { return int(img.Pix[img.PixOffset(off.X+x, off.Y+y)]) }
+	case *image.RGBA:
+		return func(x, y int) int {
+			i := img.PixOffset(off.X+x, off.Y+y)
+			return luma8(img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+		}
+	case *image.NRGBA:
+		return func(x, y int) int {
+			i := img.PixOffset(off.X+x, off.Y+y)
+			return luma8(img.Pix[i], img.Pix[i+1], img.Pix[i+2])
+		}
+	default:
+		return func(x, y int) int {
+			return int(color.GrayModel.Convert(img.At(off.X+x, off.Y+y)).(color.Gray).Y)
+		}
+	}
+}
+
+// luma8 is the same weighting color.GrayModel uses.
+func luma8(r, g, b uint8) int {
+	return (19595*int(r) + 38470*int(g) + 7471*int(b) + 1<<15) >> 16
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// testArtwork draws a picture whose content runs smoothly across any cell
+// boundary: gradients with a few dark shapes, like a page of line art.
+func testArtwork(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(40 + (x*120)/width + (y*80)/height)
+			dx, dy := x-width/3, y-height/2
+			if dx*dx+dy*dy < (width/5)*(width/5) {
+				v = 20
+			}
+			if (x+2*y)%97 < 3 {
+				v = 0
+			}
+			img.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return img
+}
+
+// scrambleWith scrambles the picture img as spec describes.
+func scrambleWith(img *image.RGBA, spec ScrambleSpec) *image.RGBA {
+	b := img.Bounds()
+	return Scramble(img, spec, b.Dx(), b.Dy())
+}
+
+func TestDetectScrambleRecognisesScrambledPages(t *testing.T) {
+	const width, height = 410, 590
+	art := testArtwork(width, height)
+
+	got := detectScramble(scrambleWith(art, comicDaysScramble), width, height, comicDaysScramble)
+	if got.Spec.Name != comicDaysScramble.Name || !got.Certain {
+		t.Fatalf("scrambled page: detected %s", got.Describe())
+	}
+
+	got = detectScramble(art, width, height, comicDaysScramble)
+	if !got.Spec.IsIdentity() || !got.Certain {
+		t.Fatalf("unscrambled page: detected %s", got.Describe())
+	}
+	if got.Describe() != "not scrambled" {
+		t.Fatalf("Describe = %q", got.Describe())
+	}
+}
+
+func TestDetectScrambleTriesTheInversePermutation(t *testing.T) {
+	const width, height = 400, 300
+	rotate, err := ParseScrambleSpec("3x1/8:1,2,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inverse, err := ParseScrambleSpec("3x1/8:2,0,1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	art := testArtwork(width, height)
+
+	got := detectScramble(scrambleWith(art, inverse), width, height, rotate)
+	if !equalInts(got.Spec.Permutation, inverse.Permutation) || !got.Certain {
+		t.Fatalf("detected %s with permutation %v, want %v", got.Describe(), got.Spec.Permutation, inverse.Permutation)
+	}
+}
+
+func TestDetectScrambleAssumesExpectedOnBlankPages(t *testing.T) {
+	blank := image.NewGray(image.Rect(0, 0, 300, 300))
+	for i := range blank.Pix {
+		blank.Pix[i] = 255
+	}
+	got := detectScramble(blank, 300, 300, comicDaysScramble)
+	if got.Spec.Name != comicDaysScramble.Name || !got.Certain {
+		t.Fatalf("blank page: detected %s", got.Describe())
+	}
+}
+
+func TestDetectScrambleFlagsNoise(t *testing.T) {
+	noise := image.NewGray(image.Rect(0, 0, 256, 256))
+	state := uint32(1)
+	for i := range noise.Pix {
+		state = state*1664525 + 1013904223
+		noise.Pix[i] = uint8(state >> 24)
+	}
+	if got := detectScramble(noise, 256, 256, comicDaysScramble); got.Certain {
+		t.Fatalf("random noise: detected %s with certainty", got.Describe())
+	}
+}
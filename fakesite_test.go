@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This file is a fake Comic Days for end-to-end tests: an HTTP server with
+// episode pages carrying #episode-json, and page images scrambled on the fly
+// with Scramble. Pages can be made to misbehave the way the real site and
+// its CDN sometimes do, and episodes can be gated behind a cookie.
+
+// fakeFault is one way a fake page image request can go wrong.
+type fakeFault int
+
+const (
+	// faultTooManyRequests answers 429 with Retry-After: 0.
+	faultTooManyRequests fakeFault = iota + 1
+	// faultTruncated sends half the image, then drops the connection.
+	faultTruncated
+	// faultSlow sends the whole image, but in small, delayed chunks.
+	faultSlow
+	// faultServerError answers 500.
+	faultServerError
+)
+
+type fakePage struct {
+	Width, Height int
+	// JPEG serves the image as a JPEG instead of a PNG.
+	JPEG bool
+	// Faults are served one per request, in order, before the page image
+	// is served normally.
+	Faults []fakeFault
+}
+
+type fakeEpisode struct {
+	ID, Title, Series string
+	Number            int
+	Pages             []fakePage
+	// Cookie, when set, is the value of the glsc cookie the page images
+	// require; without it they answer 403.
+	Cookie string
+}
+
+type fakeSite struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	episodes map[string]*fakeEpisode
+	// requests counts the requests made for every path.
+	requests map[string]int
+}
+
+// newFakeSite starts a fake site with episodes and points the downloader
+// at it (see useSiteURL) for the rest of the test. It also shortens the
+// retry delays so misbehaving pages do not slow the tests down.
+func newFakeSite(t *testing.T, episodes ...*fakeEpisode) *fakeSite {
+	t.Helper()
+	s := &fakeSite{episodes: map[string]*fakeEpisode{}, requests: map[string]int{}}
+	for _, e := range episodes {
+		s.episodes[e.ID] = e
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+
+	savedBase, savedRetry := baseDelay, retryDelay
+	baseDelay, retryDelay = time.Millisecond, time.Millisecond
+	if err := useSiteURL(s.URL); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		baseDelay, retryDelay = savedBase, savedRetry
+		useSiteURL("")
+	})
+	return s
+}
+
+// useSiteURL makes raw (or defaultSiteURL, when raw is empty) the site URLs
+// are checked against and page requests claim to come from.
+func useSiteURL(raw string) error {
+	if raw == "" {
+		raw = defaultSiteURL
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid site URL %q: want scheme://host", raw)
+	}
+	siteURL = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	return nil
+}
+
+// EpisodeURL is the address of the episode's page.
+func (s *fakeSite) EpisodeURL(id string) string {
+	return s.URL + "/episode/" + id
+}
+
+// Requests returns how often path was requested.
+func (s *fakeSite) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// fakePicture is the unscrambled picture of page n of an episode; pages
+// differ so a page saved in the wrong place shows up.
+func fakePicture(p fakePage, n int) *image.RGBA {
+	img := testPicture(p.Width, p.Height)
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			c := img.RGBAAt(x, y)
+			c.B = uint8(n * 40)
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func (s *fakeSite) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	count := s.requests[r.URL.Path]
+	s.mu.Unlock()
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "episode":
+		s.serveEpisode(w, parts[1])
+	case len(parts) == 3 && parts[0] == "images":
+		n, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveImage(w, r, parts[1], n, count)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeSite) serveEpisode(w http.ResponseWriter, id string) {
+	e, ok := s.episodes[id]
+	if !ok {
+		http.Error(w, "no such episode", http.StatusNotFound)
+		return
+	}
+	var pages []pageJSON
+	for i, p := range e.Pages {
+		pages = append(pages, pageJSON{
+			Src:    fmt.Sprintf("%s/images/%s/%d", s.URL, id, i+1),
+			Type:   "main",
+			Width:  p.Width,
+			Height: p.Height,
+		})
+	}
+	pages = append(pages, pageJSON{Type: "backMatter"})
+	data, err := json.Marshal(episodeJSON{ReadableProduct: &readableProductJSON{
+		ID:            e.ID,
+		Title:         e.Title,
+		Number:        e.Number,
+		PublishedAt:   "2024-05-01T12:00:00+09:00",
+		Series:        &seriesJSON{ID: "series-" + e.ID, Title: e.Series},
+		PageStructure: &pageStructureJSON{Pages: pages},
+	}})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html><html><head><title>%s</title></head><body>
+<script id="episode-json" type="text/json" data-value="%s"></script>
+</body></html>`, html.EscapeString(e.Title), html.EscapeString(string(data)))
+}
+
+func (s *fakeSite) serveImage(w http.ResponseWriter, r *http.Request, id string, n, count int) {
+	e, ok := s.episodes[id]
+	if !ok || n < 1 || n > len(e.Pages) {
+		http.NotFound(w, r)
+		return
+	}
+	if e.Cookie != "" {
+		if c, err := r.Cookie("glsc"); err != nil || c.Value != e.Cookie {
+			http.Error(w, "purchase required", http.StatusForbidden)
+			return
+		}
+	}
+	p := e.Pages[n-1]
+	var fault fakeFault
+	if count <= len(p.Faults) {
+		fault = p.Faults[count-1]
+	}
+
+	switch fault {
+	case faultTooManyRequests:
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return
+	case faultServerError:
+		http.Error(w, "oops", http.StatusInternalServerError)
+		return
+	}
+
+	scrambled := Scramble(fakePicture(p, n), comicDaysScramble, p.Width, p.Height)
+	var body bytes.Buffer
+	contentType := "image/png"
+	if p.JPEG {
+		contentType = "image/jpeg"
+		jpeg.Encode(&body, scrambled, &jpeg.Options{Quality: 90})
+	} else {
+		png.Encode(&body, scrambled)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, id, n))
+
+	switch fault {
+	case faultTruncated:
+		w.Write(body.Bytes()[:body.Len()/2])
+		// Hijacking drops the connection with the body incomplete.
+		if hj, ok := w.(http.Hijacker); ok {
+			w.(http.Flusher).Flush()
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+			}
+		}
+	case faultSlow:
+		data := body.Bytes()
+		for len(data) > 0 {
+			chunk := min(len(data), 512)
+			w.Write(data[:chunk])
+			w.(http.Flusher).Flush()
+			data = data[chunk:]
+			time.Sleep(2 * time.Millisecond)
+		}
+	default:
+		w.Write(body.Bytes())
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// HTTPFixtures records the requests of a run and their responses into a
+// folder of fixture files, or replays them from one without touching the
+// network. A recording of a user's failing run reproduces the bug offline,
+// and recordings make end-to-end tests of NewComicSession possible without
+// the live site. Cookies and credentials are redacted before anything is
+// written.
+type HTTPFixtures struct {
+	Dir    string
+	Replay bool
+}
+
+// fixture is one recorded request and its response.
+type fixture struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	RequestHeader http.Header `json:"requestHeader,omitempty"`
+	Status        int         `json:"status"`
+	Header        http.Header `json:"header,omitempty"`
+	// Body is the response body when it is text; binary bodies are kept
+	// in BodyBase64 instead.
+	Body       string `json:"body,omitempty"`
+	BodyBase64 []byte `json:"bodyBase64,omitempty"`
+	// Incomplete is set when the run stopped reading the body before its
+	// end (a stall, an image over the size limit); Body then holds what
+	// was read, and replaying it fails the same way.
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// redactedHeaders are request headers whose value never goes into a fixture.
+var redactedHeaders = []string{"Cookie", "Authorization", "Proxy-Authorization"}
+
+const redacted = "REDACTED"
+
+// addFixtureFlags registers -record and -replay and returns a function that
+// checks them once the flag set has been parsed. It returns nil fixtures
+// when neither is given.
+func addFixtureFlags(flags *flag.FlagSet) func() (*HTTPFixtures, error) {
+	record := flags.String("record", "", "record every HTTP exchange into this folder (cookies are redacted), e.g. to attach to a bug report")
+	replay := flags.String("replay", "", "answer HTTP requests from a folder made with -record instead of the network")
+	return func() (*HTTPFixtures, error) {
+		switch {
+		case *record != "" && *replay != "":
+			return nil, fmt.Errorf("-record and -replay cannot be used together")
+		case *record != "":
+			if err := os.MkdirAll(*record, 0o755); err != nil {
+				return nil, fmt.Errorf("could not create the recording folder: %v", err)
+			}
+			return &HTTPFixtures{Dir: *record}, nil
+		case *replay != "":
+			if _, err := os.Stat(*replay); err != nil {
+				return nil, fmt.Errorf("could not open the recording: %v", err)
+			}
+			return &HTTPFixtures{Dir: *replay, Replay: true}, nil
+		}
+		return nil, nil
+	}
+}
+
+// Transport returns a RoundTripper that replays the fixtures, or that sends
+// requests to next and records them.
+func (f *HTTPFixtures) Transport(next http.RoundTripper) http.RoundTripper {
+	if f.Replay {
+		return &replayTransport{dir: f.Dir}
+	}
+	return &recordingTransport{dir: f.Dir, next: next}
+}
+
+var fixtureNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fixturePath names the fixture file of a request: a readable slug of the
+// URL followed by a hash of the method and full URL.
+func fixturePath(dir, method, url string) string {
+	sum := sha256.Sum256([]byte(method + " " + url))
+	slug := url
+	if i := strings.Index(slug, "://"); i >= 0 {
+		slug = slug[i+3:]
+	}
+	slug = strings.Trim(fixtureNameUnsafe.ReplaceAllString(slug, "_"), "_")
+	if len(slug) > 80 {
+		slug = slug[:80]
+	}
+	return filepath.Join(dir, slug+"-"+hex.EncodeToString(sum[:4])+".json")
+}
+
+// saveFixture writes f into dir, replacing an earlier recording of the same
+// request.
+func saveFixture(dir string, f fixture) error {
+	return writeJSONFile(fixturePath(dir, f.Method, f.URL), f)
+}
+
+// redactHeader returns a copy of h without secrets: the redactedHeaders
+// and the values of Set-Cookie.
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range redactedHeaders {
+		if out.Get(name) != "" {
+			out.Set(name, redacted)
+		}
+	}
+	for i, c := range out.Values("Set-Cookie") {
+		name, _, _ := strings.Cut(c, "=")
+		out["Set-Cookie"][i] = name + "=" + redacted
+	}
+	return out
+}
+
+type recordingTransport struct {
+	dir  string
+	next http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	f := fixture{
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		RequestHeader: redactHeader(req.Header),
+		Status:        resp.StatusCode,
+		Header:        redactHeader(resp.Header),
+	}
+	resp.Body = &fixtureRecorder{dir: t.dir, fixture: f, body: resp.Body, done: resp.ContentLength == 0}
+	return resp, nil
+}
+
+// fixtureRecorder copies everything the caller reads from a response body
+// and writes the fixture when the body is closed. Reading stays in the
+// caller's hands, so its size limits and stall timeout still apply.
+type fixtureRecorder struct {
+	dir     string
+	fixture fixture
+	body    io.ReadCloser
+	read    bytes.Buffer
+	// done is set once the body has been read to the end.
+	done, closed bool
+}
+
+func (r *fixtureRecorder) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	r.read.Write(p[:n])
+	if err == io.EOF {
+		r.done = true
+	}
+	return n, err
+}
+
+func (r *fixtureRecorder) Close() error {
+	err := r.body.Close()
+	if r.closed {
+		return err
+	}
+	r.closed = true
+	f := r.fixture
+	body := r.read.Bytes()
+	if utf8.Valid(body) && !strings.HasPrefix(f.Header.Get("Content-Type"), "image/") {
+		f.Body = string(body)
+	} else {
+		f.BodyBase64 = body
+	}
+	f.Incomplete = !r.done
+	if serr := saveFixture(r.dir, f); serr != nil && err == nil {
+		err = fmt.Errorf("could not record %s: %v", f.URL, serr)
+	}
+	return err
+}
+
+type replayTransport struct {
+	dir string
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	var f fixture
+	err := readJSONFile(fixturePath(t.dir, req.Method, req.URL.String()), &f)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Retrying cannot make a recording appear.
+		return nil, &PermanentError{Err: fmt.Errorf("no recorded response for %s %s in %s", req.Method, req.URL, t.dir)}
+	}
+	if err != nil {
+		return nil, &PermanentError{Err: err}
+	}
+	body := f.BodyBase64
+	if body == nil {
+		body = []byte(f.Body)
+	}
+	header := f.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	var r io.Reader = bytes.NewReader(body)
+	length := int64(len(body))
+	if f.Incomplete {
+		r = io.MultiReader(r, &errorReader{io.ErrUnexpectedEOF})
+		length = -1
+		header.Del("Content-Length")
+	} else {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.Status, http.StatusText(f.Status)),
+		StatusCode:    f.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(r),
+		ContentLength: length,
+		Request:       req,
+	}, nil
+}
+
+// errorReader fails every read with err.
+type errorReader struct{ err error }
+
+func (r *errorReader) Read([]byte) (int, error) { return 0, r.err }
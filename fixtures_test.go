@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordingRedactsCookies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "server-secret"})
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html>hello</html>")
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+
+	client := &http.Client{Transport: (&HTTPFixtures{Dir: dir}).Transport(http.DefaultTransport)}
+	req, _ := http.NewRequest("GET", srv.URL+"/episode/1", nil)
+	req.Header.Set("Cookie", "glsc=client-secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "<html>hello</html>" {
+		t.Fatalf("recorded request returned %q", body)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 1 {
+		t.Fatalf("%d fixture files, want 1", len(files))
+	}
+	data, _ := os.ReadFile(files[0])
+	for _, secret := range []string{"client-secret", "server-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("fixture contains %q:\n%s", secret, data)
+		}
+	}
+
+	replay := &http.Client{Transport: (&HTTPFixtures{Dir: dir, Replay: true}).Transport(nil)}
+	resp, err = replay.Get(srv.URL + "/episode/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "<html>hello</html>" {
+		t.Fatalf("replay = %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestRecordingLeavesReadingToTheCaller(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		io.WriteString(w, "start")
+		w.(http.Flusher).Flush()
+		<-release // the rest never comes
+	}))
+	defer srv.Close()
+	defer close(release)
+	dir := t.TempDir()
+
+	client := &http.Client{Transport: (&HTTPFixtures{Dir: dir}).Transport(http.DefaultTransport)}
+	start := time.Now()
+	resp, err := client.Get(srv.URL + "/1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("recording waited for the whole body")
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, got); err != nil || string(got) != "start" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	// The caller gives up, as a stall timeout would.
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := &http.Client{Transport: (&HTTPFixtures{Dir: dir, Replay: true}).Transport(nil)}
+	resp, err = replay.Get(srv.URL + "/1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if string(body) != "start" || err != io.ErrUnexpectedEOF {
+		t.Fatalf("replay read %q, %v; want the recorded part, then an unexpected EOF", body, err)
+	}
+}
+
+func TestReplayFailsFastOnMissingRecordings(t *testing.T) {
+	client := NewNetworkClient(defaultTransportOptions).UseFixtures(&HTTPFixtures{Dir: t.TempDir(), Replay: true})
+	req, _ := http.NewRequest("GET", "https://comic-days.com/episode/404", nil)
+	start := time.Now()
+	_, err := client.FetchWithRetries(req, nil)
+	if !IsPermanent(err) {
+		t.Fatalf("err = %v, want a permanent error", err)
+	}
+	if time.Since(start) > baseDelay {
+		t.Fatal("a missing recording was retried")
+	}
+}
+
+// TestReplayedSession runs a whole chapter, from NewComicSession to the
+// saved pages, against a recording instead of the site.
+func TestReplayedSession(t *testing.T) {
+	const episodeURL = "https://comic-days.com/episode/100"
+	const imageURL = "https://cdn-img.comic-days.com/public/page/2/100-0"
+	dir := t.TempDir()
+
+	episodeJSON := `{"readableProduct": {"id": "100", "title": "Episode 1",
+		"series": {"id": "s", "title": "Replay"},
+		"pageStructure": {"pages": [{"src": "` + imageURL + `", "type": "main", "width": 96, "height": 64}]}}}`
+	page := `<html><body><script id="episode-json" data-value="` + html.EscapeString(episodeJSON) + `"></script></body></html>`
+	picture := testPicture(96, 64)
+	var scrambled bytes.Buffer
+	if err := png.Encode(&scrambled, Scramble(picture, comicDaysScramble, 96, 64)); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []fixture{
+		{Method: "GET", URL: episodeURL, Status: 200, Header: http.Header{"Content-Type": {"text/html"}}, Body: page},
+		{Method: "GET", URL: imageURL, Status: 200, Header: http.Header{"Content-Type": {"image/png"}}, BodyBase64: scrambled.Bytes()},
+	} {
+		if err := saveFixture(dir, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	session, err := NewComicSession(SessionOptions{
+		CookieFile: filepath.Join(dir, "no-cookies.json"),
+		URL:        episodeURL,
+		OutRoot:    t.TempDir(),
+		Fixtures:   &HTTPFixtures{Dir: dir, Replay: true},
+	})
+	if err != nil {
+		t.Fatalf("NewComicSession returned error: %v", err)
+	}
+	if session.Episode.SeriesTitle != "Replay" || len(session.Pages) != 1 {
+		t.Fatalf("session = %+v", session.Episode)
+	}
+	results, failed := downloadPages(session.Pages, session.NetworkClient, nil, session.Output, &countingReporter{})
+	if failed != 0 || len(results) != 1 {
+		t.Fatalf("downloadPages: %d results, %d failed", len(results), failed)
+	}
+	got, err := os.Open(filepath.Join(session.Output.Dir, results[0].file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.Close()
+	img, err := png.Decode(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	assertSameImage(t, "replayed page", rgba, picture)
+}
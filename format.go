@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/HugoSmits86/nativewebp"
+
+	// Register the WebP decoder so pages saved as WebP can be verified,
+	// thumbnailed and scaled like any other.
+	_ "golang.org/x/image/webp"
+)
+
+// defaultJPEGQuality is used when a JPEG format is chosen without a quality.
+const defaultJPEGQuality = 90
+
+// ImageFormat is the encoding pages are saved in. The zero value is PNG.
+type ImageFormat struct {
+	// Name is "png", "jpeg", "jpeg-lossless" or "webp"; empty means "png".
+	Name string
+	// Quality is the JPEG quality from 1 to 100; zero means
+	// defaultJPEGQuality. The lossless formats ignore it.
+	Quality int
+	// Gray is the grayscale mode (see grayscale.go); empty means grayAuto.
+	Gray string
+	// Compression is the zlib effort of PNG pages; the zero value is
+	// png.DefaultCompression.
+	Compression png.CompressionLevel
+}
+
+// pngCompressionLevels maps the names accepted on the command line to
+// compression levels.
+var pngCompressionLevels = map[string]png.CompressionLevel{
+	"none":    png.NoCompression,
+	"fast":    png.BestSpeed,
+	"default": png.DefaultCompression,
+	"best":    png.BestCompression,
+}
+
+// pngBuffers lets consecutive PNG encodes reuse their compression buffers,
+// which are a large share of the allocations for big pages.
+var pngBuffers = &pngBufferPool{}
+
+type pngBufferPool struct {
+	pool sync.Pool
+}
+
+func (p *pngBufferPool) Get() *png.EncoderBuffer {
+	b, _ := p.pool.Get().(*png.EncoderBuffer)
+	return b
+}
+
+func (p *pngBufferPool) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
+}
+
+// ParseImageFormat validates a format name, JPEG quality, grayscale mode and
+// PNG compression level as given on the command line. A quality of 0 means
+// defaultJPEGQuality.
+func ParseImageFormat(name string, quality int, gray, compression string) (ImageFormat, error) {
+	f := ImageFormat{Name: strings.ToLower(strings.TrimSpace(name)), Quality: quality}
+	switch f.Name {
+	case "", "png":
+		f.Name = "png"
+	case "jpeg", "jpg":
+		f.Name = "jpeg"
+	case "jpeg-lossless", "lossless-jpeg":
+		f.Name = "jpeg-lossless"
+	case "webp":
+	default:
+		return ImageFormat{}, fmt.Errorf("unknown image format %q (want png, jpeg, jpeg-lossless or webp)", name)
+	}
+	if quality < 0 || quality > 100 {
+		return ImageFormat{}, fmt.Errorf("JPEG quality must be between 1 and 100, got %d", quality)
+	}
+	mode, err := parseGrayMode(gray)
+	if err != nil {
+		return ImageFormat{}, err
+	}
+	f.Gray = mode
+	if compression != "" {
+		level, ok := pngCompressionLevels[strings.ToLower(compression)]
+		if !ok {
+			return ImageFormat{}, fmt.Errorf("unknown PNG compression level %q (want none, fast, default or best)", compression)
+		}
+		f.Compression = level
+	}
+	return f, nil
+}
+
+// formatForFile guesses the format a page file was saved in from its
+// extension, so rewriting the page keeps the chapter consistent.
+func formatForFile(name string) ImageFormat {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return ImageFormat{Name: "jpeg"}
+	case ".webp":
+		return ImageFormat{Name: "webp"}
+	default:
+		return ImageFormat{Name: "png"}
+	}
+}
+
+// Ext is the file extension, without the dot.
+func (f ImageFormat) Ext() string {
+	switch f.Name {
+	case "jpeg", "jpeg-lossless":
+		return "jpg"
+	case "webp":
+		return "webp"
+	default:
+		return "png"
+	}
+}
+
+// Label is the format's name as shown to the user.
+func (f ImageFormat) Label() string {
+	switch f.Name {
+	case "jpeg":
+		return fmt.Sprintf("JPEG q%d", f.quality())
+	case "jpeg-lossless":
+		return "JPEG lossless"
+	case "webp":
+		return "WebP"
+	default:
+		return "PNG"
+	}
+}
+
+// keepsJPEG reports whether pages are restored from the server's JPEG data
+// (see jpegblocks.go) instead of being re-encoded.
+func (f ImageFormat) keepsJPEG() bool {
+	return f.Name == "jpeg-lossless"
+}
+
+// pixelFallback is the format a page is saved in when its JPEG data cannot
+// be kept: PNG, so the pixels at least survive exactly.
+func (f ImageFormat) pixelFallback() ImageFormat {
+	return ImageFormat{Name: "png", Gray: f.Gray, Compression: f.Compression}
+}
+
+func (f ImageFormat) quality() int {
+	if f.Quality <= 0 {
+		return defaultJPEGQuality
+	}
+	return f.Quality
+}
+
+// Encode writes img to w in this format. A jpeg-lossless format has no
+// pixel encoding of its own and writes its pixelFallback.
+func (f ImageFormat) Encode(w io.Writer, img image.Image) error {
+	switch f.Name {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: f.quality()})
+	case "webp":
+		return nativewebp.Encode(w, img, nil)
+	case "jpeg-lossless":
+		return f.pixelFallback().Encode(w, img)
+	default:
+		enc := png.Encoder{CompressionLevel: f.Compression, BufferPool: pngBuffers}
+		return enc.Encode(w, img)
+	}
+}
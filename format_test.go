@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func testPattern(width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 7), G: uint8(y * 13), B: uint8(x ^ y), A: 255})
+		}
+	}
+	return img
+}
+
+func TestImageFormatsRoundTrip(t *testing.T) {
+	src := testPattern(40, 24)
+	for _, name := range []string{"png", "jpeg", "webp"} {
+		t.Run(name, func(t *testing.T) {
+			f, err := ParseImageFormat(name, 95, grayOff, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := f.Encode(&buf, src); err != nil {
+				t.Fatalf("Encode returned error: %v", err)
+			}
+			got, kind, err := image.Decode(&buf)
+			if err != nil {
+				t.Fatalf("Decode returned error: %v", err)
+			}
+			if kind != f.Name {
+				t.Fatalf("decoded a %s image, want %s", kind, f.Name)
+			}
+			if got.Bounds() != src.Bounds() {
+				t.Fatalf("bounds = %v, want %v", got.Bounds(), src.Bounds())
+			}
+			if f.Name == "jpeg" {
+				return
+			}
+			// The lossless formats must reproduce every pixel exactly.
+			for y := 0; y < 24; y++ {
+				for x := 0; x < 40; x++ {
+					if color.NRGBAModel.Convert(got.At(x, y)) != src.At(x, y) {
+						t.Fatalf("pixel (%d,%d) = %v, want %v", x, y, got.At(x, y), src.At(x, y))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseImageFormat(t *testing.T) {
+	if f, err := ParseImageFormat("JPG", 0, "", ""); err != nil || f.Name != "jpeg" || f.Ext() != "jpg" || f.Label() != "JPEG q90" {
+		t.Fatalf("ParseImageFormat(JPG) = %+v, %v", f, err)
+	}
+	if f, err := ParseImageFormat("", 0, "", ""); err != nil || f.Ext() != "png" {
+		t.Fatalf("ParseImageFormat(\"\") = %+v, %v", f, err)
+	}
+	for _, bad := range []struct {
+		name    string
+		quality int
+	}{{"gif", 0}, {"jpeg", 101}, {"jpeg", -1}} {
+		if _, err := ParseImageFormat(bad.name, bad.quality, "", ""); err == nil {
+			t.Errorf("ParseImageFormat(%q, %d) succeeded, want an error", bad.name, bad.quality)
+		}
+	}
+	if got := formatForFile("012.webp").Name; got != "webp" {
+		t.Fatalf("formatForFile(012.webp) = %q, want webp", got)
+	}
+}
+
+func TestQualityFlagRejectsZero(t *testing.T) {
+	for args, ok := range map[string]bool{"": true, "-quality 1": true, "-quality 0": false, "-quality 101": false} {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		parse := addImageFormatFlags(flags)
+		if err := flags.Parse(strings.Fields(args)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parse(); (err == nil) != ok {
+			t.Errorf("%q: err = %v", args, err)
+		}
+	}
+}
+
+func TestDeobfuscateAndSaveFollowsFormat(t *testing.T) {
+	dir := t.TempDir()
+	page := NewPage("", 64, 64)
+	out := ChapterOutput{Dir: dir, Format: ImageFormat{Name: "webp"}}
+
+	saved, err := page.deobfuscateAndSave(testPattern(64, 64), nil, out, 3)
+	if err != nil {
+		t.Fatalf("deobfuscateAndSave returned error: %v", err)
+	}
+	if saved.file != "003.webp" {
+		t.Fatalf("file = %q, want 003.webp", saved.file)
+	}
+	info, err := os.Stat(filepath.Join(dir, saved.file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.size != info.Size() {
+		t.Fatalf("size = %d, want the file's %d bytes", saved.size, info.Size())
+	}
+	if _, err := imaging.Open(filepath.Join(dir, saved.file)); err != nil {
+		t.Fatalf("saved page cannot be opened: %v", err)
+	}
+	pages, err := listPageFiles(dir)
+	if err != nil || len(pages) != 1 || pages[0] != "003.webp" {
+		t.Fatalf("listPageFiles = %v, %v", pages, err)
+	}
+}
+
+func TestPNGCompressionLevels(t *testing.T) {
+	src := testPattern(128, 128)
+	sizes := map[string]int{}
+	for _, level := range []string{"none", "best"} {
+		f, err := ParseImageFormat("png", 0, grayOff, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := f.Encode(&buf, src); err != nil {
+			t.Fatalf("Encode(%s) returned error: %v", level, err)
+		}
+		sizes[level] = buf.Len()
+	}
+	if sizes["best"] >= sizes["none"] {
+		t.Fatalf("best compression gave %d bytes, no compression %d", sizes["best"], sizes["none"])
+	}
+	if _, err := ParseImageFormat("png", 0, "", "max"); err == nil {
+		t.Fatal("ParseImageFormat accepted an unknown compression level")
+	}
+}
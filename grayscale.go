@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+)
+
+// Grayscale modes for ImageFormat.Gray.
+const (
+	// grayAuto saves pages whose pixels are all neutral gray as 8-bit
+	// grayscale and everything else in colour.
+	grayAuto = "auto"
+	// grayOff always saves pages in colour.
+	grayOff = "off"
+	// gray4Bit is grayAuto with gray pages reduced to 16 levels, which is all
+	// most e-ink screens can show and roughly halves the PNG size again.
+	gray4Bit = "4bit"
+)
+
+// grayTolerance is how far apart the colour channels of a pixel may be for
+// it to still count as gray. The scans are JPEG-compressed, so the pixels of
+// a black and white page are never exactly neutral.
+const grayTolerance = 16
+
+// parseGrayMode validates a grayscale mode as given on the command line.
+func parseGrayMode(mode string) (string, error) {
+	switch m := strings.ToLower(strings.TrimSpace(mode)); m {
+	case "", grayAuto:
+		return grayAuto, nil
+	case grayOff, gray4Bit:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown grayscale mode %q (want auto, off or 4bit)", mode)
+	}
+}
+
+// isGrayscale reports whether every pixel of img is within grayTolerance of
+// neutral gray.
+func isGrayscale(img *image.RGBA) bool {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		for i := 0; i+3 < len(row); i += 4 {
+			r, g, bl := int(row[i]), int(row[i+1]), int(row[i+2])
+			lo, hi := min(r, g, bl), max(r, g, bl)
+			if hi-lo > grayTolerance {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// gray16Palette holds the 16 evenly spaced levels of a 4-bit gray page.
+// Encoding a paletted image with at most 16 colours gives a 4-bit PNG.
+var gray16Palette = func() color.Palette {
+	p := make(color.Palette, 16)
+	for i := range p {
+		p[i] = color.Gray{Y: uint8(i * 17)}
+	}
+	return p
+}()
+
+// toGray converts img to grayscale. With levels == 16 the result is a
+// paletted image of gray16Palette, otherwise an 8-bit *image.Gray.
+func toGray(img *image.RGBA, levels int) image.Image {
+	b := img.Bounds()
+	gray := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		src := img.Pix[img.PixOffset(b.Min.X, y):img.PixOffset(b.Max.X, y)]
+		dst := gray.Pix[gray.PixOffset(b.Min.X, y):gray.PixOffset(b.Max.X, y)]
+		for x := range dst {
+			c := color.RGBA{R: src[4*x], G: src[4*x+1], B: src[4*x+2], A: 255}
+			dst[x] = color.GrayModel.Convert(c).(color.Gray).Y
+		}
+	}
+	if levels != 16 {
+		return gray
+	}
+	paletted := image.NewPaletted(b, gray16Palette)
+	for i, v := range gray.Pix {
+		// Round to the nearest of the 16 levels, 17 apart.
+		paletted.Pix[i] = uint8((int(v) + 8) / 17)
+	}
+	return paletted
+}
+
+// prepare returns the image to encode for a deobfuscated page, and whether
+// it was converted to grayscale.
+func (f ImageFormat) prepare(img *image.RGBA) (image.Image, bool) {
+	if f.Gray == grayOff || !isGrayscale(img) {
+		return img, false
+	}
+	if f.Gray == gray4Bit {
+		return toGray(img, 16), true
+	}
+	return toGray(img, 256), true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testGrayPage returns a page of gray stripes whose channels wobble a little,
+// the way they do in a decoded JPEG scan.
+func testGrayPage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8((x * 255) / width)
+			img.Set(x, y, color.RGBA{R: v, G: v + uint8(y%3), B: v - uint8(x%2), A: 255})
+		}
+	}
+	return img
+}
+
+func TestIsGrayscale(t *testing.T) {
+	page := testGrayPage(32, 16)
+	if !isGrayscale(page) {
+		t.Fatal("a gray page with JPEG noise was not detected as grayscale")
+	}
+	page.Set(5, 5, color.RGBA{R: 200, G: 30, B: 30, A: 255})
+	if isGrayscale(page) {
+		t.Fatal("a page with a red pixel was detected as grayscale")
+	}
+}
+
+func TestSaveImageWritesGrayPages(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		src    *image.RGBA
+		wantFn func(image.Image) bool
+		gray   bool
+	}{
+		{"auto gray page", grayAuto, testGrayPage(32, 32), func(img image.Image) bool { _, ok := img.(*image.Gray); return ok }, true},
+		{"4bit gray page", gray4Bit, testGrayPage(32, 32), func(img image.Image) bool {
+			p, ok := img.(*image.Paletted)
+			return ok && len(p.Palette) <= 16
+		}, true},
+		{"off", grayOff, testGrayPage(32, 32), func(img image.Image) bool { return img.ColorModel() != color.GrayModel }, false},
+		{"colour page", grayAuto, func() *image.RGBA {
+			img := testGrayPage(32, 32)
+			img.Set(0, 0, color.RGBA{B: 255, A: 255})
+			return img
+		}(), func(img image.Image) bool { return img.ColorModel() != color.GrayModel }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "001.png")
+			ip := &ImageProcessor{Dst: tt.src, Format: ImageFormat{Gray: tt.mode}}
+			if err := ip.SaveImage(path); err != nil {
+				t.Fatalf("SaveImage returned error: %v", err)
+			}
+			if ip.Grayscale != tt.gray {
+				t.Fatalf("Grayscale = %v, want %v", ip.Grayscale, tt.gray)
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			img, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantFn(img) {
+				t.Fatalf("saved a %T", img)
+			}
+		})
+	}
+}
+
+func TestToGray4BitRoundsToNearestLevel(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 1))
+	img.Set(0, 0, color.RGBA{R: 0, G: 0, B: 0, A: 255})
+	img.Set(1, 0, color.RGBA{R: 26, G: 26, B: 26, A: 255})
+	img.Set(2, 0, color.RGBA{R: 255, G: 255, B: 255, A: 255})
+	p := toGray(img, 16).(*image.Paletted)
+	if got := []uint8{p.Pix[0], p.Pix[1], p.Pix[2]}; got[0] != 0 || got[1] != 2 || got[2] != 15 {
+		t.Fatalf("palette indexes = %v, want [0 2 15]", got)
+	}
+}
+
+func TestParseGrayMode(t *testing.T) {
+	if _, err := parseGrayMode("sepia"); err == nil {
+		t.Fatal("parseGrayMode accepted an unknown mode")
+	}
+	if m, err := parseGrayMode(""); err != nil || m != grayAuto {
+		t.Fatalf("parseGrayMode(\"\") = %q, %v", m, err)
+	}
+}
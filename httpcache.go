@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pterm/pterm"
+)
+
+// defaultCacheSize is how much the HTTP cache may hold unless -cache-size
+// says otherwise.
+const defaultCacheSize = 2 << 30
+
+// cacheHitHeader marks the responses the cache answered itself, whose
+// bodies come from disk rather than the network. The name is the
+// downloader's own: CDNs send an X-Cache header of their own on every
+// response. Only cachingTransport sets it, to cacheHitValue.
+const (
+	cacheHitHeader = "X-ComicDays-Cache"
+	cacheHitValue  = "HIT"
+)
+
+// HTTPCache keeps GET responses on disk, keyed by URL, so running a chapter
+// again (for example to save it in another format) does not download it
+// again. Page images are served straight from the cache: an image URL
+// always names the same picture. Everything else, like the episode pages
+// whose content depends on the cookies, is revalidated with the server
+// (If-None-Match / If-Modified-Since) unless its Cache-Control or Expires
+// header says it is still fresh.
+//
+// A cached page is only used for requests sent with the same cookies, and
+// the same values of every header its Vary names: a page stored while
+// logged out must not stand in for the one a logged-in run would get. Pages
+// marked private are not stored at all.
+//
+// Every entry is two files in a subfolder named after the first two hex
+// digits of the URL's SHA-256: <hash>.json with the status and headers and
+// <hash>.body with the body. When the cache grows past MaxBytes the entries
+// used least recently are evicted.
+type HTTPCache struct {
+	Dir      string
+	MaxBytes int64
+
+	mu sync.Mutex
+	// size is the total size of the cached files, or -1 until counted.
+	size int64
+	now  func() time.Time
+}
+
+// cacheEntry is the metadata file of a cached response.
+type cacheEntry struct {
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Stored time.Time   `json:"stored"`
+	// Request holds, for each header the response depends on (see
+	// variantHeaders), a hash of the value the request sent. Hashes keep
+	// the cookies themselves off the disk.
+	Request map[string]string `json:"request,omitempty"`
+}
+
+// OpenHTTPCache opens (creating if needed) the cache in dir.
+func OpenHTTPCache(dir string, maxBytes int64) (*HTTPCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create the HTTP cache: %v", err)
+	}
+	return &HTTPCache{Dir: dir, MaxBytes: maxBytes, size: -1, now: time.Now}, nil
+}
+
+// defaultCacheDir is where the HTTP cache lives unless -cache-dir says
+// otherwise.
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, appName, "http")
+	}
+	return filepath.Join(defaultDataDir(), "http-cache")
+}
+
+// addCacheFlags registers the flags that configure the HTTP cache and
+// returns a function that opens it once the flag set has been parsed. The
+// function returns a nil cache when caching is turned off.
+func addCacheFlags(flags *flag.FlagSet) func() (*HTTPCache, error) {
+	dir := flags.String("cache-dir", defaultCacheDir(), "directory downloaded pages and images are cached in")
+	sizeMB := flags.Int("cache-size", defaultCacheSize>>20, "largest size of the HTTP cache, in MiB")
+	noCache := flags.Bool("no-cache", false, "neither use nor fill the HTTP cache")
+	return func() (*HTTPCache, error) {
+		if *noCache {
+			return nil, nil
+		}
+		if *sizeMB < 1 {
+			return nil, fmt.Errorf("-cache-size must be at least 1, got %d", *sizeMB)
+		}
+		return OpenHTTPCache(*dir, int64(*sizeMB)<<20)
+	}
+}
+
+// Transport returns a RoundTripper that answers from the cache where it can
+// and sends everything else to next.
+func (c *HTTPCache) Transport(next http.RoundTripper) http.RoundTripper {
+	return &cachingTransport{cache: c, next: next}
+}
+
+type cachingTransport struct {
+	cache *HTTPCache
+	next  http.RoundTripper
+}
+
+func (t *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" {
+		return t.next.RoundTrip(req)
+	}
+	c := t.cache
+	key := req.URL.String()
+	entry, ok := c.load(key)
+	if ok && !entry.matches(req) {
+		// Cached for other cookies or headers: its validators say nothing
+		// about the response this request would get.
+		ok = false
+	}
+	if ok && entry.fresh(c.now()) {
+		if resp, err := c.response(req, key, entry); err == nil {
+			return resp, nil
+		}
+		ok = false
+	}
+
+	sent := req
+	if ok {
+		sent = req.Clone(req.Context())
+		if etag := entry.Header.Get("ETag"); etag != "" {
+			sent.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.Header.Get("Last-Modified"); modified != "" {
+			sent.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	resp, err := t.next.RoundTrip(sent)
+	if err != nil {
+		return nil, err
+	}
+	// Whatever the server sends, only a hit carries the marker.
+	resp.Header.Del(cacheHitHeader)
+
+	if ok && resp.StatusCode == http.StatusNotModified {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		// A 304 carries the headers that may have changed.
+		for _, h := range []string{"Cache-Control", "Date", "Expires", "ETag", "Last-Modified"} {
+			if v := resp.Header.Get(h); v != "" {
+				entry.Header.Set(h, v)
+			}
+		}
+		entry.Stored = c.now()
+		c.saveEntry(key, entry)
+		if cached, err := c.response(req, key, entry); err == nil {
+			return cached, nil
+		}
+		// The body vanished in the meantime; ask again without validators.
+		return t.next.RoundTrip(req)
+	}
+
+	if resp.StatusCode == http.StatusOK && cacheable(resp) {
+		e := cacheEntry{URL: key, Status: resp.StatusCode, Header: resp.Header.Clone(), Stored: c.now(), Request: requestVariant(req, resp.Header)}
+		resp.Body = c.fill(key, e, resp.Body)
+	}
+	return resp, nil
+}
+
+// cacheable reports whether resp may be stored at all.
+func cacheable(resp *http.Response) bool {
+	cc := parseCacheControl(resp.Header.Get("Cache-Control"))
+	if _, noStore := cc["no-store"]; noStore {
+		return false
+	}
+	_, private := cc["private"]
+	return !private || isImage(resp.Header)
+}
+
+// isImage reports whether h describes a page image. An image URL always
+// names the same picture, whoever asks for it.
+func isImage(h http.Header) bool {
+	return strings.HasPrefix(strings.ToLower(h.Get("Content-Type")), "image/")
+}
+
+// variantHeaders lists the request headers a response with header h
+// depends on: those its Vary names, and the cookies unless it is an image.
+func variantHeaders(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	if !isImage(h) {
+		names = append(names, "Cookie")
+	}
+	return names
+}
+
+// requestVariant records the values req sent for the headers a response
+// with header h depends on.
+func requestVariant(req *http.Request, h http.Header) map[string]string {
+	variant := map[string]string{}
+	for _, name := range variantHeaders(h) {
+		variant[name] = hashHeader(req, name)
+	}
+	return variant
+}
+
+// hashHeader hashes req's values of the header name, or returns "" when it
+// has none.
+func hashHeader(req *http.Request, name string) string {
+	v := strings.Join(req.Header.Values(name), "\n")
+	if v == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(sum[:16])
+}
+
+// matches reports whether the entry was stored for a request like req. An
+// entry that varies on every header ("Vary: *") matches nothing.
+func (e cacheEntry) matches(req *http.Request) bool {
+	for _, name := range variantHeaders(e.Header) {
+		if name == "*" || e.Request[name] != hashHeader(req, name) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCacheControl(v string) map[string]string {
+	cc := map[string]string{}
+	for _, part := range strings.Split(v, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			cc[strings.ToLower(name)] = strings.Trim(value, `"`)
+		}
+	}
+	return cc
+}
+
+// fresh reports whether the entry may be used without asking the server.
+func (e cacheEntry) fresh(now time.Time) bool {
+	cc := parseCacheControl(e.Header.Get("Cache-Control"))
+	if _, ok := cc["no-cache"]; ok {
+		return false
+	}
+	if maxAge, ok := cc["max-age"]; ok {
+		secs, err := strconv.Atoi(maxAge)
+		return err == nil && now.Before(e.Stored.Add(time.Duration(secs)*time.Second))
+	}
+	if expires := e.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		return err == nil && now.Before(t)
+	}
+	return isImage(e.Header)
+}
+
+func (c *HTTPCache) paths(key string) (meta, body string) {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	base := filepath.Join(c.Dir, name[:2], name)
+	return base + ".json", base + ".body"
+}
+
+func (c *HTTPCache) load(key string) (cacheEntry, bool) {
+	var e cacheEntry
+	meta, _ := c.paths(key)
+	data, err := os.ReadFile(meta)
+	if err != nil || json.Unmarshal(data, &e) != nil || e.URL != key {
+		return cacheEntry{}, false
+	}
+	return e, true
+}
+
+func (c *HTTPCache) saveEntry(key string, e cacheEntry) {
+	meta, _ := c.paths(key)
+	if data, err := json.Marshal(e); err == nil {
+		_ = writeFileAtomic(meta, data)
+	}
+}
+
+// response builds the response for req from the cached entry, and marks
+// the entry as just used.
+func (c *HTTPCache) response(req *http.Request, key string, e cacheEntry) (*http.Response, error) {
+	_, bodyPath := c.paths(key)
+	f, err := os.Open(bodyPath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	now := c.now()
+	_ = os.Chtimes(bodyPath, now, now)
+	header := e.Header.Clone()
+	header.Set("Content-Length", strconv.FormatInt(st.Size(), 10))
+	header.Set(cacheHitHeader, cacheHitValue)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          f,
+		ContentLength: st.Size(),
+		Request:       req,
+	}, nil
+}
+
+// fill wraps body so that everything the caller reads is also written to
+// the cache. The entry is only stored if the body is read to the end;
+// responses abandoned halfway (a refused image, a timeout) are not.
+func (c *HTTPCache) fill(key string, e cacheEntry, body io.ReadCloser) io.ReadCloser {
+	_, bodyPath := c.paths(key)
+	if err := os.MkdirAll(filepath.Dir(bodyPath), 0o755); err != nil {
+		return body
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(bodyPath), ".tmp-*")
+	if err != nil {
+		return body
+	}
+	return &cacheFiller{cache: c, key: key, entry: e, body: body, tmp: tmp, w: bufio.NewWriter(tmp)}
+}
+
+type cacheFiller struct {
+	cache *HTTPCache
+	key   string
+	entry cacheEntry
+	body  io.ReadCloser
+	tmp   *os.File
+	w     *bufio.Writer
+	// failed is set once writing the copy fails; the body is still passed
+	// through, just not cached.
+	failed, done bool
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.body.Read(p)
+	if n > 0 && !f.failed {
+		if _, werr := f.w.Write(p[:n]); werr != nil {
+			f.failed = true
+		}
+	}
+	if err == io.EOF {
+		f.done = true
+	}
+	return n, err
+}
+
+func (f *cacheFiller) Close() error {
+	err := f.body.Close()
+	tmpName := f.tmp.Name()
+	stored := f.done && !f.failed && f.w.Flush() == nil
+	if f.tmp.Close() != nil {
+		stored = false
+	}
+	if stored {
+		stored = f.cache.commit(f.key, f.entry, tmpName)
+	}
+	if !stored {
+		_ = os.Remove(tmpName)
+	}
+	return err
+}
+
+// commit moves the body written to tmp into place, records the entry and
+// evicts old entries if the cache has grown too big.
+func (c *HTTPCache) commit(key string, e cacheEntry, tmp string) bool {
+	meta, bodyPath := c.paths(key)
+	st, err := os.Stat(tmp)
+	if err != nil {
+		return false
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.countLocked()
+	old := fileSize(meta) + fileSize(bodyPath)
+	if err := os.Rename(tmp, bodyPath); err != nil {
+		return false
+	}
+	now := c.now()
+	_ = os.Chtimes(bodyPath, now, now)
+	if err := writeFileAtomic(meta, data); err != nil {
+		_ = os.Remove(bodyPath)
+		c.size -= old
+		return false
+	}
+	c.size += st.Size() + int64(len(data)) - old
+	if c.size > c.MaxBytes {
+		c.evictLocked()
+	}
+	return true
+}
+
+func fileSize(path string) int64 {
+	if st, err := os.Stat(path); err == nil {
+		return st.Size()
+	}
+	return 0
+}
+
+// cachedFile is one entry found on disk.
+type cachedFile struct {
+	meta, body string
+	size       int64
+	used       time.Time
+}
+
+// entries lists every entry in the cache.
+func (c *HTTPCache) entries() ([]cachedFile, error) {
+	var files []cachedFile
+	err := filepath.WalkDir(c.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(path, ".body") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		meta := strings.TrimSuffix(path, ".body") + ".json"
+		files = append(files, cachedFile{meta: meta, body: path, size: info.Size() + fileSize(meta), used: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+func (c *HTTPCache) countLocked() {
+	if c.size >= 0 {
+		return
+	}
+	c.size = 0
+	files, _ := c.entries()
+	for _, f := range files {
+		c.size += f.size
+	}
+}
+
+// evictLocked removes the least recently used entries until the cache is
+// back under 90% of MaxBytes, so it does not evict on every new entry.
+func (c *HTTPCache) evictLocked() {
+	files, err := c.entries()
+	if err != nil {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+	target := c.MaxBytes / 10 * 9
+	for _, f := range files {
+		if c.size <= target {
+			break
+		}
+		_ = os.Remove(f.body)
+		_ = os.Remove(f.meta)
+		c.size -= f.size
+	}
+}
+
+// Usage returns the number of entries and their total size.
+func (c *HTTPCache) Usage() (int, int64, error) {
+	files, err := c.entries()
+	var size int64
+	for _, f := range files {
+		size += f.size
+	}
+	return len(files), size, err
+}
+
+// Clear removes every entry. Only the cache's own files are deleted, so a
+// -cache-dir pointing at a folder with other content is safe.
+func (c *HTTPCache) Clear() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files, err := c.entries()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, f := range files {
+		if err := os.Remove(f.body); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, err
+		}
+		_ = os.Remove(f.meta)
+		// The subfolder goes too once it is empty.
+		_ = os.Remove(filepath.Dir(f.body))
+		removed++
+	}
+	c.size = 0
+	return removed, nil
+}
+
+func runCache(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s cache info|clear [flags]", appName)
+	}
+	flags := subcommandFlagSet("cache "+args[0], "[flags]")
+	dir := flags.String("cache-dir", defaultCacheDir(), "directory of the HTTP cache")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	cache, err := OpenHTTPCache(*dir, defaultCacheSize)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "info":
+		n, size, err := cache.Usage()
+		if err != nil {
+			return err
+		}
+		pterm.Info.Printfln("🗄️  %s holds %d response(s), %s", cache.Dir, n, humanBytes(size))
+		return nil
+	case "clear":
+		n, err := cache.Clear()
+		if err != nil {
+			return fmt.Errorf("could not clear the HTTP cache: %v", err)
+		}
+		pterm.Success.Printfln("🧹 Removed %d cached response(s) from %s", n, cache.Dir)
+		return nil
+	default:
+		return fmt.Errorf("unknown cache command %q (want info or clear)", args[0])
+	}
+}
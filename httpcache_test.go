@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, maxBytes int64) *HTTPCache {
+	t.Helper()
+	cache, err := OpenHTTPCache(t.TempDir(), maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+// cachedGet fetches url through cache and returns the body.
+func cachedGet(t *testing.T, cache *HTTPCache, url string) string {
+	t.Helper()
+	return cachedGetWith(t, cache, url, nil)
+}
+
+// cachedGetWith is cachedGet for a request sent with header.
+func cachedGetWith(t *testing.T, cache *HTTPCache, url string, header http.Header) string {
+	t.Helper()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	client := &http.Client{Transport: cache.Transport(http.DefaultTransport)}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestHTTPCacheServesImagesWithoutTheNetwork(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "picture "+r.URL.Path)
+	}))
+	defer srv.Close()
+	cache := newTestCache(t, 1<<20)
+
+	for i := 0; i < 3; i++ {
+		if got := cachedGet(t, cache, srv.URL+"/1.png"); got != "picture /1.png" {
+			t.Fatalf("body = %q", got)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("server hit %d times, want 1", n)
+	}
+}
+
+func TestHTTPCacheMarksOnlyItsOwnHits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("X-Cache", "Hit from cloudfront")
+		w.Header().Set(cacheHitHeader, cacheHitValue) // must not be trusted
+		fmt.Fprint(w, "picture")
+	}))
+	defer srv.Close()
+	cache := newTestCache(t, 1<<20)
+	client := &http.Client{Transport: cache.Transport(http.DefaultTransport)}
+
+	for i, want := range []string{"", cacheHitValue} {
+		resp, err := client.Get(srv.URL + "/1.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := resp.Header.Get(cacheHitHeader); got != want {
+			t.Fatalf("request %d: %s = %q, want %q", i+1, cacheHitHeader, got, want)
+		}
+	}
+	meta, _ := cache.paths(srv.URL + "/1.png")
+	if data, err := os.ReadFile(meta); err != nil || strings.Contains(string(data), cacheHitHeader) {
+		t.Fatalf("the hit marker was stored (%v): %s", err, data)
+	}
+}
+
+func TestHTTPCacheRevalidatesPages(t *testing.T) {
+	var hits, notModified atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html>episode</html>")
+	}))
+	defer srv.Close()
+	cache := newTestCache(t, 1<<20)
+
+	for i := 0; i < 2; i++ {
+		if got := cachedGet(t, cache, srv.URL+"/episode/1"); got != "<html>episode</html>" {
+			t.Fatalf("request %d: body = %q", i+1, got)
+		}
+	}
+	if hits.Load() != 2 || notModified.Load() != 1 {
+		t.Fatalf("server hit %d times with %d revalidations, want 2 and 1", hits.Load(), notModified.Load())
+	}
+}
+
+func TestHTTPCacheHonoursCacheControl(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		switch r.URL.Path {
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/short":
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		fmt.Fprint(w, "x")
+	}))
+	defer srv.Close()
+	cache := newTestCache(t, 1<<20)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cachedGet(t, cache, srv.URL+"/no-store")
+	cachedGet(t, cache, srv.URL+"/no-store")
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("no-store: server hit %d times, want 2", n)
+	}
+
+	hits.Store(0)
+	cachedGet(t, cache, srv.URL+"/short")
+	cachedGet(t, cache, srv.URL+"/short")
+	now = now.Add(2 * time.Minute)
+	cachedGet(t, cache, srv.URL+"/short")
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("max-age: server hit %d times, want 2", n)
+	}
+}
+
+func TestHTTPCacheKeepsPagesApartByCookie(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("ETag", `"same-for-everyone"`)
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if c, err := r.Cookie("glsc"); err == nil {
+			fmt.Fprint(w, "full episode for "+c.Value)
+			return
+		}
+		fmt.Fprint(w, "preview")
+	}))
+	defer srv.Close()
+	cache := newTestCache(t, 1<<20)
+	loggedIn := http.Header{"Cookie": {"glsc=reader"}}
+
+	if got := cachedGet(t, cache, srv.URL+"/episode/1"); got != "preview" {
+		t.Fatalf("logged out: body = %q", got)
+	}
+	for i := 0; i < 2; i++ {
+		if got := cachedGetWith(t, cache, srv.URL+"/episode/1", loggedIn); got != "full episode for reader" {
+			t.Fatalf("logged in, request %d: body = %q", i+1, got)
+		}
+	}
+	// The second logged-in request is fresh from the cache.
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("server hit %d times, want 2", n)
+	}
+
+	// Images do not depend on the cookies.
+	hits.Store(0)
+	img := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "picture")
+	}))
+	defer img.Close()
+	cachedGet(t, cache, img.URL+"/1.png")
+	cachedGetWith(t, cache, img.URL+"/1.png", loggedIn)
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("image: server hit %d times, want 1", n)
+	}
+
+	meta, _ := cache.paths(srv.URL + "/episode/1")
+	if data, err := os.ReadFile(meta); err != nil || strings.Contains(string(data), "reader") {
+		t.Fatalf("the cookie was written to the cache (%v): %s", err, data)
+	}
+}
+
+func TestHTTPCacheHonoursVaryAndPrivate(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=3600")
+			w.Header().Set("Vary", "Accept-Language")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=3600")
+		}
+		fmt.Fprint(w, "page in "+r.Header.Get("Accept-Language"))
+	}))
+	defer srv.Close()
+	cache := newTestCache(t, 1<<20)
+	ja := http.Header{"Accept-Language": {"ja"}}
+	en := http.Header{"Accept-Language": {"en"}}
+
+	cachedGetWith(t, cache, srv.URL+"/vary", ja)
+	if got := cachedGetWith(t, cache, srv.URL+"/vary", en); got != "page in en" {
+		t.Fatalf("body = %q, want the English page", got)
+	}
+	cachedGetWith(t, cache, srv.URL+"/vary", en)
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("Vary: server hit %d times, want 2", n)
+	}
+
+	hits.Store(0)
+	cachedGet(t, cache, srv.URL+"/private")
+	cachedGet(t, cache, srv.URL+"/private")
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("private: server hit %d times, want 2", n)
+	}
+}
+
+func TestHTTPCacheSkipsAbandonedBodies(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, strings.Repeat("x", 1<<16))
+	}))
+	defer srv.Close()
+	cache := newTestCache(t, 1<<20)
+
+	client := &http.Client{Transport: cache.Transport(http.DefaultTransport)}
+	resp, err := client.Get(srv.URL + "/big.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(resp.Body, make([]byte, 10))
+	resp.Body.Close()
+	if n, _, _ := cache.Usage(); n != 0 {
+		t.Fatalf("cache holds %d entries after an abandoned body", n)
+	}
+}
+
+func TestHTTPCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+	cache := newTestCache(t, 1<<20)
+	now := time.Now().Add(-time.Hour)
+	cache.now = func() time.Time { return now }
+
+	cachedGet(t, cache, srv.URL+"/1.png")
+	// Leave room for two and a half entries like this one.
+	_, entrySize, _ := cache.Usage()
+	cache.MaxBytes = entrySize * 5 / 2
+	now = now.Add(time.Minute)
+	cachedGet(t, cache, srv.URL+"/2.png")
+	now = now.Add(time.Minute)
+	cachedGet(t, cache, srv.URL+"/1.png") // hit: 1 is now newer than 2
+	now = now.Add(time.Minute)
+	cachedGet(t, cache, srv.URL+"/3.png")
+
+	if _, ok := cache.load(srv.URL + "/2.png"); ok {
+		t.Fatal("the least recently used entry was not evicted")
+	}
+	for _, keep := range []string{"/1.png", "/3.png"} {
+		if _, ok := cache.load(srv.URL + keep); !ok {
+			t.Fatalf("%s was evicted", keep)
+		}
+	}
+	if _, size, _ := cache.Usage(); size > cache.MaxBytes {
+		t.Fatalf("cache holds %d bytes, limit %d", size, cache.MaxBytes)
+	}
+}
+
+func TestHTTPCacheClearLeavesOtherFiles(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, "x")
+	}))
+	defer srv.Close()
+	cache := newTestCache(t, 1<<20)
+	other := filepath.Join(cache.Dir, "notes.txt")
+	writeBytes(t, other, []byte("keep me"))
+
+	cachedGet(t, cache, srv.URL+"/1.png")
+	cachedGet(t, cache, srv.URL+"/2.png")
+	n, err := cache.Clear()
+	if err != nil || n != 2 {
+		t.Fatalf("Clear = %d, %v; want 2", n, err)
+	}
+	if n, _, _ := cache.Usage(); n != 0 {
+		t.Fatalf("%d entries left after Clear", n)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("Clear removed an unrelated file: %v", err)
+	}
+}
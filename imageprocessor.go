@@ -4,25 +4,24 @@ import (
 	"fmt"
 	"image"
 	"image/draw"
-	"image/png"
 	"os"
 	"path/filepath"
 )
 
-// Comic Days scrambles images by splitting the picture into a
-// divideNum x divideNum grid of equally sized cells and transposing that grid
-// (the cell at row r, column c is swapped with the cell at row c, column r).
-// Cell dimensions are rounded down to a multiple of `multiple` pixels, so the
-// right and bottom edges of the image may contain a leftover margin that is
-// never scrambled and must be copied over untouched.
-const (
-	divideNum = 4
-	multiple  = 8
-)
-
 type ImageProcessor struct {
 	Src image.Image
 	Dst *image.RGBA
+	// Spec is the scrambling Deobfuscate reverses; the zero value means
+	// comicDaysScramble.
+	Spec ScrambleSpec
+	// Format is the encoding SaveImage writes; the zero value is PNG.
+	Format ImageFormat
+	// Raw is the encoded image Src was decoded from, if known; RestoreJPEG
+	// works on it.
+	Raw []byte
+	// Grayscale reports whether SaveImage detected a black and white page
+	// and saved it as grayscale.
+	Grayscale bool
 }
 
 func NewImageContext(src image.Image) *ImageProcessor {
@@ -32,46 +31,114 @@ func NewImageContext(src image.Image) *ImageProcessor {
 	}
 }
 
-// Deobfuscate reverses the Comic Days scrambling and stores the result in Dst.
+// Deobfuscate reverses the scrambling described by Spec and stores the
+// result in Dst.
 func (ip *ImageProcessor) Deobfuscate(width, height int) *image.RGBA {
 	if ip.Src == nil || width <= 0 || height <= 0 {
 		ip.Dst = nil
 		return nil
 	}
+	spec := ip.Spec
+	if spec.Columns == 0 {
+		spec = comicDaysScramble
+	}
+	ip.Dst = rearrangeCells(ip.Src, spec, width, height, false)
+	return ip.Dst
+}
 
-	cellWidth := (width / (divideNum * multiple)) * multiple
-	cellHeight := (height / (divideNum * multiple)) * multiple
+// Scramble is the inverse of Deobfuscate: it scrambles the width x height
+// picture src the way a viewer using spec serves it. The downloader never
+// needs it; it builds test fixtures and the pages of the fake server.
+func Scramble(src image.Image, spec ScrambleSpec, width, height int) *image.RGBA {
+	if src == nil || width <= 0 || height <= 0 {
+		return nil
+	}
+	return rearrangeCells(src, spec, width, height, true)
+}
 
-	ip.Dst = image.NewRGBA(image.Rect(0, 0, width, height))
+// rearrangeCells copies src into a new width x height image and moves the
+// cells of spec's grid: cell i of the picture goes to cell Permutation[i]
+// when scrambling, and comes back from it when restoring.
+//
+// The source is converted to RGBA exactly once (decoded JPEGs are
+// *image.YCbCr, which draw.Draw converts slowly), and the cells are then
+// permuted in place by copying their rows, one permutation cycle at a time,
+// so only a single cell's worth of scratch memory is needed.
+func rearrangeCells(src image.Image, spec ScrambleSpec, width, height int, scramble bool) *image.RGBA {
+	cellWidth, cellHeight := spec.cellSize(width, height)
 
 	// Copy the whole source first. This preserves any unscrambled pixels,
 	// including the right and bottom margins that fall outside the cell grid.
-	offset := ip.Src.Bounds().Min
-	draw.Draw(ip.Dst, ip.Dst.Bounds(), ip.Src, offset, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Src)
 
 	// If the image is too small to contain a single cell there is nothing to
-	// unscramble; the copy above already produced the correct output.
+	// rearrange; the copy above already produced the correct output.
 	if cellWidth == 0 || cellHeight == 0 {
-		return ip.Dst
+		return dst
 	}
 
-	// Transpose the grid back into place. Transposition is its own inverse, so
-	// applying the same operation the server used restores the original layout.
-	for row := 0; row < divideNum; row++ {
-		for col := 0; col < divideNum; col++ {
-			dstRect := image.Rect(
-				col*cellWidth, row*cellHeight,
-				col*cellWidth+cellWidth, row*cellHeight+cellHeight,
-			)
-			srcMin := image.Point{
-				X: offset.X + row*cellWidth,
-				Y: offset.Y + col*cellHeight,
-			}
-			draw.Draw(ip.Dst, dstRect, ip.Src, srcMin, draw.Src)
+	// from[i] is the cell whose content ends up in cell i.
+	from := spec.Permutation
+	if scramble {
+		from = make([]int, len(spec.Permutation))
+		for i, p := range spec.Permutation {
+			from[p] = i
 		}
 	}
 
-	return ip.Dst
+	rowBytes := cellWidth * 4
+	cellRow := func(cell, y int) []byte {
+		x0, y0 := (cell%spec.Columns)*cellWidth, (cell/spec.Columns)*cellHeight+y
+		off := dst.PixOffset(x0, y0)
+		return dst.Pix[off : off+rowBytes]
+	}
+	moveCell := func(to, from int) {
+		for y := 0; y < cellHeight; y++ {
+			copy(cellRow(to, y), cellRow(from, y))
+		}
+	}
+
+	scratch := make([]byte, rowBytes*cellHeight)
+	moved := make([]bool, len(from))
+	for start := range from {
+		if moved[start] || from[start] == start {
+			continue
+		}
+		// Walk the cycle through start: save start's cell, pull every cell
+		// into place from its source, and finish with the saved one.
+		for y := 0; y < cellHeight; y++ {
+			copy(scratch[y*rowBytes:(y+1)*rowBytes], cellRow(start, y))
+		}
+		cell := start
+		for from[cell] != start {
+			moveCell(cell, from[cell])
+			moved[cell] = true
+			cell = from[cell]
+		}
+		for y := 0; y < cellHeight; y++ {
+			copy(cellRow(cell, y), scratch[y*rowBytes:(y+1)*rowBytes])
+		}
+		moved[cell] = true
+	}
+	return dst
+}
+
+// RestoreJPEG reverses the scrambling of Raw without decoding it to
+// pixels: it moves the JPEG's DCT blocks (see rearrangeJPEG) and returns the
+// restored JPEG, which keeps exactly the quality the server sent. It fails
+// when Raw is not a baseline JPEG or the cells do not line up with its
+// blocks; Deobfuscate is then the way to restore the page.
+func (ip *ImageProcessor) RestoreJPEG() ([]byte, error) {
+	spec := ip.Spec
+	if spec.Columns == 0 {
+		spec = comicDaysScramble
+	}
+	if spec.IsIdentity() && len(ip.Raw) > 2 && ip.Raw[0] == 0xFF && ip.Raw[1] == jpegSOI {
+		// Nothing to move; any JPEG can be kept as it is.
+		return ip.Raw, nil
+	}
+	return rearrangeJPEG(ip.Raw, spec, false)
 }
 
 func (ip *ImageProcessor) SaveImage(filePath string) error {
@@ -79,7 +146,7 @@ func (ip *ImageProcessor) SaveImage(filePath string) error {
 		return fmt.Errorf("image has not been deobfuscated")
 	}
 
-	outFile, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-*.png")
+	outFile, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-*."+ip.Format.Ext())
 	if err != nil {
 		return err
 	}
@@ -91,7 +158,9 @@ func (ip *ImageProcessor) SaveImage(filePath string) error {
 		}
 	}()
 
-	if err := png.Encode(outFile, ip.Dst); err != nil {
+	img, gray := ip.Format.prepare(ip.Dst)
+	ip.Grayscale = gray
+	if err := ip.Format.Encode(outFile, img); err != nil {
 		_ = outFile.Close()
 		return err
 	}
@@ -1,14 +1,254 @@
 package main
 
 import (
+	"flag"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"os"
 	"path/filepath"
 	"testing"
 )
 
+var updateGolden = flag.Bool("update", false, "rewrite the golden images in testdata")
+
 func TestSaveImageRequiresDeobfuscate(t *testing.T) {
 	processor := NewImageContext(image.NewRGBA(image.Rect(0, 0, 1, 1)))
 	if err := processor.SaveImage(filepath.Join(t.TempDir(), "out.png")); err == nil {
 		t.Fatal("SaveImage succeeded before Deobfuscate")
 	}
 }
+
+// testPicture gives every pixel of a width x height image a colour that
+// identifies its position, so any pixel moved to the wrong place shows up.
+func testPicture(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: uint8(x>>8 | (y>>8)<<4), A: 255})
+		}
+	}
+	return img
+}
+
+// referenceScramble scrambles img pixel by pixel, straight from the
+// definition of ScrambleSpec, independently of rearrangeCells.
+func referenceScramble(img *image.RGBA, spec ScrambleSpec) *image.RGBA {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	cellWidth := (width / (spec.Columns * spec.Multiple)) * spec.Multiple
+	cellHeight := (height / (spec.Rows * spec.Multiple)) * spec.Multiple
+	out := image.NewRGBA(b)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			tx, ty := x, y
+			if cellWidth > 0 && cellHeight > 0 && x < cellWidth*spec.Columns && y < cellHeight*spec.Rows {
+				to := spec.Permutation[(y/cellHeight)*spec.Columns+x/cellWidth]
+				tx = (to%spec.Columns)*cellWidth + x%cellWidth
+				ty = (to/spec.Columns)*cellHeight + y%cellHeight
+			}
+			out.SetRGBA(tx, ty, img.RGBAAt(x, y))
+		}
+	}
+	return out
+}
+
+func assertSameImage(t *testing.T, what string, got, want *image.RGBA) {
+	t.Helper()
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("%s: bounds = %v, want %v", what, got.Bounds(), want.Bounds())
+	}
+	b := want.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if g, w := got.RGBAAt(x, y), want.RGBAAt(x, y); g != w {
+				t.Fatalf("%s: pixel (%d,%d) = %v, want %v", what, x, y, g, w)
+			}
+		}
+	}
+}
+
+func mustScrambleSpec(t *testing.T, s string) ScrambleSpec {
+	t.Helper()
+	spec, err := ParseScrambleSpec(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func TestScrambleRoundTrip(t *testing.T) {
+	specs := []ScrambleSpec{
+		comicDaysScramble,
+		mustScrambleSpec(t, "3x2/8:4,0,5,1,3,2"),
+		mustScrambleSpec(t, "1x5/16:1,2,3,4,0"),
+	}
+	sizes := []struct {
+		name          string
+		width, height int
+	}{
+		{"single pixel", 1, 1},
+		{"smaller than one cell", 7, 7},
+		{"one short of a grid", 31, 31},
+		{"exact grid", 32, 32},
+		{"one past a grid", 33, 33},
+		{"odd margins", 63, 65},
+		{"typical page", 822, 1200},
+		{"tall webtoon strip", 240, 9000},
+		{"wide strip", 1000, 7},
+		{"narrow column", 8, 1000},
+	}
+	for _, spec := range specs {
+		for _, size := range sizes {
+			t.Run(spec.String()+"/"+size.name, func(t *testing.T) {
+				picture := testPicture(size.width, size.height)
+
+				scrambled := Scramble(picture, spec, size.width, size.height)
+				assertSameImage(t, "Scramble", scrambled, referenceScramble(picture, spec))
+
+				ip := NewImageContext(scrambled)
+				ip.Spec = spec
+				assertSameImage(t, "Deobfuscate", ip.Deobfuscate(size.width, size.height), picture)
+			})
+		}
+	}
+}
+
+func TestDeobfuscateHonoursSourceOffset(t *testing.T) {
+	picture := testPicture(70, 90)
+	scrambled := Scramble(picture, comicDaysScramble, 70, 90)
+
+	// A sub-image does not start at (0,0); Deobfuscate must read relative to
+	// its bounds.
+	padded := image.NewRGBA(image.Rect(0, 0, 80, 100))
+	for y := 0; y < 90; y++ {
+		for x := 0; x < 70; x++ {
+			padded.SetRGBA(x+5, y+7, scrambled.RGBAAt(x, y))
+		}
+	}
+	sub := padded.SubImage(image.Rect(5, 7, 75, 97))
+	assertSameImage(t, "Deobfuscate", NewImageContext(sub).Deobfuscate(70, 90), picture)
+}
+
+func TestScrambleGolden(t *testing.T) {
+	cases := []struct {
+		name          string
+		spec          ScrambleSpec
+		width, height int
+	}{
+		{"transpose-70x45", comicDaysScramble, 70, 45},
+		{"custom-3x2-53x37", mustScrambleSpec(t, "3x2/8:4,0,5,1,3,2"), 53, 37},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := Scramble(testPicture(tc.width, tc.height), tc.spec, tc.width, tc.height)
+			path := filepath.Join("testdata", "scramble", tc.name+".png")
+			if *updateGolden {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				f, err := os.Create(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				if err := png.Encode(f, got); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			defer f.Close()
+			decoded, err := png.Decode(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := image.NewRGBA(decoded.Bounds())
+			for y := 0; y < tc.height; y++ {
+				for x := 0; x < tc.width; x++ {
+					want.Set(x, y, decoded.At(x, y))
+				}
+			}
+			assertSameImage(t, "Scramble", got, want)
+		})
+	}
+}
+
+// drawRearrange is the original cell-by-cell draw.Draw implementation of
+// restoring, kept as a baseline for the benchmarks and as a cross-check of
+// the row-copying fast path.
+func drawRearrange(src image.Image, spec ScrambleSpec, width, height int) *image.RGBA {
+	cellWidth, cellHeight := spec.cellSize(width, height)
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	offset := src.Bounds().Min
+	draw.Draw(dst, dst.Bounds(), src, offset, draw.Src)
+	if cellWidth == 0 || cellHeight == 0 {
+		return dst
+	}
+	for i, from := range spec.Permutation {
+		col, row := i%spec.Columns, i/spec.Columns
+		dstRect := image.Rect(col*cellWidth, row*cellHeight, col*cellWidth+cellWidth, row*cellHeight+cellHeight)
+		srcMin := image.Point{X: offset.X + (from%spec.Columns)*cellWidth, Y: offset.Y + (from/spec.Columns)*cellHeight}
+		draw.Draw(dst, dstRect, src, srcMin, draw.Src)
+	}
+	return dst
+}
+
+// testYCbCr converts img to the 4:2:0 YCbCr layout JPEG pages decode to.
+func testYCbCr(img image.Image) *image.YCbCr {
+	b := img.Bounds()
+	out := image.NewYCbCr(b, image.YCbCrSubsampleRatio420)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(bl>>8))
+			out.Y[out.YOffset(x, y)] = yy
+			out.Cb[out.COffset(x, y)] = cb
+			out.Cr[out.COffset(x, y)] = cr
+		}
+	}
+	return out
+}
+
+func TestDeobfuscateMatchesDrawBaseline(t *testing.T) {
+	src := testYCbCr(testArtwork(822, 1203))
+	ip := NewImageContext(src)
+	assertSameImage(t, "Deobfuscate", ip.Deobfuscate(822, 1203), drawRearrange(src, comicDaysScramble, 822, 1203))
+}
+
+// benchmarkPageSizes are typical page sizes served by the site.
+var benchmarkPageSizes = []struct {
+	name          string
+	width, height int
+}{
+	{"760x1080", 760, 1080},
+	{"1200x1700", 1200, 1700},
+	{"1654x2339", 1654, 2339},
+}
+
+func BenchmarkDeobfuscate(b *testing.B) {
+	for _, size := range benchmarkPageSizes {
+		picture := testPicture(size.width, size.height)
+		sources := map[string]image.Image{"rgba": picture, "ycbcr": testYCbCr(picture)}
+		for _, kind := range []string{"ycbcr", "rgba"} {
+			src := sources[kind]
+			b.Run(size.name+"/"+kind+"/rows", func(b *testing.B) {
+				b.SetBytes(int64(size.width * size.height * 4))
+				for i := 0; i < b.N; i++ {
+					NewImageContext(src).Deobfuscate(size.width, size.height)
+				}
+			})
+			b.Run(size.name+"/"+kind+"/draw", func(b *testing.B) {
+				b.SetBytes(int64(size.width * size.height * 4))
+				for i := 0; i < b.N; i++ {
+					drawRearrange(src, comicDaysScramble, size.width, size.height)
+				}
+			})
+		}
+	}
+}
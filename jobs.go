@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxQueuedJobs bounds how many downloads may wait in the web UI's queue.
+const maxQueuedJobs = 256
+
+type jobState string
+
+const (
+	jobQueued  jobState = "queued"
+	jobRunning jobState = "running"
+	jobDone    jobState = "done"
+	jobFailed  jobState = "failed"
+)
+
+// pageProgress is the live state of a single page of a job, as shown in the
+// web UI.
+type pageProgress struct {
+	// State is one of "pending", "working", "done" or "failed".
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+}
+
+// job is one chapter download queued through the web UI.
+type job struct {
+	ID        int            `json:"id"`
+	URL       string         `json:"url"`
+	State     jobState       `json:"state"`
+	Error     string         `json:"error,omitempty"`
+	Status    string         `json:"status,omitempty"`
+	ChapterID string         `json:"chapterId,omitempty"`
+	Pages     []pageProgress `json:"pages"`
+	Created   time.Time      `json:"created"`
+}
+
+func (j *job) clone() job {
+	c := *j
+	c.Pages = append([]pageProgress(nil), j.Pages...)
+	return c
+}
+
+// jobRunner downloads the chapter of a job, reporting through rep. It
+// returns the folder the chapter was saved to, relative to the output root.
+type jobRunner func(url string, rep *jobReporter) (string, error)
+
+// jobQueue runs queued downloads on a fixed number of workers and publishes
+// every state change to its broker.
+type jobQueue struct {
+	mu      sync.Mutex
+	jobs    []*job
+	nextID  int
+	pending chan *job
+	events  *broker
+	run     jobRunner
+}
+
+func newJobQueue(workers int, events *broker, run jobRunner) *jobQueue {
+	q := &jobQueue{
+		pending: make(chan *job, maxQueuedJobs),
+		events:  events,
+		run:     run,
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return q
+}
+
+// Add validates url and queues it for download.
+func (q *jobQueue) Add(url string) (job, error) {
+	normalized, err := normalizeComicDaysURL(url)
+	if err != nil {
+		return job{}, err
+	}
+
+	q.mu.Lock()
+	q.nextID++
+	j := &job{ID: q.nextID, URL: normalized, State: jobQueued, Created: time.Now()}
+	select {
+	case q.pending <- j:
+	default:
+		q.mu.Unlock()
+		return job{}, fmt.Errorf("the download queue is full")
+	}
+	q.jobs = append(q.jobs, j)
+	snapshot := j.clone()
+	q.mu.Unlock()
+
+	q.events.Publish("job", snapshot)
+	return snapshot, nil
+}
+
+// Snapshot returns a copy of every job, oldest first.
+func (q *jobQueue) Snapshot() []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]job, len(q.jobs))
+	for i, j := range q.jobs {
+		jobs[i] = j.clone()
+	}
+	return jobs
+}
+
+func (q *jobQueue) work() {
+	for j := range q.pending {
+		q.update(j, func(j *job) {
+			j.State = jobRunning
+			j.Status = "fetching chapter page..."
+		})
+		dir, err := q.run(j.URL, &jobReporter{q: q, j: j})
+		q.update(j, func(j *job) {
+			if dir != "" {
+				j.ChapterID = chapterID(dir)
+			}
+			j.Status = ""
+			var already *AlreadyDownloadedError
+			if errors.As(err, &already) {
+				j.State = jobDone
+				j.Status = "skipped: " + already.Error()
+				return
+			}
+			if err != nil {
+				j.State = jobFailed
+				j.Error = err.Error()
+				return
+			}
+			j.State = jobDone
+		})
+		q.events.Publish("chapters", nil)
+	}
+}
+
+// update applies fn to j under the queue's lock and publishes the result.
+func (q *jobQueue) update(j *job, fn func(*job)) {
+	q.mu.Lock()
+	fn(j)
+	snapshot := j.clone()
+	q.mu.Unlock()
+	q.events.Publish("job", snapshot)
+}
+
+// jobReporter is the PageReporter for a job: instead of drawing a progress
+// bar it records each page's state on the job, which the web UI receives as
+// server-sent events.
+type jobReporter struct {
+	q *jobQueue
+	j *job
+}
+
+// Begin records how many pages the chapter has once it has been parsed.
+func (r *jobReporter) Begin(pageCount int) {
+	r.q.update(r.j, func(j *job) {
+		j.Status = ""
+		j.Pages = make([]pageProgress, pageCount)
+		for i := range j.Pages {
+			j.Pages[i].State = "pending"
+		}
+	})
+}
+
+func (r *jobReporter) setPage(pageNum int, state, message string) {
+	r.q.update(r.j, func(j *job) {
+		if pageNum < 1 || pageNum > len(j.Pages) {
+			j.Status = message
+			return
+		}
+		j.Pages[pageNum-1] = pageProgress{State: state, Message: message}
+	})
+}
+
+func (r *jobReporter) Status(pageNum int, format string, a ...any) {
+	r.setPage(pageNum, "working", fmt.Sprintf(format, a...))
+}
+
+func (r *jobReporter) RetryObserver(pageNum int, phase string) RetryObserver {
+	return func(attempt, maxAttempts int, err error, delay time.Duration) {
+		if delay <= 0 {
+			r.setPage(pageNum, "working", fmt.Sprintf("%s timed out: %v", phase, err))
+			return
+		}
+		r.setPage(pageNum, "working", fmt.Sprintf(
+			"%s retry %d/%d in %v: %v", phase, attempt, maxAttempts, delay.Round(time.Millisecond), err,
+		))
+	}
+}
+
+func (r *jobReporter) PageSucceeded(res pageResult) {
+	r.setPage(res.pageNum, "done", fmt.Sprintf(
+		"%dx%d · %s · %s → %s", res.width, res.height, res.scramble.Describe(), humanBytes(res.downloadBytes), humanBytes(res.savedBytes),
+	))
+}
+
+func (r *jobReporter) PageFailed(pageNum int, err error) {
+	r.setPage(pageNum, "failed", err.Error())
+}
+
+// broker fans server-sent events out to every connected browser.
+type broker struct {
+	mu   sync.Mutex
+	subs map[chan []byte]struct{}
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[chan []byte]struct{})}
+}
+
+// Subscribe registers a new listener. The returned function unregisters it.
+func (b *broker) Subscribe() (<-chan []byte, func()) {
+	ch := make(chan []byte, 64)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		b.mu.Unlock()
+	}
+}
+
+// Publish encodes v as the data of an SSE event named event. Listeners that
+// are not keeping up miss the event rather than stalling the downloads; every
+// job event carries the job's full state, so the next one catches them up.
+func (b *broker) Publish(event string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	msg := []byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// This file rearranges the cells of a scrambled JPEG without decoding it to
+// pixels, the way jpegtran crops and rotates: the entropy-coded data is
+// decoded into DCT coefficient blocks, whole blocks are moved, and the
+// blocks are entropy-coded again. The quantised coefficients are untouched,
+// so the restored page is exactly as good as the one the server sent.
+//
+// Only baseline (sequential, Huffman-coded) JPEGs with a single scan are
+// handled, which is what image servers produce. Everything else is reported
+// as errJPEGUnsupported so the caller can fall back to restoring pixels.
+
+var errJPEGUnsupported = errors.New("not a baseline single-scan JPEG")
+
+const (
+	jpegSOI  = 0xD8
+	jpegEOI  = 0xD9
+	jpegSOF0 = 0xC0
+	jpegSOF1 = 0xC1
+	jpegDHT  = 0xC4
+	jpegSOS  = 0xDA
+	jpegDQT  = 0xDB
+	jpegDRI  = 0xDD
+	jpegRST0 = 0xD0
+	jpegRST7 = 0xD7
+	jpegAPP0 = 0xE0
+	jpegAPPF = 0xEF
+	jpegCOM  = 0xFE
+)
+
+// jpegBlock holds the 64 quantised coefficients of one 8x8 block in zigzag
+// order.
+type jpegBlock [64]int32
+
+type jpegComponent struct {
+	id     byte
+	h, v   int // sampling factors
+	tq     byte
+	td, ta byte // DC and AC Huffman table selectors of the scan
+
+	// blocks is a bw x bh array of the component's blocks, row by row.
+	blocks []jpegBlock
+	bw, bh int
+}
+
+// jpegImage is a parsed baseline JPEG.
+type jpegImage struct {
+	// keep are the marker segments copied verbatim to the output (APPn,
+	// COM and DQT), including their markers.
+	keep          [][]byte
+	sof           byte
+	precision     byte
+	width, height int
+	comps         []*jpegComponent
+	hmax, vmax    int
+	mcusX, mcusY  int
+	// restartInterval is the number of MCUs between restart markers, or 0.
+	restartInterval int
+}
+
+// mcuSize is the size in pixels of one MCU, the unit blocks move in.
+func (j *jpegImage) mcuSize() (int, int) {
+	if len(j.comps) == 1 {
+		return 8, 8
+	}
+	return 8 * j.hmax, 8 * j.vmax
+}
+
+// rearrangeJPEG restores (or, with scramble set, scrambles) the cells of the
+// JPEG in data as rearrangeCells would, but in the compressed domain. It
+// fails with errJPEGUnsupported when data is not a baseline JPEG, and with
+// another error when the cells do not line up with the JPEG's MCUs.
+func rearrangeJPEG(data []byte, spec ScrambleSpec, scramble bool) ([]byte, error) {
+	img, err := parseJPEG(data)
+	if err != nil {
+		return nil, err
+	}
+	cellWidth, cellHeight := spec.cellSize(img.width, img.height)
+	mcuWidth, mcuHeight := img.mcuSize()
+	if cellWidth%mcuWidth != 0 || cellHeight%mcuHeight != 0 {
+		return nil, fmt.Errorf("%dx%d cells do not line up with the JPEG's %dx%d blocks", cellWidth, cellHeight, mcuWidth, mcuHeight)
+	}
+	if cellWidth > 0 && cellHeight > 0 {
+		from := spec.Permutation
+		if scramble {
+			from = make([]int, len(spec.Permutation))
+			for i, p := range spec.Permutation {
+				from[p] = i
+			}
+		}
+		for _, c := range img.comps {
+			// The size of a cell in this component's blocks.
+			cw, ch := cellWidth/mcuWidth, cellHeight/mcuHeight
+			if len(img.comps) > 1 {
+				cw, ch = cw*c.h, ch*c.v
+			}
+			src := append([]jpegBlock(nil), c.blocks...)
+			for i, f := range from {
+				if i == f {
+					continue
+				}
+				dx, dy := (i%spec.Columns)*cw, (i/spec.Columns)*ch
+				sx, sy := (f%spec.Columns)*cw, (f/spec.Columns)*ch
+				for y := 0; y < ch; y++ {
+					copy(c.blocks[(dy+y)*c.bw+dx:][:cw], src[(sy+y)*c.bw+sx:][:cw])
+				}
+			}
+		}
+	}
+	return img.encode()
+}
+
+// parseJPEG decodes data down to its coefficient blocks.
+func parseJPEG(data []byte) (*jpegImage, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil, errJPEGUnsupported
+	}
+	img := &jpegImage{}
+	var dc, ac [4]*huffmanDecoder
+	scanned := false
+
+	pos := 2
+	for {
+		// Skip to the next marker, allowing fill bytes.
+		for pos < len(data) && data[pos] != 0xFF {
+			pos++
+		}
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, fmt.Errorf("truncated JPEG")
+		}
+		marker := data[pos]
+		pos++
+		if marker == jpegEOI {
+			if !scanned {
+				return nil, fmt.Errorf("JPEG has no image data")
+			}
+			return img, nil
+		}
+		if pos+2 > len(data) {
+			return nil, fmt.Errorf("truncated JPEG")
+		}
+		length := int(data[pos])<<8 | int(data[pos+1])
+		if length < 2 || pos+length > len(data) {
+			return nil, fmt.Errorf("invalid JPEG segment length")
+		}
+		seg := data[pos+2 : pos+length]
+		start := pos - 2
+		pos += length
+
+		switch {
+		case marker == jpegSOF0 || marker == jpegSOF1:
+			if err := img.parseSOF(marker, seg); err != nil {
+				return nil, err
+			}
+		case marker >= 0xC2 && marker <= 0xCF && marker != jpegDHT && marker != 0xC8 && marker != 0xCC:
+			// Progressive, lossless, hierarchical or arithmetic-coded.
+			return nil, errJPEGUnsupported
+		case marker == jpegDHT:
+			if err := parseDHT(seg, &dc, &ac); err != nil {
+				return nil, err
+			}
+		case marker == jpegDRI:
+			if len(seg) != 2 {
+				return nil, fmt.Errorf("invalid JPEG restart interval")
+			}
+			img.restartInterval = int(seg[0])<<8 | int(seg[1])
+		case marker == jpegDQT || marker == jpegCOM || (marker >= jpegAPP0 && marker <= jpegAPPF):
+			img.keep = append(img.keep, data[start:pos])
+		case marker == jpegSOS:
+			if scanned || img.comps == nil {
+				return nil, errJPEGUnsupported
+			}
+			n, err := img.decodeScan(seg, data[pos:], dc, ac)
+			if err != nil {
+				return nil, err
+			}
+			pos += n
+			scanned = true
+		}
+	}
+}
+
+func (img *jpegImage) parseSOF(marker byte, seg []byte) error {
+	if len(seg) < 6 || img.comps != nil {
+		return fmt.Errorf("invalid JPEG frame header")
+	}
+	img.sof = marker
+	img.precision = seg[0]
+	img.height = int(seg[1])<<8 | int(seg[2])
+	img.width = int(seg[3])<<8 | int(seg[4])
+	n := int(seg[5])
+	if img.precision != 8 || img.width == 0 || img.height == 0 || (n != 1 && n != 3) || len(seg) != 6+3*n {
+		return errJPEGUnsupported
+	}
+	if err := validatePageDimensions(img.width, img.height); err != nil {
+		return err
+	}
+	img.hmax, img.vmax = 1, 1
+	for i := 0; i < n; i++ {
+		c := &jpegComponent{id: seg[6+3*i], h: int(seg[7+3*i] >> 4), v: int(seg[7+3*i] & 15), tq: seg[8+3*i]}
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 {
+			return fmt.Errorf("invalid JPEG sampling factors")
+		}
+		img.hmax, img.vmax = max(img.hmax, c.h), max(img.vmax, c.v)
+		img.comps = append(img.comps, c)
+	}
+
+	if n == 1 {
+		// A single-component scan is not interleaved: its MCU is one block
+		// whatever the sampling factors say.
+		c := img.comps[0]
+		c.bw, c.bh = (img.width+7)/8, (img.height+7)/8
+		c.blocks = make([]jpegBlock, c.bw*c.bh)
+		img.mcusX, img.mcusY = c.bw, c.bh
+		return nil
+	}
+	img.mcusX = (img.width + 8*img.hmax - 1) / (8 * img.hmax)
+	img.mcusY = (img.height + 8*img.vmax - 1) / (8 * img.vmax)
+	for _, c := range img.comps {
+		c.bw, c.bh = img.mcusX*c.h, img.mcusY*c.v
+		c.blocks = make([]jpegBlock, c.bw*c.bh)
+	}
+	return nil
+}
+
+func parseDHT(seg []byte, dc, ac *[4]*huffmanDecoder) error {
+	for len(seg) > 0 {
+		if len(seg) < 17 {
+			return fmt.Errorf("invalid JPEG Huffman table")
+		}
+		class, id := seg[0]>>4, seg[0]&15
+		if class > 1 || id > 3 {
+			return fmt.Errorf("invalid JPEG Huffman table")
+		}
+		var bits [16]int
+		total := 0
+		for i := range bits {
+			bits[i] = int(seg[1+i])
+			total += bits[i]
+		}
+		if total > 256 || len(seg) < 17+total {
+			return fmt.Errorf("invalid JPEG Huffman table")
+		}
+		d := newHuffmanDecoder(bits, seg[17:17+total])
+		if class == 0 {
+			dc[id] = d
+		} else {
+			ac[id] = d
+		}
+		seg = seg[17+total:]
+	}
+	return nil
+}
+
+// decodeScan decodes the entropy-coded data following the SOS header hdr
+// and returns how many bytes of rest it used.
+func (img *jpegImage) decodeScan(hdr, rest []byte, dc, ac [4]*huffmanDecoder) (int, error) {
+	if len(hdr) < 1 {
+		return 0, fmt.Errorf("invalid JPEG scan header")
+	}
+	n := int(hdr[0])
+	if n != len(img.comps) || len(hdr) != 4+2*n {
+		// Components coded in separate scans.
+		return 0, errJPEGUnsupported
+	}
+	for i := 0; i < n; i++ {
+		c := img.comps[i]
+		if hdr[1+2*i] != c.id {
+			return 0, errJPEGUnsupported
+		}
+		c.td, c.ta = hdr[2+2*i]>>4, hdr[2+2*i]&15
+		if c.td > 3 || c.ta > 3 || dc[c.td] == nil || ac[c.ta] == nil {
+			return 0, fmt.Errorf("JPEG scan uses an undefined Huffman table")
+		}
+	}
+	if ss, se, a := hdr[1+2*n], hdr[2+2*n], hdr[3+2*n]; ss != 0 || se != 63 || a != 0 {
+		return 0, errJPEGUnsupported
+	}
+
+	r := &jpegBitReader{data: rest}
+	preds := make([]int32, n)
+	mcus := img.mcusX * img.mcusY
+	for m := 0; m < mcus; m++ {
+		if img.restartInterval > 0 && m > 0 && m%img.restartInterval == 0 {
+			if err := r.restart(); err != nil {
+				return 0, err
+			}
+			for i := range preds {
+				preds[i] = 0
+			}
+		}
+		mx, my := m%img.mcusX, m/img.mcusX
+		for ci, c := range img.comps {
+			if n == 1 {
+				if err := r.decodeBlock(&c.blocks[m], &preds[ci], dc[c.td], ac[c.ta]); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			for v := 0; v < c.v; v++ {
+				for h := 0; h < c.h; h++ {
+					b := &c.blocks[(my*c.v+v)*c.bw+mx*c.h+h]
+					if err := r.decodeBlock(b, &preds[ci], dc[c.td], ac[c.ta]); err != nil {
+						return 0, err
+					}
+				}
+			}
+		}
+	}
+	return r.end(), nil
+}
+
+// huffmanDecoder decodes one Huffman table the way Annex F.2.2.3 of the
+// JPEG standard describes: code by code length.
+type huffmanDecoder struct {
+	maxCode [17]int32
+	valPtr  [17]int32
+	minCode [17]int32
+	vals    []byte
+}
+
+func newHuffmanDecoder(bits [16]int, vals []byte) *huffmanDecoder {
+	d := &huffmanDecoder{vals: append([]byte(nil), vals...)}
+	code, k := int32(0), int32(0)
+	for l := 1; l <= 16; l++ {
+		n := int32(bits[l-1])
+		if n == 0 {
+			d.maxCode[l] = -1
+		} else {
+			d.valPtr[l] = k
+			d.minCode[l] = code
+			code += n
+			k += n
+			d.maxCode[l] = code - 1
+		}
+		code <<= 1
+	}
+	return d
+}
+
+// jpegBitReader reads entropy-coded data, undoing byte stuffing.
+type jpegBitReader struct {
+	data  []byte
+	pos   int
+	bits  uint32
+	nbits int
+	// marker is set once a marker has been reached; from then on only
+	// zero bits are returned, as the standard prescribes.
+	marker bool
+}
+
+func (r *jpegBitReader) fill() {
+	for r.nbits <= 24 {
+		var b byte
+		if !r.marker && r.pos < len(r.data) {
+			b = r.data[r.pos]
+			if b == 0xFF {
+				if r.pos+1 < len(r.data) && r.data[r.pos+1] == 0 {
+					r.pos += 2
+				} else {
+					r.marker = true
+					b = 0
+				}
+			} else {
+				r.pos++
+			}
+		}
+		r.bits |= uint32(b) << (24 - r.nbits)
+		r.nbits += 8
+	}
+}
+
+func (r *jpegBitReader) bit() int32 {
+	if r.nbits == 0 {
+		r.fill()
+	}
+	b := int32(r.bits >> 31)
+	r.bits <<= 1
+	r.nbits--
+	return b
+}
+
+func (r *jpegBitReader) receive(n int) int32 {
+	v := int32(0)
+	for i := 0; i < n; i++ {
+		v = v<<1 | r.bit()
+	}
+	return v
+}
+
+func (r *jpegBitReader) decode(d *huffmanDecoder) (byte, error) {
+	code := r.bit()
+	for l := 1; l <= 16; l++ {
+		if d.maxCode[l] >= 0 && code <= d.maxCode[l] {
+			i := d.valPtr[l] + code - d.minCode[l]
+			if int(i) >= len(d.vals) {
+				break
+			}
+			return d.vals[i], nil
+		}
+		code = code<<1 | r.bit()
+	}
+	return 0, fmt.Errorf("corrupt JPEG data")
+}
+
+// extend turns the n-bit value v into the signed number it codes.
+func extend(v int32, n int) int32 {
+	if n > 0 && v < 1<<(n-1) {
+		return v - (1 << n) + 1
+	}
+	return v
+}
+
+func (r *jpegBitReader) decodeBlock(b *jpegBlock, pred *int32, dc, ac *huffmanDecoder) error {
+	t, err := r.decode(dc)
+	if err != nil {
+		return err
+	}
+	if t > 11 {
+		return fmt.Errorf("corrupt JPEG data")
+	}
+	*pred += extend(r.receive(int(t)), int(t))
+	b[0] = *pred
+	for k := 1; k < 64; {
+		rs, err := r.decode(ac)
+		if err != nil {
+			return err
+		}
+		run, size := int(rs>>4), int(rs&15)
+		if size == 0 {
+			if run != 15 {
+				break // end of block
+			}
+			k += 16
+			continue
+		}
+		k += run
+		if k > 63 || size > 10 {
+			return fmt.Errorf("corrupt JPEG data")
+		}
+		b[k] = extend(r.receive(size), size)
+		k++
+	}
+	return nil
+}
+
+// restart consumes the RSTn marker between two restart intervals.
+func (r *jpegBitReader) restart() error {
+	// Drop the padding bits of the interval and find the marker.
+	r.bits, r.nbits = 0, 0
+	for r.pos < len(r.data) && r.data[r.pos] == 0xFF && r.pos+1 < len(r.data) && r.data[r.pos+1] == 0xFF {
+		r.pos++
+	}
+	if r.pos+1 >= len(r.data) || r.data[r.pos] != 0xFF || r.data[r.pos+1] < jpegRST0 || r.data[r.pos+1] > jpegRST7 {
+		return fmt.Errorf("corrupt JPEG data: missing restart marker")
+	}
+	r.pos += 2
+	r.marker = false
+	return nil
+}
+
+// end returns the offset of the first byte after the entropy-coded data.
+func (r *jpegBitReader) end() int {
+	for r.pos < len(r.data) {
+		if r.data[r.pos] == 0xFF && r.pos+1 < len(r.data) && r.data[r.pos+1] != 0 && (r.data[r.pos+1] < jpegRST0 || r.data[r.pos+1] > jpegRST7) {
+			return r.pos
+		}
+		r.pos++
+	}
+	return r.pos
+}
+
+// encode writes the image as a baseline JPEG with Huffman tables optimised
+// for its coefficients.
+func (img *jpegImage) encode() ([]byte, error) {
+	// The first pass only counts symbols; the second writes them.
+	var dcFreq, acFreq [4][257]int
+	img.entropyCode(func(class, table int, sym byte, _ int32, _ int) {
+		if class == 0 {
+			dcFreq[table][sym]++
+		} else {
+			acFreq[table][sym]++
+		}
+	}, func(int) {})
+
+	var dcEnc, acEnc [4]*huffmanEncoder
+	var dht bytes.Buffer
+	for t := 0; t < 4; t++ {
+		for class, freq := range [][257]int{dcFreq[t], acFreq[t]} {
+			used := false
+			for _, f := range freq[:256] {
+				if f > 0 {
+					used = true
+				}
+			}
+			if !used {
+				continue
+			}
+			bits, vals := optimalHuffmanTable(freq)
+			enc := newHuffmanEncoder(bits, vals)
+			if class == 0 {
+				dcEnc[t] = enc
+			} else {
+				acEnc[t] = enc
+			}
+			dht.WriteByte(byte(class<<4 | t))
+			for _, b := range bits {
+				dht.WriteByte(byte(b))
+			}
+			dht.Write(vals)
+		}
+	}
+
+	var out bytes.Buffer
+	out.Write([]byte{0xFF, jpegSOI})
+	for _, seg := range img.keep {
+		out.Write(seg)
+	}
+
+	sof := []byte{img.precision, byte(img.height >> 8), byte(img.height), byte(img.width >> 8), byte(img.width), byte(len(img.comps))}
+	for _, c := range img.comps {
+		sof = append(sof, c.id, byte(c.h<<4|c.v), c.tq)
+	}
+	writeJPEGSegment(&out, img.sof, sof)
+	writeJPEGSegment(&out, jpegDHT, dht.Bytes())
+	if img.restartInterval > 0 {
+		writeJPEGSegment(&out, jpegDRI, []byte{byte(img.restartInterval >> 8), byte(img.restartInterval)})
+	}
+
+	sos := []byte{byte(len(img.comps))}
+	for _, c := range img.comps {
+		sos = append(sos, c.id, c.td<<4|c.ta)
+	}
+	sos = append(sos, 0, 63, 0)
+	writeJPEGSegment(&out, jpegSOS, sos)
+
+	w := &jpegBitWriter{out: &out}
+	img.entropyCode(func(class, table int, sym byte, extra int32, extraBits int) {
+		enc := acEnc[table]
+		if class == 0 {
+			enc = dcEnc[table]
+		}
+		w.write(enc.codes[sym], int(enc.sizes[sym]))
+		if extraBits > 0 {
+			w.write(uint32(extra)&(1<<extraBits-1), extraBits)
+		}
+	}, func(n int) {
+		w.flush()
+		out.Write([]byte{0xFF, jpegRST0 + byte(n%8)})
+	})
+	w.flush()
+	out.Write([]byte{0xFF, jpegEOI})
+	return out.Bytes(), nil
+}
+
+func writeJPEGSegment(out *bytes.Buffer, marker byte, payload []byte) {
+	n := len(payload) + 2
+	out.Write([]byte{0xFF, marker, byte(n >> 8), byte(n)})
+	out.Write(payload)
+}
+
+// entropyCode walks every block in scan order and calls emit for each
+// Huffman symbol: its class (0 DC, 1 AC), table, value and the extra bits
+// that follow it. restart is called with the number of every restart
+// interval that ends.
+func (img *jpegImage) entropyCode(emit func(class, table int, sym byte, extra int32, extraBits int), restart func(n int)) {
+	preds := make([]int32, len(img.comps))
+	block := func(ci int, b *jpegBlock) {
+		c := img.comps[ci]
+		diff := b[0] - preds[ci]
+		preds[ci] = b[0]
+		size, extra := magnitude(diff)
+		emit(0, int(c.td), byte(size), extra, size)
+
+		run := 0
+		for k := 1; k < 64; k++ {
+			if b[k] == 0 {
+				run++
+				continue
+			}
+			for run > 15 {
+				emit(1, int(c.ta), 0xF0, 0, 0)
+				run -= 16
+			}
+			size, extra := magnitude(b[k])
+			emit(1, int(c.ta), byte(run<<4|size), extra, size)
+			run = 0
+		}
+		if run > 0 {
+			emit(1, int(c.ta), 0x00, 0, 0)
+		}
+	}
+
+	for m := 0; m < img.mcusX*img.mcusY; m++ {
+		if img.restartInterval > 0 && m > 0 && m%img.restartInterval == 0 {
+			restart(m/img.restartInterval - 1)
+			for i := range preds {
+				preds[i] = 0
+			}
+		}
+		mx, my := m%img.mcusX, m/img.mcusX
+		for ci, c := range img.comps {
+			if len(img.comps) == 1 {
+				block(ci, &c.blocks[m])
+				continue
+			}
+			for v := 0; v < c.v; v++ {
+				for h := 0; h < c.h; h++ {
+					block(ci, &c.blocks[(my*c.v+v)*c.bw+mx*c.h+h])
+				}
+			}
+		}
+	}
+}
+
+// magnitude returns the size category of v and the bits that code it.
+func magnitude(v int32) (int, int32) {
+	a := v
+	if a < 0 {
+		a = -a
+		v--
+	}
+	size := 0
+	for a > 0 {
+		size++
+		a >>= 1
+	}
+	return size, v
+}
+
+type huffmanEncoder struct {
+	codes [256]uint32
+	sizes [256]uint8
+}
+
+func newHuffmanEncoder(bits [16]int, vals []byte) *huffmanEncoder {
+	e := &huffmanEncoder{}
+	code, k := uint32(0), 0
+	for l := 1; l <= 16; l++ {
+		for i := 0; i < bits[l-1]; i++ {
+			e.codes[vals[k]] = code
+			e.sizes[vals[k]] = uint8(l)
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return e
+}
+
+// optimalHuffmanTable builds the code lengths for the symbol frequencies
+// freq (of which freq[256] is ignored), limited to 16 bits and never using
+// the all-ones code, as in Annex K.2 of the JPEG standard.
+func optimalHuffmanTable(freq [257]int) ([16]int, []byte) {
+	var f [257]int
+	copy(f[:], freq[:])
+	// The reserved symbol 256 guarantees no code consists of only ones.
+	f[256] = 1
+
+	var codeSize [257]int
+	var others [257]int
+	for i := range others {
+		others[i] = -1
+	}
+	for {
+		// Find the two least frequent symbols, v1 the least.
+		v1, v2 := -1, -1
+		for i := 0; i < 257; i++ {
+			if f[i] == 0 {
+				continue
+			}
+			if v1 < 0 || f[i] <= f[v1] {
+				v2, v1 = v1, i
+			} else if v2 < 0 || f[i] <= f[v2] {
+				v2 = i
+			}
+		}
+		if v2 < 0 {
+			break
+		}
+		f[v1] += f[v2]
+		f[v2] = 0
+		codeSize[v1]++
+		for others[v1] >= 0 {
+			v1 = others[v1]
+			codeSize[v1]++
+		}
+		others[v1] = v2
+		codeSize[v2]++
+		for others[v2] >= 0 {
+			v2 = others[v2]
+			codeSize[v2]++
+		}
+	}
+
+	var bits [33]int
+	for i := 0; i < 257; i++ {
+		if codeSize[i] > 0 {
+			bits[codeSize[i]]++
+		}
+	}
+	// Shorten codes longer than 16 bits.
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	// Remove the reserved symbol, which has the longest code.
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+
+	var out [16]int
+	copy(out[:], bits[1:17])
+	var vals []byte
+	for size := 1; size <= 32; size++ {
+		for sym := 0; sym < 256; sym++ {
+			if codeSize[sym] == size {
+				vals = append(vals, byte(sym))
+			}
+		}
+	}
+	return out, vals
+}
+
+// jpegBitWriter writes entropy-coded data with byte stuffing.
+type jpegBitWriter struct {
+	out   *bytes.Buffer
+	bits  uint32
+	nbits int
+}
+
+func (w *jpegBitWriter) write(code uint32, n int) {
+	w.bits = w.bits<<n | code
+	w.nbits += n
+	for w.nbits >= 8 {
+		b := byte(w.bits >> (w.nbits - 8))
+		w.out.WriteByte(b)
+		if b == 0xFF {
+			w.out.WriteByte(0)
+		}
+		w.nbits -= 8
+	}
+	w.bits &= 1<<w.nbits - 1
+}
+
+// flush pads the last byte with one bits.
+func (w *jpegBitWriter) flush() {
+	if w.nbits > 0 {
+		w.write(1<<(8-w.nbits)-1, 8-w.nbits)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// encodeTestJPEG encodes img as a baseline JPEG. Colour images come out
+// with 4:2:0 chroma (16x16 MCUs), *image.Gray ones with a single component
+// (8x8 MCUs).
+func encodeTestJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeTestJPEG(t *testing.T, data []byte) *image.RGBA {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decoding the rearranged JPEG: %v", err)
+	}
+	out := image.NewRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	return out
+}
+
+func grayTestImage(src image.Image) *image.Gray {
+	g := image.NewGray(src.Bounds())
+	draw.Draw(g, g.Bounds(), src, src.Bounds().Min, draw.Src)
+	return g
+}
+
+// Moving DCT blocks must give exactly the pixels that restoring the decoded
+// JPEG would, since every block decodes on its own.
+func TestRearrangeJPEGMatchesPixelRestore(t *testing.T) {
+	custom := mustScrambleSpec(t, "3x2/8:5,3,0,4,1,2")
+	tests := []struct {
+		name          string
+		spec          ScrambleSpec
+		width, height int
+		gray          bool
+	}{
+		{"colour 4:2:0", comicDaysScramble, 130, 197, false},
+		{"gray", comicDaysScramble, 123, 77, true},
+		{"gray custom", custom, 101, 60, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var src image.Image = Scramble(testPicture(tt.width, tt.height), tt.spec, tt.width, tt.height)
+			if tt.gray {
+				src = grayTestImage(src)
+			}
+			scrambled := encodeTestJPEG(t, src)
+
+			restored, err := rearrangeJPEG(scrambled, tt.spec, false)
+			if err != nil {
+				t.Fatalf("rearrangeJPEG returned error: %v", err)
+			}
+			want := rearrangeCells(decodeTestJPEG(t, scrambled), tt.spec, tt.width, tt.height, false)
+			assertSameImage(t, "restored JPEG", decodeTestJPEG(t, restored), want)
+
+			again, err := rearrangeJPEG(restored, tt.spec, true)
+			if err != nil {
+				t.Fatalf("rearrangeJPEG(scramble) returned error: %v", err)
+			}
+			assertSameImage(t, "re-scrambled JPEG", decodeTestJPEG(t, again), decodeTestJPEG(t, scrambled))
+		})
+	}
+}
+
+func TestRearrangeJPEGKeepsRestartIntervals(t *testing.T) {
+	const width, height = 130, 197
+	src := Scramble(testPicture(width, height), comicDaysScramble, width, height)
+	scrambled := encodeTestJPEG(t, src)
+
+	// Re-encode the scrambled page with restart markers every 3 MCUs.
+	j, err := parseJPEG(scrambled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.restartInterval = 3
+	withRestarts, err := j.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(withRestarts, []byte{0xFF, jpegDRI}) {
+		t.Fatal("re-encoded JPEG has no DRI segment")
+	}
+	assertSameImage(t, "JPEG with restarts", decodeTestJPEG(t, withRestarts), decodeTestJPEG(t, scrambled))
+
+	restored, err := rearrangeJPEG(withRestarts, comicDaysScramble, false)
+	if err != nil {
+		t.Fatalf("rearrangeJPEG returned error: %v", err)
+	}
+	want := rearrangeCells(decodeTestJPEG(t, scrambled), comicDaysScramble, width, height, false)
+	assertSameImage(t, "restored JPEG", decodeTestJPEG(t, restored), want)
+}
+
+func TestRearrangeJPEGRefusesWhatItCannotDo(t *testing.T) {
+	// 100 pixels wide gives 24 pixel cells, which split 16x16 MCUs.
+	colour := encodeTestJPEG(t, testPicture(100, 100))
+	if _, err := rearrangeJPEG(colour, comicDaysScramble, false); err == nil || errors.Is(err, errJPEGUnsupported) {
+		t.Fatalf("misaligned cells: err = %v, want an alignment error", err)
+	}
+
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, testPicture(64, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rearrangeJPEG(pngData.Bytes(), comicDaysScramble, false); !errors.Is(err, errJPEGUnsupported) {
+		t.Fatalf("PNG input: err = %v, want errJPEGUnsupported", err)
+	}
+
+	truncated := encodeTestJPEG(t, grayTestImage(testPicture(64, 64)))
+	if _, err := rearrangeJPEG(truncated[:len(truncated)/2], comicDaysScramble, false); err == nil {
+		t.Fatal("truncated JPEG: rearrangeJPEG succeeded")
+	}
+}
+
+func TestDeobfuscateAndSaveKeepsJPEG(t *testing.T) {
+	const width, height = 123, 77
+	scrambled := encodeTestJPEG(t, grayTestImage(Scramble(testPicture(width, height), comicDaysScramble, width, height)))
+	img, err := jpeg.Decode(bytes.NewReader(scrambled))
+	if err != nil {
+		t.Fatal(err)
+	}
+	format, err := ParseImageFormat("jpeg-lossless", 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := ChapterOutput{Dir: t.TempDir(), Format: format}
+	page := NewPage("", width, height)
+
+	saved, err := page.deobfuscateAndSave(img, scrambled, out, 1)
+	if err != nil {
+		t.Fatalf("deobfuscateAndSave returned error: %v", err)
+	}
+	if saved.file != "001.jpg" || saved.format != "JPEG lossless" {
+		t.Fatalf("saved %s as %q, want 001.jpg as JPEG lossless", saved.file, saved.format)
+	}
+
+	// A page that was not a JPEG falls back to PNG.
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	saved, err = page.deobfuscateAndSave(img, pngData.Bytes(), out, 2)
+	if err != nil {
+		t.Fatalf("deobfuscateAndSave returned error: %v", err)
+	}
+	if saved.file != "002.png" {
+		t.Fatalf("fallback page saved as %s, want 002.png", saved.file)
+	}
+}
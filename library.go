@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pterm/pterm"
+)
+
+// libraryFile is the library index inside the data directory.
+const libraryFile = "library.json"
+
+// LibraryEntry records one downloaded episode.
+type LibraryEntry struct {
+	EpisodeID   string        `json:"episodeId,omitempty"`
+	URL         string        `json:"url"`
+	Title       string        `json:"title,omitempty"`
+	Number      int           `json:"number,omitempty"`
+	SeriesID    string        `json:"seriesId,omitempty"`
+	SeriesTitle string        `json:"seriesTitle,omitempty"`
+	PageCount   int           `json:"pageCount"`
+	Path        string        `json:"path"`
+	Pages       []LibraryPage `json:"pages"`
+	Downloaded  time.Time     `json:"downloaded"`
+}
+
+// LibraryPage is the file name and hash of one downloaded page.
+type LibraryPage struct {
+	File   string `json:"file"`
+	SHA256 string `json:"sha256"`
+}
+
+// key identifies the episode: its site ID, or its URL for episodes whose
+// metadata carried no ID.
+func (e LibraryEntry) key() string {
+	if e.EpisodeID != "" {
+		return e.EpisodeID
+	}
+	return e.URL
+}
+
+// matches reports whether ref names this entry by episode ID or URL.
+func (e LibraryEntry) matches(ref string) bool {
+	if ref == "" {
+		return false
+	}
+	if ref == e.EpisodeID || ref == e.URL {
+		return true
+	}
+	normalized, err := normalizeComicDaysURL(ref)
+	return err == nil && normalized == e.URL
+}
+
+// newLibraryEntry builds the library record of a completely downloaded
+// chapter from its manifest.
+func newLibraryEntry(m Manifest, outDir string) LibraryEntry {
+	path, err := filepath.Abs(outDir)
+	if err != nil {
+		path = outDir
+	}
+	entry := LibraryEntry{
+		EpisodeID:   m.Episode.ID,
+		URL:         m.Episode.URL,
+		Title:       m.Episode.Title,
+		Number:      m.Episode.Number,
+		SeriesID:    m.Episode.SeriesID,
+		SeriesTitle: m.Episode.SeriesTitle,
+		PageCount:   len(m.Pages),
+		Path:        path,
+		Downloaded:  m.Downloaded,
+	}
+	for _, p := range m.Pages {
+		entry.Pages = append(entry.Pages, LibraryPage{File: p.File, SHA256: p.SHA256})
+	}
+	return entry
+}
+
+// Library is the persistent index of downloaded episodes, stored as a JSON
+// file in the data directory. Every change re-reads the file before writing
+// it back, so a watch process and a one-off download sharing the same data
+// directory do not drop each other's records.
+type Library struct {
+	path string
+
+	mu      sync.Mutex
+	entries []LibraryEntry
+}
+
+// OpenLibrary loads the library in dataDir, starting an empty one if it does
+// not exist yet.
+func OpenLibrary(dataDir string) (*Library, error) {
+	l := &Library{path: filepath.Join(dataDir, libraryFile)}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Library) reload() error {
+	var entries []LibraryEntry
+	if err := readJSONFile(l.path, &entries); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not open the library: %w", err)
+	}
+	l.entries = entries
+	return nil
+}
+
+// Entries returns every recorded episode, grouped by series and sorted by
+// episode number.
+func (l *Library) Entries() []LibraryEntry {
+	l.mu.Lock()
+	entries := append([]LibraryEntry(nil), l.entries...)
+	l.mu.Unlock()
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.SeriesTitle != b.SeriesTitle {
+			return a.SeriesTitle < b.SeriesTitle
+		}
+		if a.Number != b.Number {
+			return a.Number < b.Number
+		}
+		return a.Downloaded.Before(b.Downloaded)
+	})
+	return entries
+}
+
+// Find looks an entry up by episode ID or URL.
+func (l *Library) Find(ref string) (LibraryEntry, bool) {
+	if l == nil {
+		return LibraryEntry{}, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if e.matches(ref) {
+			return e, true
+		}
+	}
+	return LibraryEntry{}, false
+}
+
+// Has reports whether episode has already been downloaded and its folder is
+// still on disk. A nil Library has nothing.
+func (l *Library) Has(episode Episode) (LibraryEntry, bool) {
+	if l == nil {
+		return LibraryEntry{}, false
+	}
+	entry, ok := l.Find(episode.ID)
+	if !ok {
+		entry, ok = l.Find(episode.URL)
+	}
+	if !ok {
+		return LibraryEntry{}, false
+	}
+	if _, err := os.Stat(entry.Path); err != nil {
+		return LibraryEntry{}, false
+	}
+	return entry, true
+}
+
+// Put records entry, replacing any previous record of the same episode.
+func (l *Library) Put(entry LibraryEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reload(); err != nil {
+		return err
+	}
+	kept := l.entries[:0]
+	for _, e := range l.entries {
+		if e.key() != entry.key() {
+			kept = append(kept, e)
+		}
+	}
+	l.entries = append(kept, entry)
+	return writeJSONFile(l.path, l.entries)
+}
+
+// Remove deletes the record named by ref (an episode ID or URL) and returns
+// it. The chapter's files are left alone.
+func (l *Library) Remove(ref string) (LibraryEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.reload(); err != nil {
+		return LibraryEntry{}, err
+	}
+	for i, e := range l.entries {
+		if e.matches(ref) {
+			l.entries = append(l.entries[:i], l.entries[i+1:]...)
+			return e, writeJSONFile(l.path, l.entries)
+		}
+	}
+	return LibraryEntry{}, fmt.Errorf("%s is not in the library", ref)
+}
+
+// finishChapter records the outcome of a chapter download: the hashes of the
+// saved pages go into the chapter's manifest, and a complete chapter is
+// added to the library (which may be nil). Pages the manifest already
+// records as saved, by an earlier download that was resumed, are kept.
+func finishChapter(lib *Library, out ChapterOutput, pages []Page, results []pageResult) error {
+	m := newManifest(out, pages)
+	if old, err := readManifest(out.Dir); err == nil && len(old.Pages) == len(m.Pages) {
+		for i, p := range old.Pages {
+			if _, err := os.Stat(filepath.Join(out.Dir, p.File)); p.SHA256 != "" && err == nil {
+				m.Pages[i] = p
+			}
+		}
+	}
+	for _, r := range results {
+		mp := &m.Pages[r.pageNum-1]
+		mp.File = r.file
+		mp.Size = r.savedBytes
+		mp.SHA256 = r.sha256
+		mp.Scramble = r.scramble.Spec.String()
+		mp.ScrambleUncertain = !r.scramble.Certain
+		mp.Original = r.original
+	}
+	if err := writeManifest(out.Dir, m); err != nil {
+		return err
+	}
+	if lib == nil || len(m.missingPages()) > 0 {
+		return nil
+	}
+	if err := lib.Put(newLibraryEntry(m, out.Dir)); err != nil {
+		return fmt.Errorf("could not record the chapter in the library: %w", err)
+	}
+	return nil
+}
+
+// AlreadyDownloadedError is returned when an episode is skipped because the
+// library already has it.
+type AlreadyDownloadedError struct {
+	Entry LibraryEntry
+}
+
+func (e *AlreadyDownloadedError) Error() string {
+	return fmt.Sprintf("already downloaded to %s on %s", e.Entry.Path, e.Entry.Downloaded.Local().Format("2006-01-02"))
+}
+
+func runLibrary(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s library list|show|remove [flags]", appName)
+	}
+	switch args[0] {
+	case "list":
+		return runLibraryList(args[1:])
+	case "show":
+		return runLibraryShow(args[1:])
+	case "remove":
+		return runLibraryRemove(args[1:])
+	default:
+		return fmt.Errorf("unknown library command %q (want list, show or remove)", args[0])
+	}
+}
+
+func runLibraryList(args []string) error {
+	flags := subcommandFlagSet("library list", "[flags]")
+	dataDir := flags.String("data-dir", defaultDataDir(), "directory the library is kept in")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	lib, err := OpenLibrary(*dataDir)
+	if err != nil {
+		return err
+	}
+	entries := lib.Entries()
+	if len(entries) == 0 {
+		pterm.Info.Println("The library is empty.")
+		return nil
+	}
+
+	rows := [][]string{{"Episode ID", "Series", "#", "Title", "Pages", "Downloaded"}}
+	for _, e := range entries {
+		number := ""
+		if e.Number > 0 {
+			number = strconv.Itoa(e.Number)
+		}
+		rows = append(rows, []string{
+			e.key(), e.SeriesTitle, number, e.Title, strconv.Itoa(e.PageCount),
+			e.Downloaded.Local().Format("2006-01-02 15:04"),
+		})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(rows).WithBoxed().Render()
+}
+
+func runLibraryShow(args []string) error {
+	flags := subcommandFlagSet("library show", "[flags] <episode-id-or-url>")
+	dataDir := flags.String("data-dir", defaultDataDir(), "directory the library is kept in")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected one episode ID or URL")
+	}
+	lib, err := OpenLibrary(*dataDir)
+	if err != nil {
+		return err
+	}
+	e, ok := lib.Find(flags.Arg(0))
+	if !ok {
+		return fmt.Errorf("%s is not in the library", flags.Arg(0))
+	}
+
+	rows := [][]string{
+		{"Property", "Value"},
+		{"Episode ID", e.EpisodeID},
+		{"Title", e.Title},
+		{"Series", strings.TrimSpace(e.SeriesTitle + " " + e.SeriesID)},
+		{"URL", e.URL},
+		{"Pages", strconv.Itoa(e.PageCount)},
+		{"Path", e.Path},
+		{"Downloaded", e.Downloaded.Local().Format(time.RFC1123)},
+	}
+	if err := pterm.DefaultTable.WithHasHeader().WithData(rows).WithBoxed().Render(); err != nil {
+		return err
+	}
+	pages := [][]string{{"File", "SHA-256"}}
+	for _, p := range e.Pages {
+		pages = append(pages, []string{p.File, p.SHA256})
+	}
+	return pterm.DefaultTable.WithHasHeader().WithData(pages).Render()
+}
+
+func runLibraryRemove(args []string) error {
+	flags := subcommandFlagSet("library remove", "[flags] <episode-id-or-url>")
+	dataDir := flags.String("data-dir", defaultDataDir(), "directory the library is kept in")
+	deleteFiles := flags.Bool("delete", false, "also delete the chapter folder from disk")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected one episode ID or URL")
+	}
+	lib, err := OpenLibrary(*dataDir)
+	if err != nil {
+		return err
+	}
+	e, err := lib.Remove(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	pterm.Success.Printfln("Removed %s from the library", seriesTitleOr(e.Title, e.URL))
+
+	if *deleteFiles {
+		if err := os.RemoveAll(e.Path); err != nil {
+			return fmt.Errorf("could not delete %s: %v", e.Path, err)
+		}
+		pterm.Success.Printfln("Deleted %s", e.Path)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLibraryPutFindRemove(t *testing.T) {
+	dataDir := t.TempDir()
+	lib, err := OpenLibrary(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := LibraryEntry{EpisodeID: "42", URL: "https://comic-days.com/episode/42", Title: "第1話", Path: t.TempDir()}
+	if err := lib.Put(entry); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+	entry.Title = "第1話 (updated)"
+	if err := lib.Put(entry); err != nil {
+		t.Fatalf("Put returned error: %v", err)
+	}
+
+	reopened, err := OpenLibrary(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(reopened.Entries()); n != 1 {
+		t.Fatalf("library has %d entries, want 1", n)
+	}
+	for _, ref := range []string{"42", "https://comic-days.com/episode/42", "comic-days.com/episode/42"} {
+		if got, ok := reopened.Find(ref); !ok || got.Title != entry.Title {
+			t.Fatalf("Find(%q) = %+v, %v", ref, got, ok)
+		}
+	}
+
+	if _, err := reopened.Remove("42"); err != nil {
+		t.Fatalf("Remove returned error: %v", err)
+	}
+	if _, ok := reopened.Find("42"); ok {
+		t.Fatal("entry still present after Remove")
+	}
+}
+
+func TestLibraryHasIgnoresDeletedFolders(t *testing.T) {
+	lib, err := OpenLibrary(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Put(LibraryEntry{EpisodeID: "1", Path: filepath.Join(t.TempDir(), "gone")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lib.Has(Episode{ID: "1"}); ok {
+		t.Fatal("Has reported an episode whose folder no longer exists")
+	}
+
+	var none *Library
+	if _, ok := none.Has(Episode{ID: "1"}); ok {
+		t.Fatal("a nil library reported an episode")
+	}
+}
+
+func TestFinishChapterRecordsOnlyCompleteChapters(t *testing.T) {
+	lib, err := OpenLibrary(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	episode := Episode{ID: "7", URL: "https://comic-days.com/episode/7"}
+	pages := []Page{NewPage("", 1, 1), NewPage("", 1, 1)}
+	first := pageResult{pageNum: 1, file: "001.png", sha256: "aa", savedBytes: 3}
+
+	if err := finishChapter(lib, ChapterOutput{Dir: outDir, Episode: episode}, pages, []pageResult{first}); err != nil {
+		t.Fatalf("finishChapter returned error: %v", err)
+	}
+	if _, ok := lib.Find("7"); ok {
+		t.Fatal("a partially downloaded chapter was added to the library")
+	}
+	m, err := readManifest(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Pages[0].SHA256 != "aa" || m.Pages[1].SHA256 != "" {
+		t.Fatalf("manifest pages = %+v", m.Pages)
+	}
+
+	second := pageResult{pageNum: 2, file: "002.png", sha256: "bb", savedBytes: 3}
+	if err := finishChapter(lib, ChapterOutput{Dir: outDir, Episode: episode}, pages, []pageResult{first, second}); err != nil {
+		t.Fatalf("finishChapter returned error: %v", err)
+	}
+	entry, ok := lib.Find("7")
+	if !ok {
+		t.Fatal("a complete chapter was not added to the library")
+	}
+	if len(entry.Pages) != 2 || entry.Pages[1].SHA256 != "bb" {
+		t.Fatalf("library pages = %+v", entry.Pages)
+	}
+}
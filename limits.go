@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+)
+
+// ImageLimits bound what a single page image may cost before it is
+// decoded, so a hostile or broken server cannot exhaust memory with a huge
+// response or a small file that decodes to an enormous picture.
+type ImageLimits struct {
+	// MaxBytes is the largest response (or file) read for one image.
+	MaxBytes int64
+	// MaxPixels is the largest width x height decoded.
+	MaxPixels int
+}
+
+var defaultImageLimits = ImageLimits{MaxBytes: 64 << 20, MaxPixels: 100_000_000}
+
+// imageLimits are the limits in force. The commands that read images set
+// them from their flags (see addImageLimitFlags) before any work starts.
+var imageLimits = defaultImageLimits
+
+// addImageLimitFlags registers the flags that override imageLimits and
+// returns a function that applies them once the flag set has been parsed.
+func addImageLimitFlags(flags *flag.FlagSet) func() error {
+	maxMB := flags.Int("max-image-mb", int(defaultImageLimits.MaxBytes>>20), "largest image download or file accepted, in MiB")
+	maxPixels := flags.Int("max-image-pixels", defaultImageLimits.MaxPixels, "largest image accepted, in pixels (width x height)")
+	return func() error {
+		if *maxMB < 1 {
+			return fmt.Errorf("-max-image-mb must be at least 1, got %d", *maxMB)
+		}
+		if *maxPixels < 1 {
+			return fmt.Errorf("-max-image-pixels must be at least 1, got %d", *maxPixels)
+		}
+		imageLimits = ImageLimits{MaxBytes: int64(*maxMB) << 20, MaxPixels: *maxPixels}
+		return nil
+	}
+}
+
+// errImageTooLarge reports an image over the byte limit. Downloading it
+// again will not make it smaller, so the error is permanent.
+func errImageTooLarge(limit int64) error {
+	return &PermanentError{Err: fmt.Errorf("image is larger than the %d MiB limit", limit>>20)}
+}
+
+// readImage reads an encoded image from r, which claims to be size bytes
+// long (-1 if unknown), without ever holding more than imageLimits.MaxBytes.
+// The image's header is decoded as soon as it arrives and check is given its
+// size, so an image that is too big is refused before the rest of it is even
+// read, let alone decoded.
+func readImage(r io.Reader, size int64, check func(width, height int) error) ([]byte, error) {
+	limit := imageLimits.MaxBytes
+	if size > limit {
+		return nil, errImageTooLarge(limit)
+	}
+	limited := io.LimitReader(r, limit+1)
+	var buf bytes.Buffer
+	if size > 0 {
+		buf.Grow(int(size))
+	}
+	cfg, _, err := image.DecodeConfig(io.TeeReader(limited, &buf))
+	if err != nil {
+		if int64(buf.Len()) > limit {
+			return nil, errImageTooLarge(limit)
+		}
+		return nil, fmt.Errorf("not a readable image: %v", err)
+	}
+	if err := check(cfg.Width, cfg.Height); err != nil {
+		return nil, err
+	}
+	if _, err := buf.ReadFrom(limited); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > limit {
+		return nil, errImageTooLarge(limit)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+)
+
+// pngHeader returns the signature and IHDR chunk of a PNG claiming to be
+// width x height, which is all image.DecodeConfig needs to see.
+func pngHeader(width, height int) []byte {
+	var ihdr bytes.Buffer
+	ihdr.WriteString("IHDR")
+	binary.Write(&ihdr, binary.BigEndian, uint32(width))
+	binary.Write(&ihdr, binary.BigEndian, uint32(height))
+	ihdr.Write([]byte{8, 0, 0, 0, 0}) // 8-bit grayscale
+	var out bytes.Buffer
+	out.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&out, binary.BigEndian, uint32(ihdr.Len()-4))
+	out.Write(ihdr.Bytes())
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(ihdr.Bytes()))
+	return out.Bytes()
+}
+
+// endlessReader yields zeros forever and counts how many it gave out.
+type endlessReader struct{ n int64 }
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	clear(p)
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+func withImageLimits(t *testing.T, limits ImageLimits) {
+	t.Helper()
+	saved := imageLimits
+	imageLimits = limits
+	t.Cleanup(func() { imageLimits = saved })
+}
+
+func TestReadImageRefusesHugePicturesFromTheHeader(t *testing.T) {
+	rest := &endlessReader{}
+	bomb := io.MultiReader(bytes.NewReader(pngHeader(200_000, 200_000)), rest)
+	_, err := readImage(bomb, -1, validatePageDimensions)
+	if err == nil || !strings.Contains(err.Error(), "pixel safety limit") {
+		t.Fatalf("err = %v, want the pixel limit", err)
+	}
+	if rest.n > 64<<10 {
+		t.Fatalf("read %d bytes past the header before refusing", rest.n)
+	}
+}
+
+func TestReadImageCapsTheBytesRead(t *testing.T) {
+	withImageLimits(t, ImageLimits{MaxBytes: 1 << 20, MaxPixels: defaultImageLimits.MaxPixels})
+	accept := func(int, int) error { return nil }
+
+	// A declared length over the limit is refused without reading.
+	if _, err := readImage(&endlessReader{}, 2<<20, accept); !IsPermanent(err) {
+		t.Fatalf("declared size: err = %v, want a permanent error", err)
+	}
+
+	// A body that just keeps going is cut off at the limit.
+	rest := &endlessReader{}
+	_, err := readImage(io.MultiReader(bytes.NewReader(pngHeader(10, 10)), rest), -1, accept)
+	if !IsPermanent(err) {
+		t.Fatalf("endless body: err = %v, want a permanent error", err)
+	}
+	if rest.n > 2<<20 {
+		t.Fatalf("read %d bytes of an endless body", rest.n)
+	}
+
+	data := testPNG(t, 8, 8)
+	got, err := readImage(bytes.NewReader(data), int64(len(data)), accept)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("readImage = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestReadImageReportsTheCheckError(t *testing.T) {
+	want := errors.New("wrong size")
+	_, err := readImage(bytes.NewReader(testPNG(t, 8, 8)), -1, func(int, int) error { return want })
+	if !errors.Is(err, want) {
+		t.Fatalf("err = %v, want %v", err, want)
+	}
+}
+
+func TestAddImageLimitFlags(t *testing.T) {
+	withImageLimits(t, defaultImageLimits)
+	flags := subcommandFlagSet("test", "")
+	apply := addImageLimitFlags(flags)
+	if err := flags.Parse([]string{"-max-image-mb", "8", "-max-image-pixels", "1000"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(); err != nil {
+		t.Fatal(err)
+	}
+	if imageLimits != (ImageLimits{MaxBytes: 8 << 20, MaxPixels: 1000}) {
+		t.Fatalf("imageLimits = %+v", imageLimits)
+	}
+	if err := validatePageDimensions(40, 40); err == nil {
+		t.Fatal("a 1600 pixel image passed a 1000 pixel limit")
+	}
+
+	flags = subcommandFlagSet("test", "")
+	apply = addImageLimitFlags(flags)
+	if err := flags.Parse([]string{"-max-image-mb", "0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(); err == nil {
+		t.Fatal("-max-image-mb 0 was accepted")
+	}
+}
@@ -1,18 +1,138 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pterm/pterm"
+)
 
 func main() {
-	if err := run(); err != nil {
+	err := run(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
 		fatal(err)
 	}
 }
 
-func run() error {
+// run dispatches to a subcommand (see commands.go) when the first argument
+// names one, and otherwise downloads a single chapter.
+func run(args []string) error {
+	if len(args) > 0 {
+		if cmd := findCommand(args[0]); cmd != nil {
+			return cmd.Run(args[1:])
+		}
+	}
+	return runDownload(args)
+}
+
+func runDownload(args []string) error {
+	flags := newFlagSet(appName, "[flags] [chapter-url]")
+	cookieFile := flags.String("cookies", "cookie.json", "cookie file exported from the browser")
+	outRoot := flags.String("out", ".", "directory the chapter folder is created in")
+	template := flags.String("output-template", "", "lay out chapter folders and page names, e.g. {series}/{number:03} - {title}/{page:03}.{ext}")
+	imageFormatFlag := addImageFormatFlags(flags)
+	applyImageLimits := addImageLimitFlags(flags)
+	keepOriginal := addKeepOriginalFlag(flags)
+	scramble := flags.String("scramble", "", "override how pages are scrambled: none, transpose, or COLSxROWS/MULTIPLE[:PERMUTATION]")
+	dataDir := flags.String("data-dir", defaultDataDir(), "directory the library of downloaded episodes is kept in")
+	openCache := addCacheFlags(flags)
+	openProxies := addProxyFlags(flags)
+	transportOptions := addTransportFlags(flags)
+	applyRateLimit := addRateLimitFlags(flags)
+	openBreaker := addBreakerFlags(flags)
+	openFixtures := addFixtureFlags(flags)
+	force := flags.Bool("force", false, "download the chapter even if the library already has it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("expected at most one chapter URL, got %d", flags.NArg())
+	}
+
+	tmpl, err := parseTemplateFlag(*template)
+	if err != nil {
+		return err
+	}
+	imageFormat, err := imageFormatFlag()
+	if err != nil {
+		return err
+	}
+	if err := applyImageLimits(); err != nil {
+		return err
+	}
+	var scrambleSpec *ScrambleSpec
+	if *scramble != "" {
+		spec, err := ParseScrambleSpec(*scramble)
+		if err != nil {
+			return err
+		}
+		scrambleSpec = &spec
+	}
+	lib, err := OpenLibrary(*dataDir)
+	if err != nil {
+		return err
+	}
+	cache, err := openCache()
+	if err != nil {
+		return err
+	}
+	fixtures, err := openFixtures()
+	if err != nil {
+		return err
+	}
+	proxies, err := openProxies(*dataDir)
+	if err != nil {
+		return err
+	}
+	transport, err := transportOptions()
+	if err != nil {
+		return err
+	}
+	if err := applyRateLimit(); err != nil {
+		return err
+	}
+	breaker, err := openBreaker()
+	if err != nil {
+		return err
+	}
+	if breaker != nil {
+		breaker.OnChange = printBreakerEvent
+	}
+	if fixtures != nil {
+		// A recording must see every request, and a replay must not be
+		// answered from what earlier runs cached.
+		cache = nil
+	}
+
 	printBanner()
 
 	printStage(1, "Initialization", "Reading cookies, asking for a chapter URL and fetching + parsing its page data.")
-	session, err := NewComicSession("cookie.json")
+	session, err := NewComicSession(SessionOptions{
+		CookieFile:    *cookieFile,
+		URL:           flags.Arg(0),
+		OutRoot:       *outRoot,
+		Template:      tmpl,
+		Format:        imageFormat,
+		KeepOriginals: *keepOriginal,
+		Scramble:      scrambleSpec,
+		Cache:         cache,
+		Fixtures:      fixtures,
+		Proxies:       proxies,
+		Transport:     transport,
+		Breaker:       breaker,
+		Library:       lib,
+		Force:         *force,
+	})
+	var already *AlreadyDownloadedError
+	if errors.As(err, &already) {
+		pterm.Info.Printfln("📚 This episode is %v — use -force to download it again.", already)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
@@ -22,20 +142,20 @@ func run() error {
 		return fmt.Errorf("no pages were found for this chapter — it may be unavailable or require a valid cookie")
 	}
 
-	printDeobfuscationLegend()
+	printDeobfuscationLegend(session.Pages[0].scrambleSpec())
 
 	pl := StartPipeline(len(session.Pages))
-	for i, page := range session.Pages {
-		pageNum := i + 1
-		// Process already reports success/failure for this page through pl,
-		// so the returned error only decides the exit code of the loop body,
-		// not whether anything more needs to be printed here.
-		_ = page.Process(session.NetworkClient, session.Cookies, session.OutDir, pageNum, pl)
+	results, _ := downloadPages(session.Pages, session.NetworkClient, session.Cookies, session.Output, pl)
+	stats := pl.Finish(session.Output.Dir)
+	if err := finishChapter(lib, session.Output, session.Pages, results); err != nil {
+		pterm.Warning.Println(err)
 	}
-	stats := pl.Finish(session.OutDir)
 
 	printStage(3, "Summary", "Here's how the run went.")
 	printFinalSummary(stats)
+	if err := breaker.Err(); err != nil {
+		return err
+	}
 	if stats.Failed > 0 {
 		return fmt.Errorf("%d page(s) failed", stats.Failed)
 	}
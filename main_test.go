@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/disintegration/imaging"
+)
+
+func TestMain(m *testing.M) {
+	// See animateSpinners: the animation would make -race fail every test
+	// that runs a spinner.
+	animateSpinners = false
+	os.Exit(m.Run())
+}
+
+// runAgainst runs the program with args plus the flags that keep it inside
+// the test's folders out and data.
+func runAgainst(t *testing.T, out, data string, args ...string) error {
+	t.Helper()
+	base := []string{"-out", out, "-data-dir", data, "-no-cache"}
+	if !strings.Contains(strings.Join(args, " "), "-cookies") {
+		base = append(base, "-cookies", filepath.Join(data, "no-cookies.json"))
+	}
+	return run(append(base, args...))
+}
+
+// readChapter returns the manifest and pages of the only chapter in out.
+func readChapter(t *testing.T, out string) (Manifest, []*image.RGBA) {
+	t.Helper()
+	dirs, err := findChapterDirs(out)
+	if err != nil || len(dirs) != 1 {
+		t.Fatalf("found chapters %v, %v; want exactly one", dirs, err)
+	}
+	m, err := readManifest(dirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pages []*image.RGBA
+	for _, p := range m.Pages {
+		img, err := imaging.Open(filepath.Join(dirs[0], p.File))
+		if err != nil {
+			t.Fatalf("page %s: %v", p.File, err)
+		}
+		rgba := image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		pages = append(pages, rgba)
+	}
+	return m, pages
+}
+
+func TestRunDownloadsAChapterFromTheFakeSite(t *testing.T) {
+	episode := &fakeEpisode{ID: "1001", Title: "First Flight", Series: "Fake Series", Number: 1, Pages: []fakePage{
+		{Width: 160, Height: 240, Faults: []fakeFault{faultTooManyRequests, faultTooManyRequests}},
+		{Width: 160, Height: 240, Faults: []fakeFault{faultTruncated}},
+		{Width: 150, Height: 230, Faults: []fakeFault{faultSlow, faultServerError}},
+	}}
+	site := newFakeSite(t, episode)
+	out, data := t.TempDir(), t.TempDir()
+
+	if err := runAgainst(t, out, data, site.EpisodeURL("1001")); err != nil {
+		t.Fatalf("run returned error: %v", err)
+	}
+
+	m, pages := readChapter(t, out)
+	if m.Episode.Title != "First Flight" || m.Episode.SeriesTitle != "Fake Series" || len(pages) != 3 {
+		t.Fatalf("manifest = %+v with %d pages", m.Episode, len(pages))
+	}
+	for i, p := range episode.Pages {
+		assertSameImage(t, m.Pages[i].File, pages[i], fakePicture(p, i+1))
+		if m.Pages[i].SHA256 == "" {
+			t.Errorf("page %d has no hash in the manifest", i+1)
+		}
+	}
+	if n := site.Requests("/images/1001/1"); n != 3 {
+		t.Errorf("page 1 requested %d times, want 3 (two 429s)", n)
+	}
+	if n := site.Requests("/images/1001/2"); n != 2 {
+		t.Errorf("page 2 requested %d times, want 2 (one truncated)", n)
+	}
+
+	lib, err := OpenLibrary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := lib.Has(m.Episode); !ok {
+		t.Fatal("the chapter was not recorded in the library")
+	}
+
+	// A second run finds the episode in the library and downloads nothing.
+	if err := runAgainst(t, out, data, site.EpisodeURL("1001")); err != nil {
+		t.Fatalf("second run returned error: %v", err)
+	}
+	if n := site.Requests("/images/1001/3"); n != 1 {
+		t.Errorf("page 3 requested %d times after the second run, want 1", n)
+	}
+}
+
+func TestRunNeedsCookiesForPaidEpisodes(t *testing.T) {
+	episode := &fakeEpisode{ID: "2002", Title: "Paid", Series: "Fake Series", Number: 2, Cookie: "paid-up", Pages: []fakePage{
+		{Width: 96, Height: 128},
+		{Width: 96, Height: 128},
+	}}
+	site := newFakeSite(t, episode)
+	out, data := t.TempDir(), t.TempDir()
+
+	err := runAgainst(t, out, data, site.EpisodeURL("2002"))
+	if err == nil || !strings.Contains(err.Error(), "2 page(s) failed") {
+		t.Fatalf("run without cookies: err = %v, want 2 failed pages", err)
+	}
+	// 403 is permanent: every page is asked for exactly once.
+	if n := site.Requests("/images/2002/1"); n != 1 {
+		t.Fatalf("page 1 requested %d times, want 1", n)
+	}
+
+	cookies := filepath.Join(data, "cookie.json")
+	writeBytes(t, cookies, []byte(`[{"domain": "127.0.0.1", "name": "glsc", "value": "paid-up"}]`))
+	out = t.TempDir()
+	if err := runAgainst(t, out, data, "-cookies", cookies, site.EpisodeURL("2002")); err != nil {
+		t.Fatalf("run with cookies returned error: %v", err)
+	}
+	_, pages := readChapter(t, out)
+	for i, p := range episode.Pages {
+		assertSameImage(t, "paid page", pages[i], fakePicture(p, i+1))
+	}
+}
+
+func TestRunGivesUpOnAPageThatKeepsFailing(t *testing.T) {
+	broken := make([]fakeFault, maxRetries*maxPageDownloadAttempts)
+	for i := range broken {
+		broken[i] = faultServerError
+	}
+	episode := &fakeEpisode{ID: "3003", Title: "Flaky", Series: "Fake Series", Pages: []fakePage{
+		{Width: 96, Height: 128},
+		{Width: 96, Height: 128, Faults: broken},
+	}}
+	site := newFakeSite(t, episode)
+	out, data := t.TempDir(), t.TempDir()
+
+	err := runAgainst(t, out, data, site.EpisodeURL("3003"))
+	if err == nil || !strings.Contains(err.Error(), "1 page(s) failed") {
+		t.Fatalf("err = %v, want 1 failed page", err)
+	}
+	if n := site.Requests("/images/3003/2"); n != len(broken) {
+		t.Fatalf("page 2 requested %d times, want %d", n, len(broken))
+	}
+	// The chapter is incomplete, so it must not be in the library.
+	lib, err := OpenLibrary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lib.Entries()) != 0 {
+		t.Fatal("an incomplete chapter was recorded in the library")
+	}
+}
+
+func TestRunStopsWhenTheSiteGoesDown(t *testing.T) {
+	down := make([]fakeFault, maxRetries*maxPageDownloadAttempts)
+	for i := range down {
+		down[i] = faultServerError
+	}
+	episode := &fakeEpisode{ID: "3004", Title: "Outage", Series: "Fake Series", Pages: []fakePage{
+		{Width: 96, Height: 128},
+		{Width: 96, Height: 128, Faults: down},
+		{Width: 96, Height: 128},
+	}}
+	site := newFakeSite(t, episode)
+	out, data := t.TempDir(), t.TempDir()
+
+	err := runAgainst(t, out, data, "-breaker-failures", "4", "-breaker-cooldown", "10ms", site.EpisodeURL("3004"))
+	if !errors.Is(err, ErrSiteDown) {
+		t.Fatalf("err = %v, want the site to be reported down", err)
+	}
+	// Four failures open the breaker, the probe fails too, and the page
+	// after it is not even tried.
+	if n := site.Requests("/images/3004/2"); n != 5 {
+		t.Fatalf("page 2 requested %d times, want 5", n)
+	}
+	if n := site.Requests("/images/3004/3"); n != 0 {
+		t.Fatalf("page 3 requested %d times after the site went down", n)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+)
+
+// manifestFile is written into every chapter folder to describe what it
+// contains.
+const manifestFile = "manifest.json"
+
+// Manifest records which episode a chapter folder holds and the pages it is
+// expected to contain.
+type Manifest struct {
+	Episode    Episode        `json:"episode"`
+	Downloaded time.Time      `json:"downloaded"`
+	Pages      []ManifestPage `json:"pages"`
+}
+
+// ManifestPage describes one page file of a chapter folder.
+type ManifestPage struct {
+	File   string `json:"file"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// Size and SHA256 describe the saved file; both are empty until the page
+	// has been downloaded.
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	// Scramble is the scrambling the page was found to have and restored
+	// from; ScrambleUncertain is set when detectScramble could not tell.
+	Scramble          string `json:"scramble,omitempty"`
+	ScrambleUncertain bool   `json:"scrambleUncertain,omitempty"`
+	// Original describes the image as the server sent it, when a copy was
+	// kept (see -keep-original).
+	Original *ManifestOriginal `json:"original,omitempty"`
+}
+
+// ManifestOriginal describes the server's image kept next to a page file.
+type ManifestOriginal struct {
+	File        string `json:"file"`
+	ContentType string `json:"contentType,omitempty"`
+	ETag        string `json:"etag,omitempty"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+func newManifest(out ChapterOutput, pages []Page) Manifest {
+	m := Manifest{Episode: out.Episode, Downloaded: time.Now().UTC()}
+	for i, p := range pages {
+		m.Pages = append(m.Pages, ManifestPage{
+			File:   out.PageFile(i + 1),
+			Width:  p.Width,
+			Height: p.Height,
+		})
+	}
+	return m
+}
+
+// missingPages returns the numbers (1-based) of the pages the manifest does
+// not record as saved.
+func (m Manifest) missingPages() []int {
+	var missing []int
+	for i, p := range m.Pages {
+		if p.SHA256 == "" {
+			missing = append(missing, i+1)
+		}
+	}
+	return missing
+}
+
+// DisplayTitle is the most descriptive title available for the chapter.
+func (m Manifest) DisplayTitle() string {
+	switch {
+	case m.Episode.SeriesTitle != "" && m.Episode.Title != "":
+		return m.Episode.SeriesTitle + " — " + m.Episode.Title
+	case m.Episode.Title != "":
+		return m.Episode.Title
+	default:
+		return m.Episode.SeriesTitle
+	}
+}
+
+// writeManifest stores m in dir, replacing any previous manifest atomically.
+func writeManifest(dir string, m Manifest) error {
+	return writeJSONFile(filepath.Join(dir, manifestFile), m)
+}
+
+// readManifest loads the manifest of the chapter folder dir.
+func readManifest(dir string) (Manifest, error) {
+	var m Manifest
+	err := readJSONFile(filepath.Join(dir, manifestFile), &m)
+	return m, err
+}
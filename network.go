@@ -5,21 +5,28 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const (
 	maxRetries = 5
-	baseDelay  = 1 * time.Second
+	// maxRetryAfter is how long a request waits in all because of
+	// Retry-After headers. A server that asks for longer than is left gets
+	// the request abandoned rather than waited for.
+	maxRetryAfter = time.Minute
 )
 
+// baseDelay is the first backoff delay; each further retry doubles it. It
+// is a variable so tests against the fake site do not have to wait.
+var baseDelay = 1 * time.Second
+
 // RetryObserver is notified before FetchWithRetries sleeps and retries a
 // request, so callers can surface progress in their own UI (a spinner, a log
-// line, ...) instead of the network layer printing directly. It is also
-// called, with delay 0, when a client-side timeout forces an immediate,
-// non-retrying failure. A nil observer simply disables notifications.
+// line, ...) instead of the network layer printing directly. A nil observer
+// simply disables notifications.
 type RetryObserver func(attempt, maxAttempts int, err error, delay time.Duration)
 
 type HTTPFetcher interface {
@@ -44,21 +51,68 @@ func IsPermanent(err error) bool {
 
 type NetworkClient struct {
 	client *http.Client
+	// transport is the client's own connection to the network, beneath any
+	// cache or fixtures.
+	transport    *http.Transport
+	stallTimeout time.Duration
+	breaker      *CircuitBreaker
 }
 
-func NewNetworkClient(timeout time.Duration) *NetworkClient {
+// NewNetworkClient returns a client that connects as opts describes. It has
+// no overall deadline: each step of a request has its own timeout instead.
+func NewNetworkClient(opts TransportOptions) *NetworkClient {
+	transport := newTransport(opts)
 	return &NetworkClient{
-		client: &http.Client{
-			Timeout: timeout,
-		},
+		client:       &http.Client{Transport: transport},
+		transport:    transport,
+		stallTimeout: opts.StallTimeout,
+	}
+}
+
+// UseProxies sends the client's requests through the proxies p chooses. A
+// nil p leaves the client using the proxy environment variables.
+func (nc *NetworkClient) UseProxies(p *Proxies) *NetworkClient {
+	if p != nil {
+		nc.transport.Proxy = p.Proxy
+	}
+	return nc
+}
+
+// UseCache makes the client answer from cache where it can (see
+// HTTPCache). A nil cache leaves the client as it is.
+func (nc *NetworkClient) UseCache(cache *HTTPCache) *NetworkClient {
+	if cache != nil {
+		nc.client.Transport = cache.Transport(nc.client.Transport)
+	}
+	return nc
+}
+
+// UseFixtures records the client's requests into fixtures, or replays them
+// (see HTTPFixtures). Nil fixtures leave the client as it is.
+func (nc *NetworkClient) UseFixtures(fixtures *HTTPFixtures) *NetworkClient {
+	if fixtures != nil {
+		nc.client.Transport = fixtures.Transport(nc.client.Transport)
+	}
+	return nc
+}
+
+// UseCircuitBreaker makes every request of the client go through b (see
+// CircuitBreaker). A nil b leaves the client as it is.
+func (nc *NetworkClient) UseCircuitBreaker(b *CircuitBreaker) *NetworkClient {
+	if b != nil {
+		nc.breaker = b
 	}
+	return nc
 }
 
-// FetchWithRetries performs the request, retrying transient failures with
-// exponential backoff. A successful call returns a response with a 2xx status
-// whose Body the caller must close. Persistent 4xx responses (except 429) are
-// returned as a *PermanentError so callers can stop retrying. onRetry may be
-// nil.
+// FetchWithRetries performs the request, retrying transient failures,
+// timeouts included, with exponential backoff. A successful call returns a
+// response with a 2xx status whose Body the caller must close; reading the
+// body fails if it stalls for longer than the client's stall timeout.
+// Persistent 4xx responses (except 429) are returned as a *PermanentError so
+// callers can stop retrying. A Retry-After header replaces the backoff
+// delay, but never makes the request wait more than maxRetryAfter in all.
+// onRetry may be nil.
 func (nc *NetworkClient) FetchWithRetries(req *http.Request, onRetry RetryObserver) (*http.Response, error) {
 	if req == nil {
 		return nil, &PermanentError{Err: fmt.Errorf("request is nil")}
@@ -68,46 +122,78 @@ func (nc *NetworkClient) FetchWithRetries(req *http.Request, onRetry RetryObserv
 	}
 
 	var lastErr error
+	var waited time.Duration // for Retry-After
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
-		attemptReq := req.Clone(req.Context())
+		probe, err := nc.breaker.acquire(req.Context())
+		if err != nil {
+			if errors.Is(err, ErrSiteDown) {
+				return nil, &PermanentError{Err: err}
+			}
+			return nil, err
+		}
+
+		// The attempt's context outlives this call: the stall watchdog
+		// cancels it when the body stops arriving.
+		ctx, cancel := context.WithCancel(req.Context())
+		attemptReq := req.Clone(ctx)
 		if req.GetBody != nil {
 			body, err := req.GetBody()
 			if err != nil {
+				cancel()
+				nc.breaker.abandon(probe)
 				return nil, &PermanentError{Err: fmt.Errorf("could not replay request body: %w", err)}
 			}
 			attemptReq.Body = body
 		}
 
 		resp, err := nc.client.Do(attemptReq)
+		delay := baseDelay * time.Duration(1<<attempt)
 		switch {
 		case err != nil:
-			if isTimeout(err) {
-				// The overall client timeout elapsed. Retrying within the same
-				// short-lived client is unlikely to help, so fail fast and let
-				// the higher level decide whether to try again.
-				if onRetry != nil {
-					onRetry(attempt+1, maxRetries, err, 0)
-				}
+			cancel()
+			if IsPermanent(err) || req.Context().Err() != nil {
+				// Either the transport itself knows retrying is pointless
+				// (a replayed run missing a recording, for example) or the
+				// caller gave up. Neither says anything about the site.
+				nc.breaker.abandon(probe)
 				return nil, err
 			}
 			lastErr = err
+			nc.breaker.record(probe, err)
 		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			nc.breaker.record(probe, nil)
+			if nc.stallTimeout > 0 {
+				resp.Body = watchStalls(resp.Body, nc.stallTimeout, cancel)
+			} else {
+				resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+			}
 			return resp, nil
 		default:
 			// Non-2xx response: drain and close the body so the connection can
 			// be reused, then classify the status code.
 			io.Copy(io.Discard, resp.Body)
 			resp.Body.Close()
+			cancel()
 			status := resp.StatusCode
 			lastErr = fmt.Errorf("server returned HTTP %d %s", status, http.StatusText(status))
 			if status >= 400 && status < 500 && status != http.StatusTooManyRequests {
+				// The site is up; it just refuses this request.
+				nc.breaker.record(probe, nil)
 				return nil, &PermanentError{Err: lastErr}
 			}
+			nc.breaker.record(probe, lastErr)
+			// A server that is shedding load says when to come back.
+			if wait, ok := retryAfter(resp.Header, time.Now()); ok {
+				if waited+wait > maxRetryAfter {
+					return nil, &PermanentError{Err: fmt.Errorf("%w: asked to retry in %v, longer than %v", lastErr, wait.Round(time.Second), maxRetryAfter-waited)}
+				}
+				waited += wait
+				delay = wait
+			}
 		}
 
 		if attempt < maxRetries-1 {
-			delay := baseDelay * time.Duration(1<<attempt)
 			if onRetry != nil {
 				onRetry(attempt+1, maxRetries, lastErr, delay)
 			}
@@ -122,15 +208,37 @@ func (nc *NetworkClient) FetchWithRetries(req *http.Request, onRetry RetryObserv
 	return nil, err
 }
 
-// isTimeout reports whether err was caused by a timeout, covering both the
-// http.Client.Timeout deadline and lower level network timeouts.
-func isTimeout(err error) bool {
-	if errors.Is(err, context.DeadlineExceeded) {
-		return true
+// retryAfter parses the Retry-After header of h, in either of its forms
+// (seconds, or an HTTP date).
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0, false
 	}
-	var netErr net.Error
-	if errors.As(err, &netErr) {
-		return netErr.Timeout()
+	var wait time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		// Capped only so that the Duration cannot overflow.
+		wait = time.Duration(min(secs, 1<<31)) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		wait = max(t.Sub(now), 0)
+	} else {
+		return 0, false
 	}
-	return false
+	return wait, true
+}
+
+// cancelOnClose releases a response's request context when its body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -20,7 +23,7 @@ func TestFetchWithRetriesDoesNotRetryPermanent4xx(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	client := NewNetworkClient(time.Second)
+	client := NewNetworkClient(defaultTransportOptions)
 	resp, err := client.FetchWithRetries(req, nil)
 	if resp != nil {
 		t.Fatalf("response = %#v, want nil", resp)
@@ -35,3 +38,169 @@ func TestFetchWithRetriesDoesNotRetryPermanent4xx(t *testing.T) {
 		t.Fatalf("server calls = %d, want 1", calls)
 	}
 }
+
+func TestFetchWithRetriesGivesUpOnLongRetryAfter(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "come back later", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	start := time.Now()
+	_, err := NewNetworkClient(defaultTransportOptions).FetchWithRetries(req, nil)
+	if !IsPermanent(err) || !strings.Contains(err.Error(), "retry in 1h0m0s") {
+		t.Fatalf("err = %v, want a permanent error naming the wait", err)
+	}
+	if calls.Load() != 1 || time.Since(start) > 10*time.Second {
+		t.Fatalf("%d calls in %v, want 1 and no waiting", calls.Load(), time.Since(start))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"86400", 24 * time.Hour, true},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.value != "" {
+			h.Set("Retry-After", tt.value)
+		}
+		got, ok := retryAfter(h, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// testTransport returns transport options with short timeouts for tests.
+func testTransport() TransportOptions {
+	opts := defaultTransportOptions
+	opts.HeaderTimeout = 100 * time.Millisecond
+	opts.StallTimeout = 100 * time.Millisecond
+	return opts
+}
+
+func TestSlowButSteadyDownloadsDoNotTimeOut(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Far longer than the stall timeout in all, but never silent for long.
+		for i := 0; i < 10; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := NewNetworkClient(testTransport()).FetchWithRetries(req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || len(body) != 50 {
+		t.Fatalf("read %d bytes, %v", len(body), err)
+	}
+}
+
+func TestStalledDownloadsAreAbandoned(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("half an image"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	t.Cleanup(server.Close)
+	defer close(release)
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := NewNetworkClient(testTransport()).FetchWithRetries(req, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	start := time.Now()
+	_, err = io.ReadAll(resp.Body)
+	if err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Fatalf("reading a stalled body returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("the stall was noticed after %v", elapsed)
+	}
+}
+
+func TestFetchWithRetriesRetriesTimeouts(t *testing.T) {
+	old := baseDelay
+	baseDelay = time.Millisecond
+	t.Cleanup(func() { baseDelay = old })
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			// Answer too late for the response header timeout.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(server.Close)
+
+	retries := 0
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	resp, err := NewNetworkClient(testTransport()).FetchWithRetries(req, func(attempt, maxAttempts int, err error, delay time.Duration) {
+		retries++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 2 || retries != 1 {
+		t.Fatalf("%d calls and %d retries, want 2 and 1", calls.Load(), retries)
+	}
+}
+
+func TestHTTPVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	for version, want := range map[string]int{"auto": 2, "1.1": 1, "2": 2} {
+		opts := defaultTransportOptions
+		opts.HTTPVersion = version
+		client := NewNetworkClient(opts)
+		client.transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := client.FetchWithRetries(req, nil)
+		if err != nil {
+			t.Fatalf("-http %s: %v", version, err)
+		}
+		resp.Body.Close()
+		if resp.ProtoMajor != want {
+			t.Errorf("-http %s used %s, want HTTP/%d", version, resp.Proto, want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+// The OPDS catalog exposes the chapters under the output root as an OPDS 1.2
+// (Atom) feed so reader apps such as Panels, Chunky or KOReader can browse
+// and download them: a navigation feed of series, an acquisition feed of
+// chapters per series with CBZ downloads, and OPDS-PSE page streaming links
+// so pages can be read without downloading the whole chapter first.
+const (
+	opdsNavigationType  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	cbzType             = "application/vnd.comicbook+zip"
+
+	opdsAcquisitionRel = "http://opds-spec.org/acquisition"
+	opdsImageRel       = "http://opds-spec.org/image"
+	opdsThumbnailRel   = "http://opds-spec.org/image/thumbnail"
+	pseStreamRel       = "http://vaemendis.net/opds-pse/stream"
+
+	unsortedSeriesKey = "unsorted"
+)
+
+type atomFeed struct {
+	XMLName   xml.Name    `xml:"feed"`
+	Xmlns     string      `xml:"xmlns,attr"`
+	XmlnsOPDS string      `xml:"xmlns:opds,attr"`
+	XmlnsPSE  string      `xml:"xmlns:pse,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Links     []atomLink  `xml:"link"`
+	Entries   []atomEntry `xml:"entry"`
+}
+
+type atomEntry struct {
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Content *atomContent `xml:"content,omitempty"`
+	Links   []atomLink   `xml:"link"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomLink struct {
+	Rel      string `xml:"rel,attr,omitempty"`
+	Href     string `xml:"href,attr"`
+	Type     string `xml:"type,attr,omitempty"`
+	PSECount int    `xml:"pse:count,attr,omitempty"`
+}
+
+func newAtomFeed(id, title string, updated time.Time, self, selfType string) *atomFeed {
+	return &atomFeed{
+		Xmlns:     "http://www.w3.org/2005/Atom",
+		XmlnsOPDS: "http://opds-spec.org/2010/catalog",
+		XmlnsPSE:  "http://vaemendis.net/opds-pse/ns",
+		ID:        id,
+		Title:     title,
+		Updated:   atomTime(updated),
+		Links: []atomLink{
+			{Rel: "self", Href: self, Type: selfType},
+			{Rel: "start", Href: "/opds", Type: opdsNavigationType},
+		},
+	}
+}
+
+func atomTime(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// seriesGroup is the set of local chapters belonging to one series.
+type seriesGroup struct {
+	Key      string
+	Title    string
+	Chapters []LocalChapter
+	Updated  time.Time
+}
+
+// seriesKey identifies the series a chapter belongs to, preferring the
+// site's series ID and falling back to its title. Chapters without any
+// series metadata share the "unsorted" group.
+func seriesKey(c LocalChapter) (key, title string) {
+	if c.Manifest == nil {
+		return unsortedSeriesKey, "Unsorted"
+	}
+	e := c.Manifest.Episode
+	switch {
+	case e.SeriesID != "":
+		return e.SeriesID, seriesTitleOr(e.SeriesTitle, e.SeriesID)
+	case e.SeriesTitle != "":
+		sum := sha256.Sum256([]byte(e.SeriesTitle))
+		return "t" + hex.EncodeToString(sum[:8]), e.SeriesTitle
+	default:
+		return unsortedSeriesKey, "Unsorted"
+	}
+}
+
+func seriesTitleOr(title, fallback string) string {
+	if title != "" {
+		return title
+	}
+	return fallback
+}
+
+// groupBySeries groups chapters by series, sorting series by title and the
+// chapters of each series by episode number.
+func groupBySeries(chapters []LocalChapter) []seriesGroup {
+	index := map[string]int{}
+	var groups []seriesGroup
+	for _, c := range chapters {
+		key, title := seriesKey(c)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, seriesGroup{Key: key, Title: title})
+		}
+		groups[i].Chapters = append(groups[i].Chapters, c)
+		if c.ModTime.After(groups[i].Updated) {
+			groups[i].Updated = c.ModTime
+		}
+	}
+
+	for _, g := range groups {
+		sort.SliceStable(g.Chapters, func(i, j int) bool {
+			return episodeNumber(g.Chapters[i]) < episodeNumber(g.Chapters[j])
+		})
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		// Keep the catch-all group last.
+		if (groups[i].Key == unsortedSeriesKey) != (groups[j].Key == unsortedSeriesKey) {
+			return groups[j].Key == unsortedSeriesKey
+		}
+		return groups[i].Title < groups[j].Title
+	})
+	return groups
+}
+
+func episodeNumber(c LocalChapter) int {
+	if c.Manifest == nil {
+		return 0
+	}
+	return c.Manifest.Episode.Number
+}
+
+func (s *server) handleOPDSRoot(w http.ResponseWriter, r *http.Request) {
+	chapters, err := scanChapters(s.root)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	groups := groupBySeries(chapters)
+
+	var updated time.Time
+	for _, g := range groups {
+		if g.Updated.After(updated) {
+			updated = g.Updated
+		}
+	}
+	feed := newAtomFeed("urn:comicdays:root", "Comic Days library", updated, "/opds", opdsNavigationType)
+	for _, g := range groups {
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:      "urn:comicdays:series:" + g.Key,
+			Title:   g.Title,
+			Updated: atomTime(g.Updated),
+			Content: &atomContent{Type: "text", Text: fmt.Sprintf("%d chapter(s)", len(g.Chapters))},
+			Links: []atomLink{
+				{Rel: "subsection", Href: "/opds/series/" + g.Key, Type: opdsAcquisitionType},
+			},
+		})
+	}
+	writeAtom(w, opdsNavigationType, feed)
+}
+
+func (s *server) handleOPDSSeries(w http.ResponseWriter, r *http.Request) {
+	chapters, err := scanChapters(s.root)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	key := r.PathValue("key")
+	for _, g := range groupBySeries(chapters) {
+		if g.Key != key {
+			continue
+		}
+		self := "/opds/series/" + g.Key
+		feed := newAtomFeed("urn:comicdays:series:"+g.Key, g.Title, g.Updated, self, opdsAcquisitionType)
+		feed.Links = append(feed.Links, atomLink{Rel: "up", Href: "/opds", Type: opdsNavigationType})
+		for _, c := range g.Chapters {
+			feed.Entries = append(feed.Entries, chapterEntry(c))
+		}
+		writeAtom(w, opdsAcquisitionType, feed)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// chapterEntry describes one chapter with its cover, CBZ download and
+// OPDS-PSE streaming links.
+func chapterEntry(c LocalChapter) atomEntry {
+	title := c.Title()
+	if c.Manifest != nil && c.Manifest.Episode.Title != "" {
+		title = c.Manifest.Episode.Title
+	}
+	return atomEntry{
+		ID:      "urn:comicdays:chapter:" + c.ID,
+		Title:   title,
+		Updated: atomTime(c.ModTime),
+		Content: &atomContent{Type: "text", Text: fmt.Sprintf("%d page(s)", len(c.Pages))},
+		Links: []atomLink{
+			{Rel: opdsImageRel, Href: "/api/chapters/" + c.ID + "/pages/1", Type: mime.TypeByExtension(filepath.Ext(c.Pages[0]))},
+			{Rel: opdsThumbnailRel, Href: "/api/chapters/" + c.ID + "/thumbnail", Type: "image/jpeg"},
+			{Rel: opdsAcquisitionRel, Href: "/opds/chapters/" + c.ID + "/cbz", Type: cbzType},
+			{
+				Rel:      pseStreamRel,
+				Href:     "/opds/chapters/" + c.ID + "/pages/{pageNumber}?maxWidth={maxWidth}",
+				Type:     "image/jpeg",
+				PSECount: len(c.Pages),
+			},
+		},
+	}
+}
+
+// handleOPDSCBZ streams a chapter as a CBZ archive. Pages are stored rather
+// than deflated since the page images are already compressed.
+func (s *server) handleOPDSCBZ(w http.ResponseWriter, r *http.Request) {
+	c, ok := findChapter(s.root, r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", cbzType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": c.Title() + ".cbz",
+	}))
+
+	zw := zip.NewWriter(w)
+	for _, name := range c.Pages {
+		if err := addZipFile(zw, c.Path(s.root, name), name); err != nil {
+			// The response has already started; all that is left is to cut
+			// the archive short so the client sees a broken download.
+			return
+		}
+	}
+	if c.Manifest != nil {
+		if fw, err := zw.Create("ComicInfo.xml"); err == nil {
+			_ = writeComicInfo(fw, *c.Manifest, len(c.Pages))
+		}
+	}
+	_ = zw.Close()
+}
+
+func addZipFile(zw *zip.Writer, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: info.ModTime()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
+
+// writeComicInfo writes the ComicRack metadata most comic readers use to
+// show series and chapter names for a CBZ.
+func writeComicInfo(w io.Writer, m Manifest, pageCount int) error {
+	info := struct {
+		XMLName   xml.Name `xml:"ComicInfo"`
+		Title     string   `xml:"Title,omitempty"`
+		Series    string   `xml:"Series,omitempty"`
+		Number    string   `xml:"Number,omitempty"`
+		Web       string   `xml:"Web,omitempty"`
+		PageCount int      `xml:"PageCount"`
+		Manga     string   `xml:"Manga"`
+	}{
+		Title:     m.Episode.Title,
+		Series:    m.Episode.SeriesTitle,
+		Web:       m.Episode.URL,
+		PageCount: pageCount,
+		Manga:     "YesAndRightToLeft",
+	}
+	if m.Episode.Number > 0 {
+		info.Number = strconv.Itoa(m.Episode.Number)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(info)
+}
+
+// handleOPDSPage serves an OPDS-PSE page. PSE page numbers are 0-based, and
+// clients may ask for a maximum width to save bandwidth, in which case the
+// page is scaled down and sent as JPEG.
+func (s *server) handleOPDSPage(w http.ResponseWriter, r *http.Request) {
+	c, ok := findChapter(s.root, r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("page"))
+	if err != nil || n < 0 || n >= len(c.Pages) {
+		http.NotFound(w, r)
+		return
+	}
+	path := c.Path(s.root, c.Pages[n])
+
+	maxWidth, _ := strconv.Atoi(r.URL.Query().Get("maxWidth"))
+	if maxWidth > 0 {
+		img, err := imaging.Open(path)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if img.Bounds().Dx() > maxWidth {
+			w.Header().Set("Content-Type", "image/jpeg")
+			_ = jpeg.Encode(w, imaging.Resize(img, maxWidth, 0, imaging.Lanczos), &jpeg.Options{Quality: 90})
+			return
+		}
+	}
+	http.ServeFile(w, r, path)
+}
+
+func writeAtom(w http.ResponseWriter, contentType string, feed *atomFeed) {
+	w.Header().Set("Content-Type", contentType)
+	_, _ = io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	_ = enc.Encode(feed)
+}
+
+// requireBasicAuth wraps next so every request must carry the given HTTP
+// basic auth credentials.
+func requireBasicAuth(user, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+appName+`", charset="UTF-8"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestChapter(t *testing.T, root, dir string, episode Episode, pageCount int) {
+	t.Helper()
+	pages := make([]Page, pageCount)
+	for i := range pages {
+		pages[i] = NewPage("", 1, 1)
+	}
+	m := newManifest(ChapterOutput{Episode: episode}, pages)
+	for _, p := range m.Pages {
+		writeTestFiles(t, filepath.Join(root, dir), p.File)
+	}
+	if err := writeManifest(filepath.Join(root, dir), m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOPDSGroupsChaptersBySeries(t *testing.T) {
+	root := t.TempDir()
+	writeTestChapter(t, root, "a", Episode{Title: "第2話", Number: 2, SeriesID: "s1", SeriesTitle: "Series One"}, 3)
+	writeTestChapter(t, root, "b", Episode{Title: "第1話", Number: 1, SeriesID: "s1", SeriesTitle: "Series One"}, 2)
+	writeTestFiles(t, filepath.Join(root, "legacy"), "001.png")
+	handler := (&server{root: root, events: newBroker()}).routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/opds", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `href="/opds/series/s1"`) || !strings.Contains(body, "Unsorted") {
+		t.Fatalf("navigation feed is missing series:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/opds/series/s1", nil))
+	body = rec.Body.String()
+	first, second := strings.Index(body, "第1話"), strings.Index(body, "第2話")
+	if first < 0 || second < 0 || first > second {
+		t.Fatalf("acquisition feed does not list chapters in episode order:\n%s", body)
+	}
+	if !strings.Contains(body, `pse:count="3"`) || !strings.Contains(body, cbzType) {
+		t.Fatalf("acquisition feed is missing PSE or CBZ links:\n%s", body)
+	}
+}
+
+func TestOPDSCBZContainsPagesAndComicInfo(t *testing.T) {
+	root := t.TempDir()
+	writeTestChapter(t, root, "a", Episode{Title: "第1話", SeriesTitle: "Series"}, 2)
+	handler := (&server{root: root, events: newBroker()}).routes()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/opds/chapters/"+chapterID("a")+"/cbz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("response is not a zip archive: %v", err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if got := strings.Join(names, ","); got != "001.png,002.png,ComicInfo.xml" {
+		t.Fatalf("archive entries = %s", got)
+	}
+}
+
+func TestRequireBasicAuth(t *testing.T) {
+	handler := requireBasicAuth("reader", "secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/opds", nil))
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("unauthenticated request: status = %d, want a %d challenge", rec.Code, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest("GET", "/opds", nil)
+	req.SetBasicAuth("reader", "wrong")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong password: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	req.SetBasicAuth("reader", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid credentials: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// serverImage is a page image exactly as the server sent it.
+type serverImage struct {
+	data        []byte
+	contentType string
+	etag        string
+}
+
+// originalExts are the extensions kept originals get for the usual image
+// types; mime.ExtensionsByType would pick ".jfif" or ".jpe" for JPEGs on
+// some systems.
+var originalExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+	"image/avif": ".avif",
+}
+
+// originalExt is the file extension of img, taken from its content type or,
+// when the server did not send a useful one, from the data itself.
+func originalExt(img serverImage) string {
+	mediaType, _, _ := mime.ParseMediaType(img.contentType)
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(img.data))
+	}
+	if ext, ok := originalExts[mediaType]; ok {
+		return ext
+	}
+	if strings.HasPrefix(mediaType, "image/") {
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			return exts[0]
+		}
+	}
+	return ".bin"
+}
+
+// originalFile names the copy of the server's image kept next to the page
+// file page: 001.png keeps its original as 001.original.jpg.
+func originalFile(page, ext string) string {
+	return strings.TrimSuffix(page, filepath.Ext(page)) + ".original" + ext
+}
+
+// saveOriginal writes img next to the page file page in dir, so the page can
+// be restored again later without downloading it, and describes it for the
+// manifest.
+func saveOriginal(img serverImage, dir, page string) (*ManifestOriginal, error) {
+	name := originalFile(page, originalExt(img))
+	if err := writeFileAtomic(filepath.Join(dir, name), img.data); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(img.data)
+	return &ManifestOriginal{
+		File:        name,
+		ContentType: img.contentType,
+		ETag:        img.etag,
+		Size:        int64(len(img.data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+	}, nil
+}
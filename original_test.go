@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOriginalExt(t *testing.T) {
+	png := testPNG(t, 4, 4)
+	tests := []struct {
+		contentType string
+		data        []byte
+		want        string
+	}{
+		{"image/jpeg", nil, ".jpg"},
+		{"image/webp; charset=binary", nil, ".webp"},
+		{"IMAGE/PNG", nil, ".png"},
+		{"", png, ".png"},
+		{"application/octet-stream", png, ".png"},
+		{"", []byte("????"), ".bin"},
+	}
+	for _, tt := range tests {
+		if got := originalExt(serverImage{data: tt.data, contentType: tt.contentType}); got != tt.want {
+			t.Errorf("originalExt(%q) = %q, want %q", tt.contentType, got, tt.want)
+		}
+	}
+	if got := originalFile("Series 001.png", ".jpg"); got != "Series 001.original.jpg" {
+		t.Errorf("originalFile = %q", got)
+	}
+}
+
+func TestDownloadPagesKeepsOriginals(t *testing.T) {
+	body := testPNG(t, 64, 64)
+	fetcher := fetcherFunc(func(req *http.Request) (*http.Response, error) {
+		resp := testResponse("image/png", bytes.NewReader(body))
+		resp.Header.Set("ETag", `"abc"`)
+		return resp, nil
+	})
+	pages := []Page{NewPage("https://cdn.comic-days.com/1.png", 64, 64)}
+	out := ChapterOutput{Dir: t.TempDir(), KeepOriginals: true}
+
+	results, failed := downloadPages(pages, fetcher, nil, out, &countingReporter{})
+	if failed != 0 || len(results) != 1 {
+		t.Fatalf("downloadPages: %d results, %d failed", len(results), failed)
+	}
+	orig := results[0].original
+	if orig == nil || orig.File != "001.original.png" || orig.ETag != `"abc"` || orig.ContentType != "image/png" || orig.Size != int64(len(body)) {
+		t.Fatalf("original = %+v", orig)
+	}
+	data, err := os.ReadFile(filepath.Join(out.Dir, orig.File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, body) {
+		t.Fatal("kept original differs from the server's response")
+	}
+
+	if err := finishChapter(nil, out, pages, results); err != nil {
+		t.Fatal(err)
+	}
+	m, err := readManifest(out.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Pages[0].Original == nil || m.Pages[0].Original.SHA256 != orig.SHA256 {
+		t.Fatalf("manifest original = %+v", m.Pages[0].Original)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ChapterOutput is a prepared chapter folder: where the pages of one
+// episode are written and what their files are called.
+type ChapterOutput struct {
+	Dir     string
+	Episode Episode
+	// Format is the encoding pages are saved in.
+	Format ImageFormat
+	// KeepOriginals keeps every image as the server sent it next to its
+	// page (see saveOriginal).
+	KeepOriginals bool
+
+	// template names the page files; nil means the classic 001.png style.
+	template *OutputTemplate
+	// files, when set, overrides the names of existing pages (as recorded in
+	// a manifest) so rewriting a page replaces the right file.
+	files []string
+}
+
+// PageFile is the file name of page pageNum (1-based).
+func (o ChapterOutput) PageFile(pageNum int) string {
+	ext := o.Format.Ext()
+	if pageNum-1 < len(o.files) && o.files[pageNum-1] != "" {
+		return o.files[pageNum-1]
+	}
+	if o.template != nil {
+		return o.template.PageFile(pageNum, ext)
+	}
+	return fmt.Sprintf("%03d.%s", pageNum, ext)
+}
+
+// outputFromManifest describes an existing chapter folder, keeping the page
+// file names its manifest recorded.
+func outputFromManifest(dir string, m Manifest) ChapterOutput {
+	out := ChapterOutput{Dir: dir, Episode: m.Episode}
+	for _, p := range m.Pages {
+		out.files = append(out.files, p.File)
+	}
+	if len(m.Pages) > 0 {
+		out.Format = formatForFile(m.Pages[0].File)
+	}
+	return out
+}
+
+// prepareChapterDir creates the output folder for a chapter and records its
+// metadata there, so the chapter can be recognised and organised later even
+// if the download is interrupted. Without a template every download gets a
+// fresh, timestamped folder inside root.
+func prepareChapterDir(root string, tmpl *OutputTemplate, format ImageFormat, episode Episode, pages []Page) (ChapterOutput, error) {
+	out := ChapterOutput{Episode: episode, Format: format, template: tmpl}
+	var err error
+	if tmpl == nil {
+		out.Dir, err = createOutputDir(root)
+	} else {
+		out.Dir, err = createTemplateDir(root, tmpl.ChapterDir(episode, time.Now()), episode)
+	}
+	if err != nil {
+		return ChapterOutput{}, err
+	}
+	if err := writeManifest(out.Dir, newManifest(out, pages)); err != nil {
+		return ChapterOutput{}, err
+	}
+	return out, nil
+}
+
+// findPartialChapter looks under root for a chapter folder of episode that
+// an earlier download left unfinished, with the same pages. It returns the
+// folder, ready for the missing pages to be written to, and the numbers of the pages still
+// missing there.
+func findPartialChapter(root string, tmpl *OutputTemplate, format ImageFormat, episode Episode, pages []Page) (ChapterOutput, []int, bool) {
+	dirs, err := findChapterDirs(root)
+	if err != nil {
+		return ChapterOutput{}, nil, false
+	}
+	for _, dir := range dirs {
+		m, err := readManifest(dir)
+		if err != nil || !sameEpisode(m.Episode, episode) || len(m.Pages) != len(pages) {
+			continue
+		}
+		same := true
+		for i, p := range m.Pages {
+			same = same && p.Width == pages[i].Width && p.Height == pages[i].Height
+		}
+		if !same {
+			continue
+		}
+		var missing []int
+		for i, p := range m.Pages {
+			if _, err := os.Stat(filepath.Join(dir, p.File)); p.SHA256 == "" || err != nil {
+				missing = append(missing, i+1)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		return ChapterOutput{Dir: dir, Episode: episode, Format: format, template: tmpl}, missing, true
+	}
+	return ChapterOutput{}, nil, false
+}
+
+// createTemplateDir creates root/rel for episode. Templates that do not
+// identify an episode uniquely can map two episodes to the same folder; the
+// second one then gets a " (2)" suffix instead of overwriting the first.
+func createTemplateDir(root, rel string, episode Episode) (string, error) {
+	base := filepath.Join(root, rel)
+	for n := 1; ; n++ {
+		dir := base
+		if n > 1 {
+			dir = base + " (" + strconv.Itoa(n) + ")"
+		}
+		if m, err := readManifest(dir); err == nil && !sameEpisode(m.Episode, episode) {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", fmt.Errorf("failed to create output directory: %v", err)
+		}
+		return dir, nil
+	}
+}
+
+func sameEpisode(a, b Episode) bool {
+	if a.ID != "" || b.ID != "" {
+		return a.ID == b.ID
+	}
+	return a.URL == b.URL
+}
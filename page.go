@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"io"
@@ -8,22 +12,35 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/disintegration/imaging"
 )
 
-const (
-	retryDelay              = 10 * time.Second
-	maxPageDownloadAttempts = 3
-	maxPagePixels           = 100_000_000
-)
+const maxPageDownloadAttempts = 3
+
+// retryDelay is how long a page waits before it is downloaded again. It is
+// a variable so tests against the fake site do not have to wait.
+var retryDelay = 10 * time.Second
 
 type Page struct {
 	Src    string `json:"src"`
 	Width  int    `json:"width"`
 	Height int    `json:"height"`
+	// Scramble is how the image is scrambled; the zero value means
+	// comicDaysScramble.
+	Scramble ScrambleSpec `json:"-"`
+}
+
+// scrambleSpec returns p.Scramble, or the default when it is unset.
+func (p Page) scrambleSpec() ScrambleSpec {
+	if p.Scramble.Columns == 0 {
+		return comicDaysScramble
+	}
+	return p.Scramble
 }
 
 func NewPage(src string, width, height int) Page {
@@ -34,18 +51,109 @@ func NewPage(src string, width, height int) Page {
 	}
 }
 
-// countingReader tallies how many bytes have passed through it, which lets
-// the UI report real download sizes even though the image is decoded
-// straight from the streaming HTTP response body.
-type countingReader struct {
-	r     io.Reader
-	count int64
+// PageReporter receives progress for the pages of a chapter as they are
+// processed. The terminal Pipeline (see ui.go) and the web UI's job tracker
+// (see jobs.go) both implement it, so the download loop itself never cares
+// where its progress ends up.
+type PageReporter interface {
+	Status(pageNum int, format string, a ...any)
+	RetryObserver(pageNum int, phase string) RetryObserver
+	PageSucceeded(r pageResult)
+	PageFailed(pageNum int, err error)
+}
+
+// pageSkipper is implemented by PageReporters that can report the pages a
+// run abandons in one go; the others are told about each page with
+// PageFailed.
+type pageSkipper interface {
+	SkipPages(pageNums []int, err error)
+}
+
+// skipPages reports pageNums as abandoned because of err.
+func skipPages(pl PageReporter, pageNums []int, err error) {
+	if s, ok := pl.(pageSkipper); ok {
+		s.SkipPages(pageNums, err)
+		return
+	}
+	for _, n := range pageNums {
+		pl.PageFailed(n, fmt.Errorf("skipped: %w", err))
+	}
 }
 
-func (c *countingReader) Read(buf []byte) (int, error) {
-	n, err := c.r.Read(buf)
-	c.count += int64(n)
-	return n, err
+// maxPendingEncodes bounds how many downloaded pages may be deobfuscated and
+// encoded in the background at once. Each one holds a decoded page in
+// memory, so the bound is kept small even on machines with many cores.
+var maxPendingEncodes = max(1, min(runtime.NumCPU(), 4))
+
+// downloadPages processes every page in reading order, reporting through pl.
+// Pages are downloaded one after another, but each is encoded in the
+// background while the next one downloads, so the CPU and network work
+// overlap. It returns the results of the pages that were produced, in
+// order, and how many pages could not be. When the site is down (see
+// CircuitBreaker) the pages that are left are skipped.
+func downloadPages(pages []Page, networkClient HTTPFetcher, cookies []Cookie, out ChapterOutput, pl PageReporter) ([]pageResult, int) {
+	return downloadSomePages(pages, nil, networkClient, cookies, out, pl)
+}
+
+// downloadSomePages is downloadPages for the pages numbered pageNums
+// (1-based, in order) only, for example those an interrupted download left
+// missing. A nil pageNums means every page.
+func downloadSomePages(pages []Page, pageNums []int, networkClient HTTPFetcher, cookies []Cookie, out ChapterOutput, pl PageReporter) ([]pageResult, int) {
+	if pageNums == nil {
+		for n := 1; n <= len(pages); n++ {
+			pageNums = append(pageNums, n)
+		}
+	}
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		results = make([]*pageResult, len(pages))
+		failed  int
+		slots   = make(chan struct{}, maxPendingEncodes)
+	)
+	for k, pageNum := range pageNums {
+		i, page := pageNum-1, pages[pageNum-1]
+		// fetch and save already report success/failure for this page
+		// through pl, so their errors only need counting here, not printing.
+		fetched, err := page.fetch(networkClient, cookies, pageNum, pl)
+		if errors.Is(err, ErrSiteDown) {
+			rest := pageNums[k+1:]
+			skipPages(pl, rest, err)
+			mu.Lock()
+			failed += 1 + len(rest)
+			mu.Unlock()
+			break
+		}
+		if err != nil {
+			mu.Lock()
+			failed++
+			mu.Unlock()
+			continue
+		}
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, page Page) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			r, err := page.save(fetched, out, pl)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+				return
+			}
+			results[i] = &r
+		}(i, page)
+	}
+	wg.Wait()
+
+	var done []pageResult
+	for _, r := range results {
+		if r != nil {
+			done = append(done, *r)
+		}
+	}
+	return done, failed
 }
 
 // Process downloads, deobfuscates and saves a single page, narrating every
@@ -53,65 +161,109 @@ func (c *countingReader) Read(buf []byte) (int, error) {
 // gives up on permanent errors (for example a page that requires a purchase)
 // immediately. It returns an error only when the page could not be
 // produced; pl has already reported success or failure by the time it does.
-func (p Page) Process(networkClient HTTPFetcher, cookies []Cookie, outDir string, pageNum int, pl *Pipeline) error {
+func (p Page) Process(networkClient HTTPFetcher, cookies []Cookie, out ChapterOutput, pageNum int, pl PageReporter) (pageResult, error) {
+	fetched, err := p.fetch(networkClient, cookies, pageNum, pl)
+	if err != nil {
+		return pageResult{}, err
+	}
+	return p.save(fetched, out, pl)
+}
+
+// fetchedPage is a downloaded, still scrambled page waiting to be saved.
+type fetchedPage struct {
+	pageNum int
+	img     image.Image
+	// original is the response img was decoded from.
+	original serverImage
+	start    time.Time
+}
+
+// fetch is the download half of Process.
+func (p Page) fetch(networkClient HTTPFetcher, cookies []Cookie, pageNum int, pl PageReporter) (fetchedPage, error) {
 	start := time.Now()
 
 	var img image.Image
-	var downloadedBytes int64
+	var original serverImage
 	var err error
 
 	for attempt := 1; attempt <= maxPageDownloadAttempts; attempt++ {
 		pl.Status(pageNum, "downloading...")
-		img, downloadedBytes, err = p.downloadAttempt(networkClient, cookies, pageNum, pl)
+		img, original, err = p.downloadAttempt(networkClient, cookies, pageNum, pl)
 		if err == nil {
 			break
 		}
 
 		if IsPermanent(err) {
 			pl.PageFailed(pageNum, err)
-			return fmt.Errorf("page %d: %w", pageNum, err)
+			return fetchedPage{}, fmt.Errorf("page %d: %w", pageNum, err)
 		}
 		if attempt == maxPageDownloadAttempts {
 			finalErr := fmt.Errorf("download failed after %d attempts: %w", attempt, err)
 			pl.PageFailed(pageNum, finalErr)
-			return fmt.Errorf("page %d: %w", pageNum, finalErr)
+			return fetchedPage{}, fmt.Errorf("page %d: %w", pageNum, finalErr)
 		}
 
 		pl.Status(pageNum, "download failed (attempt %d): %v — retrying in %v...", attempt, err, retryDelay)
 		time.Sleep(retryDelay)
 	}
+	return fetchedPage{pageNum: pageNum, img: img, original: original, start: start}, nil
+}
 
-	pl.Status(pageNum, "reversing %dx%d grid transpose...", divideNum, divideNum)
-	savedBytes, err := p.deobfuscateAndSave(img, outDir, pageNum)
+// save is the CPU-bound half of Process: it works out how the fetched page
+// is scrambled, then restores and encodes it.
+func (p Page) save(f fetchedPage, out ChapterOutput, pl PageReporter) (pageResult, error) {
+	pageNum := f.pageNum
+	pl.Status(pageNum, "checking how the page is scrambled...")
+	detection := detectScramble(f.img, p.Width, p.Height, p.scrambleSpec())
+	p.Scramble = detection.Spec
+	if !detection.Spec.IsIdentity() {
+		pl.Status(pageNum, "reversing %s scrambling...", detection.Spec)
+	}
+	saved, err := p.deobfuscateAndSave(f.img, f.original.data, out, pageNum)
 	if err != nil {
 		pl.PageFailed(pageNum, err)
-		return fmt.Errorf("page %d: %w", pageNum, err)
+		return pageResult{}, fmt.Errorf("page %d: %w", pageNum, err)
+	}
+	var original *ManifestOriginal
+	if out.KeepOriginals {
+		original, err = saveOriginal(f.original, out.Dir, saved.file)
+		if err != nil {
+			err = fmt.Errorf("error keeping the original of page %d: %v", pageNum, err)
+			pl.PageFailed(pageNum, err)
+			return pageResult{}, fmt.Errorf("page %d: %w", pageNum, err)
+		}
 	}
 
-	pl.PageSucceeded(pageResult{
+	r := pageResult{
 		pageNum:       pageNum,
 		width:         p.Width,
 		height:        p.Height,
-		downloadBytes: downloadedBytes,
-		savedBytes:    savedBytes,
-		elapsed:       time.Since(start),
-	})
-	return nil
+		file:          saved.file,
+		format:        saved.format,
+		scramble:      detection,
+		sha256:        saved.sha256,
+		original:      original,
+		downloadBytes: int64(len(f.original.data)),
+		savedBytes:    saved.size,
+		elapsed:       time.Since(f.start),
+	}
+	pl.PageSucceeded(r)
+	return r, nil
 }
 
-func (p Page) downloadAttempt(networkClient HTTPFetcher, cookies []Cookie, pageNum int, pl *Pipeline) (image.Image, int64, error) {
+func (p Page) downloadAttempt(networkClient HTTPFetcher, cookies []Cookie, pageNum int, pl PageReporter) (image.Image, serverImage, error) {
 	src, err := normalizeComicDaysAssetURL(p.Src)
 	if err != nil {
-		return nil, 0, &PermanentError{Err: fmt.Errorf("invalid page %d src: %w", pageNum, err)}
+		return nil, serverImage{}, &PermanentError{Err: fmt.Errorf("invalid page %d src: %w", pageNum, err)}
 	}
 	req, err := http.NewRequest("GET", src, nil)
 	if err != nil {
-		return nil, 0, &PermanentError{Err: fmt.Errorf("error creating request for page %d: %v", pageNum, err)}
+		return nil, serverImage{}, &PermanentError{Err: fmt.Errorf("error creating request for page %d: %v", pageNum, err)}
 	}
 
 	req.Header.Set("User-Agent", defaultUserAgent)
-	req.Header.Set("Referer", "https://comic-days.com/")
-	req.Header.Set("Origin", "https://comic-days.com")
+	req.Header.Set("Referer", siteURL.String()+"/")
+	req.Header.Set("Origin", siteURL.String())
 	addCookies(req, cookies)
 
 	var onRetry RetryObserver
@@ -120,30 +272,45 @@ func (p Page) downloadAttempt(networkClient HTTPFetcher, cookies []Cookie, pageN
 	}
 	resp, err := networkClient.FetchWithRetries(req, onRetry)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to download page %d: %w", pageNum, err)
+		return nil, serverImage{}, fmt.Errorf("failed to download page %d: %w", pageNum, err)
 	}
 	if resp == nil {
-		return nil, 0, fmt.Errorf("failed to download page %d: empty response", pageNum)
+		return nil, serverImage{}, fmt.Errorf("failed to download page %d: empty response", pageNum)
 	}
 	defer resp.Body.Close()
 	if err := validateImageContentType(resp, pageNum); err != nil {
-		return nil, 0, err
+		return nil, serverImage{}, err
 	}
 
-	counting := &countingReader{r: resp.Body}
-	img, err := imaging.Decode(counting)
+	// The body is kept, not just decoded: the jpeg-lossless format restores
+	// the page from the JPEG data itself, and -keep-original saves it. Its
+	// size is checked against the page metadata before it is decoded.
+	// Reading through downloadRate measures the download and applies
+	// -limit-rate to it; images the cache answers cost no bandwidth.
+	body := io.Reader(resp.Body)
+	if resp.Header.Get(cacheHitHeader) != cacheHitValue {
+		body = downloadRate.Reader(resp.Body)
+	}
+	raw, err := readImage(body, resp.ContentLength, func(width, height int) error {
+		return p.validateImageSize(width, height)
+	})
 	if err != nil {
-		return nil, counting.count, fmt.Errorf("error decoding image for page %d: %v", pageNum, err)
+		return nil, serverImage{}, fmt.Errorf("failed to download page %d: %w", pageNum, err)
+	}
+	original := serverImage{data: raw, contentType: resp.Header.Get("Content-Type"), etag: resp.Header.Get("ETag")}
+	img, err := imaging.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, original, fmt.Errorf("error decoding image for page %d: %v", pageNum, err)
 	}
 
 	if img == nil {
-		return nil, counting.count, fmt.Errorf("downloaded image for page %d is empty", pageNum)
+		return nil, original, fmt.Errorf("downloaded image for page %d is empty", pageNum)
 	}
 	if err := p.validateImageBounds(img); err != nil {
-		return nil, counting.count, err
+		return nil, original, err
 	}
 
-	return img, counting.count, nil
+	return img, original, nil
 }
 
 func validateImageContentType(resp *http.Response, pageNum int) error {
@@ -166,44 +333,100 @@ func validatePageDimensions(width, height int) error {
 	if width <= 0 || height <= 0 {
 		return fmt.Errorf("dimensions must be positive, got %dx%d", width, height)
 	}
-	if width > maxPagePixels/height {
-		return fmt.Errorf("dimensions %dx%d exceed the %d pixel safety limit", width, height, maxPagePixels)
+	if width > imageLimits.MaxPixels/height {
+		return fmt.Errorf("dimensions %dx%d exceed the %d pixel safety limit", width, height, imageLimits.MaxPixels)
 	}
 	return nil
 }
 
 func (p Page) validateImageBounds(img image.Image) error {
+	bounds := img.Bounds()
+	return p.validateImageSize(bounds.Dx(), bounds.Dy())
+}
+
+// validateImageSize checks that an image of width x height is the page the
+// metadata describes, and within the pixel limit.
+func (p Page) validateImageSize(width, height int) error {
 	if err := validatePageDimensions(p.Width, p.Height); err != nil {
 		return &PermanentError{Err: err}
 	}
-	bounds := img.Bounds()
-	if bounds.Dx() != p.Width || bounds.Dy() != p.Height {
+	if width != p.Width || height != p.Height {
 		return &PermanentError{Err: fmt.Errorf(
 			"decoded image dimensions %dx%d do not match metadata %dx%d",
-			bounds.Dx(), bounds.Dy(), p.Width, p.Height,
+			width, height, p.Width, p.Height,
 		)}
 	}
 	return nil
 }
 
-// deobfuscateAndSave reverses the grid scrambling and writes the PNG to
-// disk, returning the size of the saved file for reporting.
-func (p Page) deobfuscateAndSave(img image.Image, outDir string, pageNum int) (int64, error) {
-	if err := p.validateImageBounds(img); err != nil {
-		return 0, err
-	}
-	filePath := filepath.Join(outDir, fmt.Sprintf("%03d.png", pageNum))
+// savedPage describes a page file once it has been written.
+type savedPage struct {
+	file   string
+	format string
+	size   int64
+	sha256 string
+}
+
+// deobfuscateAndSave reverses the page's scrambling and writes the page to
+// disk in the chapter's format, returning the name, size and hash of the saved file.
+// With the jpeg-lossless format the JPEG raw is restored as it is; when that
+// is impossible the page falls back to PNG, and the format says why. img
+// must already match the page's dimensions, as downloadAttempt checks.
+func (p Page) deobfuscateAndSave(img image.Image, raw []byte, out ChapterOutput, pageNum int) (savedPage, error) {
 	imageCtx := NewImageContext(img)
+	imageCtx.Raw = raw
+	imageCtx.Spec = p.scrambleSpec()
+	imageCtx.Format = out.Format
+
+	var note string
+	if out.Format.keepsJPEG() {
+		data, err := imageCtx.RestoreJPEG()
+		if err == nil {
+			name := out.PageFile(pageNum)
+			if err := writeFileAtomic(filepath.Join(out.Dir, name), data); err != nil {
+				return savedPage{}, fmt.Errorf("error creating file for page %d: %v", pageNum, err)
+			}
+			return digestSavedPage(out.Dir, name, out.Format.Label(), pageNum)
+		}
+		note = fmt.Sprintf(" (lossless JPEG impossible: %v)", err)
+		out.Format = out.Format.pixelFallback()
+		imageCtx.Format = out.Format
+	}
+
+	name := out.PageFile(pageNum)
 	imageCtx.Deobfuscate(p.Width, p.Height)
+	if err := imageCtx.SaveImage(filepath.Join(out.Dir, name)); err != nil {
+		return savedPage{}, fmt.Errorf("error creating file for page %d: %v", pageNum, err)
+	}
+	format := out.Format.Label()
+	if imageCtx.Grayscale {
+		format += " gray"
+	}
+	return digestSavedPage(out.Dir, name, format+note, pageNum)
+}
 
-	if err := imageCtx.SaveImage(filePath); err != nil {
-		return 0, fmt.Errorf("error creating file for page %d: %v", pageNum, err)
+// digestSavedPage describes the page file dir/name that was just written.
+// The hash is taken from the file as it landed on disk, so it can later
+// prove the file was not truncated or corrupted.
+func digestSavedPage(dir, name, format string, pageNum int) (savedPage, error) {
+	size, sum, err := fileDigest(filepath.Join(dir, name))
+	if err != nil {
+		return savedPage{}, fmt.Errorf("error reading back page %d: %v", pageNum, err)
 	}
+	return savedPage{file: name, format: format, size: size, sha256: sum}, nil
+}
 
-	if info, err := os.Stat(filePath); err == nil {
-		return info.Size(), nil
+// fileDigest returns the size and hex SHA-256 of the file at path.
+func fileDigest(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
 	}
-	// The file was saved successfully; not knowing its exact size is only
-	// cosmetic, so this is not treated as an error.
-	return 0, nil
+	return n, hex.EncodeToString(h.Sum(nil)), nil
 }
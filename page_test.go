@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"image"
 	"image/png"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type fakeFetcher struct {
@@ -69,6 +75,36 @@ func TestDownloadAttemptRejectsDimensionMismatch(t *testing.T) {
 	}
 }
 
+func TestDownloadAttemptLimitsRateUnlessCached(t *testing.T) {
+	saved := downloadRate
+	t.Cleanup(func() { downloadRate = saved })
+	data := testPNG(t, 64, 64)
+	page := NewPage("https://cdn.comic-days.com/image.png", 64, 64)
+
+	for _, tt := range []struct {
+		header  http.Header
+		limited bool
+	}{
+		// A CDN's own cache header says nothing about our cache.
+		{http.Header{"X-Cache": {"Miss from cloudfront"}}, true},
+		{http.Header{cacheHitHeader: {"hit"}}, true},
+		{http.Header{cacheHitHeader: {cacheHitValue}}, false},
+	} {
+		var slept func() time.Duration
+		downloadRate, slept = fakeRateLimiter(64)
+		resp := testResponse("image/png", bytes.NewReader(data))
+		for name := range tt.header {
+			resp.Header.Set(name, tt.header[name][0])
+		}
+		if _, _, err := page.downloadAttempt(&fakeFetcher{resp: resp}, nil, 1, nil); err != nil {
+			t.Fatal(err)
+		}
+		if limited := slept() > 0; limited != tt.limited {
+			t.Errorf("headers %v: limited = %v, want %v", tt.header, limited, tt.limited)
+		}
+	}
+}
+
 func testResponse(contentType string, body io.Reader) *http.Response {
 	return &http.Response{
 		StatusCode: http.StatusOK,
@@ -86,3 +122,64 @@ func testPNG(t *testing.T, width, height int) []byte {
 	}
 	return buf.Bytes()
 }
+
+// fetcherFunc adapts a function to HTTPFetcher, for tests that need a fresh
+// response per request.
+type fetcherFunc func(req *http.Request) (*http.Response, error)
+
+func (f fetcherFunc) FetchWithRetries(req *http.Request, onRetry RetryObserver) (*http.Response, error) {
+	return f(req)
+}
+
+// countingReporter is a PageReporter that only counts outcomes.
+type countingReporter struct {
+	mu                sync.Mutex
+	succeeded, failed int
+}
+
+func (r *countingReporter) Status(pageNum int, format string, a ...any) {}
+
+func (r *countingReporter) RetryObserver(pageNum int, phase string) RetryObserver { return nil }
+
+func (r *countingReporter) PageSucceeded(res pageResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.succeeded++
+}
+
+func (r *countingReporter) PageFailed(pageNum int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed++
+}
+
+func TestDownloadPagesReturnsResultsInOrder(t *testing.T) {
+	fetcher := fetcherFunc(func(req *http.Request) (*http.Response, error) {
+		size := 64
+		if strings.HasSuffix(req.URL.Path, "/3.png") {
+			size = 32 // does not match the page metadata
+		}
+		return testResponse("image/png", bytes.NewReader(testPNG(t, size, size))), nil
+	})
+	var pages []Page
+	for i := 1; i <= 6; i++ {
+		pages = append(pages, NewPage(fmt.Sprintf("https://cdn.comic-days.com/%d.png", i), 64, 64))
+	}
+	out := ChapterOutput{Dir: t.TempDir()}
+	rep := &countingReporter{}
+
+	results, failed := downloadPages(pages, fetcher, nil, out, rep)
+	if failed != 1 || rep.failed != 1 || rep.succeeded != 5 {
+		t.Fatalf("failed = %d, reported %d failed and %d succeeded; want 1, 1 and 5", failed, rep.failed, rep.succeeded)
+	}
+	var got []int
+	for _, r := range results {
+		got = append(got, r.pageNum)
+		if _, err := os.Stat(filepath.Join(out.Dir, r.file)); err != nil {
+			t.Fatalf("page %d was not saved: %v", r.pageNum, err)
+		}
+	}
+	if want := []int{1, 2, 4, 5, 6}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("result pages = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throughputWindow is how far back RateLimiter.Throughput looks, and
+// throughputBucket how finely it remembers.
+const (
+	throughputWindow = 2 * time.Second
+	throughputBucket = 100 * time.Millisecond
+)
+
+// RateLimiter caps and measures how fast downloads arrive. It is a token
+// bucket shared by every reader it wraps, so the cap holds however many
+// downloads run at once.
+type RateLimiter struct {
+	mu sync.Mutex
+	// limit is the cap in bytes per second; 0 means no cap.
+	limit  int64
+	tokens float64
+	last   time.Time
+	// samples are the bytes read in each recent throughputBucket.
+	samples []rateSample
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+type rateSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// downloadRate throttles and measures the page downloads of the whole
+// process; -limit-rate sets its cap (see addRateLimitFlags).
+var downloadRate = newRateLimiter(0)
+
+func newRateLimiter(limit int64) *RateLimiter {
+	return &RateLimiter{limit: limit, now: time.Now, sleep: time.Sleep}
+}
+
+// addRateLimitFlags registers -limit-rate and returns a function that
+// applies it to downloadRate once the flag set has been parsed.
+func addRateLimitFlags(flags *flag.FlagSet) func() error {
+	limit := flags.String("limit-rate", "", "cap the download speed of all downloads together, in bytes per second, e.g. 500K or 2M")
+	return func() error {
+		var n int64
+		if *limit != "" {
+			var err error
+			if n, err = parseByteRate(*limit); err != nil {
+				return fmt.Errorf("invalid -limit-rate: %w", err)
+			}
+		}
+		downloadRate.SetLimit(n)
+		return nil
+	}
+}
+
+// parseByteRate parses a speed such as "800", "500K", "2M" or "1.5MB" into
+// bytes per second. K, M and G are powers of 1024, as they are for curl's
+// --limit-rate.
+func parseByteRate(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	t = strings.TrimSuffix(strings.TrimSuffix(t, "/S"), "B")
+	t = strings.TrimSuffix(t, "I")
+	multiplier := 1.0
+	if t != "" {
+		switch t[len(t)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier != 1 {
+			t = t[:len(t)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%q is not a speed like 500K or 2M", s)
+	}
+	n := int64(v * multiplier)
+	if v > 0 && n == 0 {
+		return 0, fmt.Errorf("%q is less than one byte per second", s)
+	}
+	return n, nil
+}
+
+// SetLimit changes the cap to limit bytes per second, or removes it when
+// limit is 0.
+func (l *RateLimiter) SetLimit(limit int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.tokens = 0
+	l.last = l.now()
+}
+
+// Limit returns the cap in bytes per second, or 0 when there is none.
+func (l *RateLimiter) Limit() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// burst is the most a reader may take at once, and the most the bucket
+// saves up while nothing is downloading. A fraction of a second's worth
+// keeps the speed even and lets concurrent downloads take turns.
+func (l *RateLimiter) burst() int64 {
+	return max(l.limit/8, 4<<10)
+}
+
+// Reader wraps r so that reading from it counts towards the measured
+// throughput and waits as long as the cap requires.
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, l: l}
+}
+
+type throttledReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if limit := t.l.Limit(); limit > 0 {
+		p = p[:min(int64(len(p)), t.l.burst())]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.l.take(int64(n))
+	}
+	return n, err
+}
+
+// take records n bytes that have been read and sleeps until the cap has
+// room for them. Bytes taken while the bucket is empty are owed, so
+// concurrent readers queue up behind each other instead of all going at
+// once.
+func (l *RateLimiter) take(n int64) {
+	l.mu.Lock()
+	now := l.now()
+	l.record(now, n)
+	if l.limit <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit)
+	}
+	l.tokens = min(l.tokens, float64(l.burst())) - float64(n)
+	l.last = now
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.limit) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// record adds n bytes read at now to the samples; l.mu must be held.
+func (l *RateLimiter) record(now time.Time, n int64) {
+	if k := len(l.samples); k > 0 && now.Sub(l.samples[k-1].at) < throughputBucket {
+		l.samples[k-1].bytes += n
+	} else {
+		l.samples = append(l.samples, rateSample{at: now, bytes: n})
+	}
+	l.prune(now)
+}
+
+func (l *RateLimiter) prune(now time.Time) {
+	i := 0
+	for i < len(l.samples) && now.Sub(l.samples[i].at) > throughputWindow {
+		i++
+	}
+	l.samples = l.samples[i:]
+}
+
+// Throughput returns how many bytes per second were read over the last
+// couple of seconds.
+func (l *RateLimiter) Throughput() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(l.now())
+	var total int64
+	for _, s := range l.samples {
+		total += s.bytes
+	}
+	return total * int64(time.Second) / int64(throughputWindow)
+}
+
+// describeThroughput formats the current throughput, and the cap if there
+// is one, for a status line; it is empty while nothing is downloading.
+func describeThroughput(l *RateLimiter) string {
+	rate := l.Throughput()
+	if rate == 0 {
+		return ""
+	}
+	if limit := l.Limit(); limit > 0 {
+		return fmt.Sprintf("%s/s (limit %s/s)", humanBytes(rate), humanBytes(limit))
+	}
+	return humanBytes(rate) + "/s"
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseByteRate(t *testing.T) {
+	for s, want := range map[string]int64{
+		"800":     800,
+		"500K":    500 << 10,
+		"500k":    500 << 10,
+		"2M":      2 << 20,
+		"1.5MB":   3 << 19,
+		"2MiB":    2 << 20,
+		"2M/s":    2 << 20,
+		"1G":      1 << 30,
+		"0":       0,
+		" 64KB ":  64 << 10,
+		"10kb/s":  10 << 10,
+		"0.5K":    512,
+		"100 K":   100 << 10,
+		"3.25MiB": 3<<20 + 1<<18,
+	} {
+		got, err := parseByteRate(s)
+		if err != nil || got != want {
+			t.Errorf("parseByteRate(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "fast", "-1M", "2T", "0.1"} {
+		if got, err := parseByteRate(s); err == nil {
+			t.Errorf("parseByteRate(%q) = %d, want an error", s, got)
+		}
+	}
+}
+
+// fakeRateLimiter returns a limiter whose clock only moves when it sleeps,
+// and a function reporting how long it has slept in all.
+func fakeRateLimiter(limit int64) (*RateLimiter, func() time.Duration) {
+	l := newRateLimiter(0)
+	clock := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var slept time.Duration
+	l.now = func() time.Time { return clock }
+	l.sleep = func(d time.Duration) {
+		clock = clock.Add(d)
+		slept += d
+	}
+	l.SetLimit(limit)
+	return l, func() time.Duration { return slept }
+}
+
+func TestRateLimiterCapsSharedReaders(t *testing.T) {
+	const limit = 64 << 10
+	l, slept := fakeRateLimiter(limit)
+
+	// Two downloads of 128 KiB each share 64 KiB/s, so reading both takes
+	// four seconds: the bucket starts out empty.
+	for i := 0; i < 2; i++ {
+		n, err := io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 128<<10))))
+		if err != nil || n != 128<<10 {
+			t.Fatalf("read %d bytes, %v", n, err)
+		}
+	}
+	if got := slept(); got < 4*time.Second-time.Millisecond || got > 4*time.Second+time.Millisecond {
+		t.Fatalf("slept %v, want 4s", got)
+	}
+}
+
+func TestRateLimiterCapsConcurrentReaders(t *testing.T) {
+	l := newRateLimiter(0)
+	l.SetLimit(256 << 10)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 64<<10))))
+		}()
+	}
+	wg.Wait()
+	// 128 KiB at 256 KiB/s.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("two concurrent downloads took %v, want about 500ms", elapsed)
+	}
+}
+
+func TestRateLimiterWithoutLimitOnlyMeasures(t *testing.T) {
+	l, slept := fakeRateLimiter(0)
+	if _, err := io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 1<<20)))); err != nil {
+		t.Fatal(err)
+	}
+	if slept() != 0 {
+		t.Fatalf("slept %v without a limit", slept())
+	}
+	if got, want := l.Throughput(), int64(1<<20)*int64(time.Second)/int64(throughputWindow); got != want {
+		t.Fatalf("Throughput = %d, want %d", got, want)
+	}
+}
+
+func TestRateLimiterThroughputForgetsOldReads(t *testing.T) {
+	l, _ := fakeRateLimiter(0)
+	clock := l.now()
+	l.now = func() time.Time { return clock }
+
+	l.take(4000)
+	clock = clock.Add(time.Second)
+	l.take(2000)
+	if got := l.Throughput(); got != 3000 {
+		t.Fatalf("Throughput = %d, want 3000", got)
+	}
+	clock = clock.Add(1500 * time.Millisecond)
+	if got := l.Throughput(); got != 1000 {
+		t.Fatalf("Throughput after the first read expired = %d, want 1000", got)
+	}
+	clock = clock.Add(time.Minute)
+	if got := describeThroughput(l); got != "" {
+		t.Fatalf("describeThroughput while idle = %q", got)
+	}
+}
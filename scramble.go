@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A ScrambleSpec describes how a viewer scrambles its page images. The
+// picture is divided into a Columns x Rows grid of equally sized cells whose
+// dimensions are rounded down to a multiple of Multiple pixels; the cells
+// are then shuffled. Any margin to the right of and below the grid is never
+// scrambled.
+//
+// Cells are numbered row by row from the top left. Permutation[i] is the
+// cell of the scrambled image that holds cell i of the original picture.
+type ScrambleSpec struct {
+	Name        string
+	Columns     int
+	Rows        int
+	Multiple    int
+	Permutation []int
+}
+
+// comicDaysScramble is the scrambling used by Comic Days and the other
+// GigaViewer sites: a 4x4 grid of cells, multiples of 8 pixels, transposed
+// (the cell at row r, column c is swapped with the cell at row c, column r).
+var comicDaysScramble = transposeScramble(4, 8)
+
+// noScramble leaves the picture as it is.
+var noScramble = ScrambleSpec{Name: "none", Columns: 1, Rows: 1, Multiple: 1, Permutation: []int{0}}
+
+// siteScrambleSpecs is the scrambling used by each supported host.
+var siteScrambleSpecs = map[string]ScrambleSpec{
+	comicDaysHost: comicDaysScramble,
+}
+
+// transposeScramble returns the spec of an n x n grid that is transposed.
+// Transposition is its own inverse, so the same spec both scrambles and
+// restores.
+func transposeScramble(n, multiple int) ScrambleSpec {
+	perm := make([]int, n*n)
+	for row := 0; row < n; row++ {
+		for col := 0; col < n; col++ {
+			perm[row*n+col] = col*n + row
+		}
+	}
+	return ScrambleSpec{
+		Name:        fmt.Sprintf("transpose %dx%d/%d", n, n, multiple),
+		Columns:     n,
+		Rows:        n,
+		Multiple:    multiple,
+		Permutation: perm,
+	}
+}
+
+// scrambleSpecForURL returns the scrambling of the site serving rawURL,
+// falling back to comicDaysScramble.
+func scrambleSpecForURL(rawURL string) ScrambleSpec {
+	if u, err := url.Parse(rawURL); err == nil {
+		host := u.Hostname()
+		for site, spec := range siteScrambleSpecs {
+			if host == site || strings.HasSuffix(host, "."+site) {
+				return spec
+			}
+		}
+	}
+	return comicDaysScramble
+}
+
+// ParseScrambleSpec parses a spec as given on the command line: "none",
+// "transpose" (the Comic Days default), or "COLSxROWS/MULTIPLE" optionally
+// followed by ":" and a comma-separated permutation. Without a permutation a
+// square grid is transposed.
+//
+//	4x4/8              a transposed 4x4 grid, cells multiples of 8 pixels
+//	2x1/16:1,0         two side-by-side cells swapped
+func ParseScrambleSpec(s string) (ScrambleSpec, error) {
+	switch s = strings.TrimSpace(s); s {
+	case "none":
+		return noScramble, nil
+	case "transpose":
+		return comicDaysScramble, nil
+	}
+
+	grid, permText, hasPerm := strings.Cut(s, ":")
+	size, multipleText, ok := strings.Cut(grid, "/")
+	if !ok {
+		return ScrambleSpec{}, fmt.Errorf("scramble spec %q: want none, transpose or COLSxROWS/MULTIPLE[:PERMUTATION]", s)
+	}
+	colsText, rowsText, ok := strings.Cut(size, "x")
+	if !ok {
+		return ScrambleSpec{}, fmt.Errorf("scramble spec %q: grid size must be written COLSxROWS", s)
+	}
+	cols, err1 := strconv.Atoi(colsText)
+	rows, err2 := strconv.Atoi(rowsText)
+	multiple, err3 := strconv.Atoi(multipleText)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return ScrambleSpec{}, fmt.Errorf("scramble spec %q: grid size and multiple must be numbers", s)
+	}
+
+	var spec ScrambleSpec
+	if hasPerm {
+		spec = ScrambleSpec{Name: s, Columns: cols, Rows: rows, Multiple: multiple}
+		for _, field := range strings.Split(permText, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil {
+				return ScrambleSpec{}, fmt.Errorf("scramble spec %q: invalid permutation entry %q", s, field)
+			}
+			spec.Permutation = append(spec.Permutation, n)
+		}
+	} else {
+		if cols != rows {
+			return ScrambleSpec{}, fmt.Errorf("scramble spec %q: a %dx%d grid needs an explicit permutation", s, cols, rows)
+		}
+		spec = transposeScramble(cols, multiple)
+	}
+	if err := spec.Validate(); err != nil {
+		return ScrambleSpec{}, err
+	}
+	return spec, nil
+}
+
+// Validate checks that the grid is sensible and Permutation moves every
+// cell to exactly one place.
+func (s ScrambleSpec) Validate() error {
+	if s.Columns < 1 || s.Rows < 1 || s.Columns > 64 || s.Rows > 64 {
+		return fmt.Errorf("scramble spec %q: grid must be between 1x1 and 64x64, got %dx%d", s.Name, s.Columns, s.Rows)
+	}
+	// Bounded so that Columns*Multiple cannot overflow in cellSize.
+	if s.Multiple < 1 || s.Multiple > 256 {
+		return fmt.Errorf("scramble spec %q: cell multiple must be between 1 and 256, got %d", s.Name, s.Multiple)
+	}
+	cells := s.Columns * s.Rows
+	if len(s.Permutation) != cells {
+		return fmt.Errorf("scramble spec %q: permutation has %d entries, the grid %d cells", s.Name, len(s.Permutation), cells)
+	}
+	seen := make([]bool, cells)
+	for _, p := range s.Permutation {
+		if p < 0 || p >= cells || seen[p] {
+			return fmt.Errorf("scramble spec %q: permutation must use every cell from 0 to %d exactly once", s.Name, cells-1)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+// IsIdentity reports whether the spec leaves every cell in place.
+func (s ScrambleSpec) IsIdentity() bool {
+	for i, p := range s.Permutation {
+		if p != i {
+			return false
+		}
+	}
+	return true
+}
+
+// isTranspose reports whether the spec is a square grid transposition.
+func (s ScrambleSpec) isTranspose() bool {
+	if s.Columns != s.Rows || s.Columns < 2 || len(s.Permutation) != s.Columns*s.Rows {
+		return false
+	}
+	n := s.Columns
+	for row := 0; row < n; row++ {
+		for col := 0; col < n; col++ {
+			if s.Permutation[row*n+col] != col*n+row {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// cellSize returns the size of one grid cell for a width x height image.
+// It is zero when the image is too small to hold a single cell.
+func (s ScrambleSpec) cellSize(width, height int) (int, int) {
+	return (width / (s.Columns * s.Multiple)) * s.Multiple, (height / (s.Rows * s.Multiple)) * s.Multiple
+}
+
+// String describes the spec for the UI.
+func (s ScrambleSpec) String() string {
+	if s.Columns == 0 {
+		return ""
+	}
+	if s.Name != "" {
+		return s.Name
+	}
+	return fmt.Sprintf("%dx%d/%d", s.Columns, s.Rows, s.Multiple)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestParseScrambleSpec(t *testing.T) {
+	spec, err := ParseScrambleSpec("4x4/8")
+	if err != nil {
+		t.Fatalf("ParseScrambleSpec returned error: %v", err)
+	}
+	if !reflect.DeepEqual(spec.Permutation, comicDaysScramble.Permutation) || spec.Multiple != 8 {
+		t.Fatalf("4x4/8 = %+v, want the Comic Days transpose", spec)
+	}
+	if !spec.isTranspose() {
+		t.Fatal("4x4/8 is not recognised as a transpose")
+	}
+
+	spec, err = ParseScrambleSpec("3x1/16:2,0,1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Columns != 3 || spec.Rows != 1 || spec.Multiple != 16 || !reflect.DeepEqual(spec.Permutation, []int{2, 0, 1}) {
+		t.Fatalf("3x1/16:2,0,1 = %+v", spec)
+	}
+
+	if spec, err := ParseScrambleSpec("none"); err != nil || !spec.IsIdentity() {
+		t.Fatalf("none = %+v, %v", spec, err)
+	}
+
+	for _, bad := range []string{"", "4x4", "4/8", "ax4/8", "3x2/8", "2x1/8:0,0", "2x1/8:0,1,2", "2x1/0:1,0", "2x1/8:1,x", "0x0/8:", "4x4/257", "4x4/4611686018427387904"} {
+		if _, err := ParseScrambleSpec(bad); err == nil {
+			t.Errorf("ParseScrambleSpec(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestScrambleSpecForURL(t *testing.T) {
+	spec := scrambleSpecForURL("https://cdn-img.comic-days.com/public/page/2/1.jpg")
+	if spec.Name != comicDaysScramble.Name {
+		t.Fatalf("spec = %v, want %v", spec, comicDaysScramble)
+	}
+}
+
+func TestDeobfuscateAppliesPermutation(t *testing.T) {
+	// Three 16px wide cells in a row plus a 5px margin, scrambled so the
+	// image shows cells in the order C, A, B.
+	colors := []color.RGBA{{R: 255, A: 255}, {G: 255, A: 255}, {B: 255, A: 255}}
+	margin := color.RGBA{R: 9, G: 9, B: 9, A: 255}
+	src := image.NewRGBA(image.Rect(0, 0, 53, 16))
+	for x := 0; x < 53; x++ {
+		for y := 0; y < 16; y++ {
+			c := margin
+			if x < 48 {
+				c = colors[[]int{2, 0, 1}[x/16]]
+			}
+			src.Set(x, y, c)
+		}
+	}
+	spec, err := ParseScrambleSpec("3x1/16:1,2,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := NewImageContext(src)
+	ip.Spec = spec
+	dst := ip.Deobfuscate(53, 16)
+	for cell, want := range colors {
+		if got := dst.RGBAAt(cell*16+8, 8); got != want {
+			t.Fatalf("cell %d = %v, want %v", cell, got, want)
+		}
+	}
+	if got := dst.RGBAAt(50, 8); got != margin {
+		t.Fatalf("margin = %v, want %v", got, margin)
+	}
+}
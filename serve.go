@@ -0,0 +1,375 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/pterm/pterm"
+)
+
+// thumbnailSize bounds the width and height of the library thumbnails.
+const thumbnailSize = 320
+
+//go:embed web
+var webAssets embed.FS
+
+func runServe(args []string) error {
+	flags := subcommandFlagSet("serve", "[flags]")
+	addr := flags.String("addr", "127.0.0.1:8080", "address to listen on")
+	cookieFile := flags.String("cookies", "cookie.json", "cookie file exported from the browser")
+	outRoot := flags.String("out", ".", "directory chapter folders are created in and browsed from")
+	template := flags.String("output-template", "", "lay out chapter folders and page names, e.g. {series}/{number:03} - {title}/{page:03}.{ext}")
+	imageFormatFlag := addImageFormatFlags(flags)
+	applyImageLimits := addImageLimitFlags(flags)
+	keepOriginal := addKeepOriginalFlag(flags)
+	dataDir := flags.String("data-dir", defaultDataDir(), "directory the library of downloaded episodes is kept in")
+	openCache := addCacheFlags(flags)
+	openProxies := addProxyFlags(flags)
+	transportOptions := addTransportFlags(flags)
+	applyRateLimit := addRateLimitFlags(flags)
+	openBreaker := addBreakerFlags(flags)
+	workers := flags.Int("jobs", 1, "number of chapters downloaded at the same time")
+	user := flags.String("user", "", "require HTTP basic auth with this user name (web UI and OPDS)")
+	password := flags.String("password", os.Getenv("COMICDAYS_PASSWORD"), "basic auth password (default $COMICDAYS_PASSWORD)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *user != "" && *password == "" {
+		return fmt.Errorf("-user requires a password (-password or $COMICDAYS_PASSWORD)")
+	}
+
+	if err := os.MkdirAll(*outRoot, 0o755); err != nil {
+		return fmt.Errorf("failed to create output directory: %v", err)
+	}
+	tmpl, err := parseTemplateFlag(*template)
+	if err != nil {
+		return err
+	}
+	imageFormat, err := imageFormatFlag()
+	if err != nil {
+		return err
+	}
+	if err := applyImageLimits(); err != nil {
+		return err
+	}
+	lib, err := OpenLibrary(*dataDir)
+	if err != nil {
+		return err
+	}
+	cache, err := openCache()
+	if err != nil {
+		return err
+	}
+	proxies, err := openProxies(*dataDir)
+	if err != nil {
+		return err
+	}
+	transport, err := transportOptions()
+	if err != nil {
+		return err
+	}
+	if err := applyRateLimit(); err != nil {
+		return err
+	}
+	breaker, err := openBreaker()
+	if err != nil {
+		return err
+	}
+	if breaker != nil {
+		breaker.OnChange = printBreakerEvent
+	}
+	cookies, err := NewFileCookieLoader(*cookieFile).Load()
+	reportCookieLoad(*cookieFile, cookies, err)
+
+	s := newServer(*outRoot, cookies, NewNetworkClient(transport).UseProxies(proxies).UseCircuitBreaker(breaker).UseCache(cache), *workers)
+	s.breaker = breaker
+	s.lib = lib
+	s.template = tmpl
+	s.format = imageFormat
+	s.keepOriginals = *keepOriginal
+	handler := s.routes()
+	if *user != "" {
+		handler = requireBasicAuth(*user, *password, handler)
+	}
+	pterm.Success.Printfln("🌐 Web UI listening on http://%s", *addr)
+	pterm.Info.Printfln("📚 OPDS catalog at http://%s/opds", *addr)
+	return http.ListenAndServe(*addr, handler)
+}
+
+// server is the web UI backend: a job queue for downloads plus read-only
+// access to the chapters already under root, both through the web UI's JSON
+// API and as an OPDS catalog (see opds.go).
+type server struct {
+	root     string
+	cookies  []Cookie
+	client   HTTPFetcher
+	lib      *Library
+	template *OutputTemplate
+	format   ImageFormat
+	// keepOriginals keeps the server's images next to the pages.
+	keepOriginals bool
+	events        *broker
+	queue         *jobQueue
+	// breaker, if set, is the client's circuit breaker. Once it gives up on
+	// the site, queued jobs fail at once; adding jobs gives the site another
+	// chance.
+	breaker *CircuitBreaker
+}
+
+func newServer(root string, cookies []Cookie, client HTTPFetcher, workers int) *server {
+	s := &server{root: root, cookies: cookies, client: client, events: newBroker()}
+	s.queue = newJobQueue(workers, s.events, s.downloadChapter)
+	return s
+}
+
+func (s *server) routes() http.Handler {
+	static, err := fs.Sub(webAssets, "web")
+	if err != nil {
+		panic(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(static))
+	mux.HandleFunc("GET /api/jobs", s.handleListJobs)
+	mux.HandleFunc("POST /api/jobs", s.handleCreateJobs)
+	mux.HandleFunc("GET /api/events", s.handleEvents)
+	mux.HandleFunc("GET /api/chapters", s.handleListChapters)
+	mux.HandleFunc("GET /api/chapters/{id}/thumbnail", s.handleThumbnail)
+	mux.HandleFunc("GET /api/chapters/{id}/pages/{page}", s.handlePage)
+	mux.HandleFunc("GET /opds", s.handleOPDSRoot)
+	mux.HandleFunc("GET /opds/series/{key}", s.handleOPDSSeries)
+	mux.HandleFunc("GET /opds/chapters/{id}/cbz", s.handleOPDSCBZ)
+	mux.HandleFunc("GET /opds/chapters/{id}/pages/{page}", s.handleOPDSPage)
+	return mux
+}
+
+// downloadChapter is the jobRunner behind the queue: the same fetch, parse
+// and per-page pipeline as a command-line run, narrated to the browser
+// instead of the terminal.
+func (s *server) downloadChapter(url string, rep *jobReporter) (string, error) {
+	doc, err := fetchComicHTML(url, s.cookies, s.client, rep.RetryObserver(0, "fetch"))
+	if err != nil {
+		return "", fmt.Errorf("could not load the page: %w", err)
+	}
+	episode, pages, err := loadEpisode(doc, url)
+	if err != nil {
+		return "", err
+	}
+	if entry, ok := s.lib.Has(episode); ok {
+		return s.relativeDir(entry.Path), &AlreadyDownloadedError{Entry: entry}
+	}
+	out, err := prepareChapterDir(s.root, s.template, s.format, episode, pages)
+	if err != nil {
+		return "", err
+	}
+	out.KeepOriginals = s.keepOriginals
+	rel := s.relativeDir(out.Dir)
+
+	rep.Begin(len(pages))
+	pterm.Info.Printfln("⬇️  %s — %d page(s) → %s", url, len(pages), out.Dir)
+	results, failed := downloadPages(pages, s.client, s.cookies, out, rep)
+	if err := finishChapter(s.lib, out, pages, results); err != nil {
+		pterm.Warning.Printfln("%s: %v", url, err)
+	}
+	if failed > 0 {
+		pterm.Warning.Printfln("%s: %d of %d page(s) failed", url, failed, len(pages))
+		return rel, fmt.Errorf("%d page(s) failed", failed)
+	}
+	pterm.Success.Printfln("%s: all %d page(s) saved to %s", url, len(pages), out.Dir)
+	return rel, nil
+}
+
+// relativeDir returns dir relative to the output root, or "" when it lies
+// outside of it (an episode downloaded elsewhere, for example).
+func (s *server) relativeDir(dir string) string {
+	absRoot, err := filepath.Abs(s.root)
+	if err != nil {
+		return ""
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(absRoot, absDir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return rel
+}
+
+func (s *server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.queue.Snapshot())
+}
+
+// handleCreateJobs queues every URL in the JSON body {"urls": [...]}. Only
+// JSON from the page's own origin is accepted: a form on another site can
+// post to localhost, but it cannot send JSON without the browser asking
+// first, and the browser names its origin.
+func (s *server) handleCreateJobs(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("requests from %s are not allowed", origin))
+			return
+		}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("the request body must be JSON"))
+		return
+	}
+	var body struct {
+		URLs []string `json:"urls"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %v", err))
+		return
+	}
+	urls := body.URLs
+	if len(urls) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no URLs were provided"))
+		return
+	}
+
+	// The user asking again is the cue to try a site the breaker gave up on.
+	if s.breaker.Err() != nil {
+		s.breaker.Reset()
+	}
+	queued := []job{}
+	var problems []string
+	for _, u := range urls {
+		j, err := s.queue.Add(u)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", u, err))
+			continue
+		}
+		queued = append(queued, j)
+	}
+	status := http.StatusAccepted
+	if len(queued) == 0 {
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, struct {
+		Jobs   []job    `json:"jobs"`
+		Errors []string `json:"errors,omitempty"`
+	}{queued, problems})
+}
+
+// handleEvents streams job updates as server-sent events. Each connection
+// first receives the full job list, then every change as it happens.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	events, unsubscribe := s.events.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	initial, err := json.Marshal(s.queue.Snapshot())
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: jobs\ndata: %s\n\n", initial)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-events:
+			if _, err := w.Write(msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// chapterJSON is how a LocalChapter is presented to the web UI.
+type chapterJSON struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Pages    int       `json:"pages"`
+	Modified time.Time `json:"modified"`
+}
+
+func (s *server) handleListChapters(w http.ResponseWriter, r *http.Request) {
+	chapters, err := scanChapters(s.root)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	list := make([]chapterJSON, 0, len(chapters))
+	for _, c := range chapters {
+		list = append(list, chapterJSON{ID: c.ID, Name: c.Title(), Pages: len(c.Pages), Modified: c.ModTime})
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *server) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	c, ok := findChapter(s.root, r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	img, err := imaging.Open(c.Path(s.root, c.Pages[0]))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	_ = jpeg.Encode(w, imaging.Fit(img, thumbnailSize, thumbnailSize, imaging.Lanczos), &jpeg.Options{Quality: 80})
+}
+
+// handlePage serves page n (1-based) of a chapter. Only files the chapter
+// scan recognised as pages can be reached, never arbitrary paths.
+func (s *server) handlePage(w http.ResponseWriter, r *http.Request) {
+	c, ok := findChapter(s.root, r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("page"))
+	if err != nil || n < 1 || n > len(c.Pages) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age=3600")
+	http.ServeFile(w, r, c.Path(s.root, c.Pages[n-1]))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
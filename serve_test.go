@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlePageServesOnlyChapterPages(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, filepath.Join(root, "chapter"), "001.png", "secret.json")
+	s := &server{root: root, events: newBroker()}
+	handler := s.routes()
+	id := chapterID("chapter")
+
+	for path, want := range map[string]int{
+		"/api/chapters/" + id + "/pages/1":   http.StatusOK,
+		"/api/chapters/" + id + "/pages/2":   http.StatusNotFound,
+		"/api/chapters/" + id + "/pages/0":   http.StatusNotFound,
+		"/api/chapters/" + id + "/pages/x.1": http.StatusNotFound,
+		"/api/chapters/unknown/pages/1":      http.StatusNotFound,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != want {
+			t.Errorf("GET %s = %d, want %d", path, rec.Code, want)
+		}
+	}
+}
+
+func TestCreateJobsRejectsUntrustedURLs(t *testing.T) {
+	s := &server{root: t.TempDir(), events: newBroker()}
+	s.queue = newJobQueue(1, s.events, func(string, *jobReporter) (string, error) {
+		t.Error("runner called for a rejected URL")
+		return "", nil
+	})
+
+	body := strings.NewReader(`{"urls": ["https://example.com/episode/1"]}`)
+	req := httptest.NewRequest("POST", "/api/jobs", body)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if jobs := s.queue.Snapshot(); len(jobs) != 0 {
+		t.Fatalf("queued %d job(s), want 0", len(jobs))
+	}
+}
+
+func TestCreateJobsGivesTheSiteAnotherChance(t *testing.T) {
+	b := &CircuitBreaker{Threshold: 1, CoolDown: time.Millisecond}
+	b.record(false, errors.New("HTTP 503"))
+	if probe, _ := b.acquire(context.Background()); !probe {
+		t.Fatal("no probe after the cool-down")
+	}
+	b.record(true, errors.New("HTTP 503"))
+	if b.Err() == nil {
+		t.Fatal("the breaker did not give up")
+	}
+
+	s := &server{root: t.TempDir(), events: newBroker(), breaker: b}
+	s.queue = newJobQueue(1, s.events, func(string, *jobReporter) (string, error) { return "", nil })
+	body := strings.NewReader(`{"urls": ["https://comic-days.com/episode/1"]}`)
+	req := httptest.NewRequest("POST", "/api/jobs", body)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusAccepted)
+	}
+	if err := b.Err(); err != nil {
+		t.Fatalf("the breaker still fails new jobs: %v", err)
+	}
+}
+
+func TestJobQueueTracksPageProgress(t *testing.T) {
+	events := newBroker()
+	updates, unsubscribe := events.Subscribe()
+	defer unsubscribe()
+
+	q := newJobQueue(1, events, func(url string, rep *jobReporter) (string, error) {
+		rep.Begin(2)
+		rep.PageSucceeded(pageResult{pageNum: 1, width: 1, height: 1})
+		rep.PageFailed(2, errors.New("broken"))
+		return "chapter", errors.New("1 page(s) failed")
+	})
+	if _, err := q.Add("comic-days.com/episode/1"); err != nil {
+		t.Fatalf("Add returned error: %v", err)
+	}
+
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case <-updates:
+		case <-deadline:
+			t.Fatal("job did not finish")
+		}
+		jobs := q.Snapshot()
+		if jobs[0].State != jobFailed {
+			continue
+		}
+		if got := []string{jobs[0].Pages[0].State, jobs[0].Pages[1].State}; got[0] != "done" || got[1] != "failed" {
+			t.Fatalf("page states = %v, want [done failed]", got)
+		}
+		if jobs[0].ChapterID != chapterID("chapter") {
+			t.Fatalf("ChapterID = %q, want the ID of the chapter folder", jobs[0].ChapterID)
+		}
+		return
+	}
+}
+
+func TestCreateJobsRejectsCrossSiteRequests(t *testing.T) {
+	s := &server{root: t.TempDir(), events: newBroker()}
+	s.queue = newJobQueue(1, s.events, func(string, *jobReporter) (string, error) {
+		t.Error("runner called for a cross-site request")
+		return "", nil
+	})
+
+	tests := []struct {
+		name, contentType, origin, body string
+		want                            int
+	}{
+		{"form post", "application/x-www-form-urlencoded", "", "urls=https://comic-days.com/episode/1", http.StatusUnsupportedMediaType},
+		{"plain text", "text/plain", "", `{"urls": ["https://comic-days.com/episode/1"]}`, http.StatusUnsupportedMediaType},
+		{"other origin", "application/json", "https://evil.example", `{"urls": ["https://comic-days.com/episode/1"]}`, http.StatusForbidden},
+		{"opaque origin", "application/json", "null", `{"urls": ["https://comic-days.com/episode/1"]}`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/api/jobs", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+	if jobs := s.queue.Snapshot(); len(jobs) != 0 {
+		t.Fatalf("queued %d job(s), want 0", len(jobs))
+	}
+}
+
+func TestCreateJobsAcceptsItsOwnOrigin(t *testing.T) {
+	s := &server{root: t.TempDir(), events: newBroker()}
+	done := make(chan struct{})
+	s.queue = newJobQueue(1, s.events, func(string, *jobReporter) (string, error) {
+		close(done)
+		return "", errors.New("not downloading in a test")
+	})
+
+	body := strings.NewReader(`{"urls": ["https://comic-days.com/episode/1"]}`)
+	req := httptest.NewRequest("POST", "http://127.0.0.1:8080/api/jobs", body)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Origin", "http://127.0.0.1:8080")
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusAccepted, rec.Body)
+	}
+	<-done
+}
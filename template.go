@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// An OutputTemplate lays out where chapters and their pages are saved, for
+// example "{series}/{number:03} - {title}/{page:03}.{ext}". Everything up
+// to the last slash names the chapter folder (relative to the output root);
+// the last element names each page file. Fields are written {name} or
+// {name:0N} to zero-pad numbers to N digits:
+//
+//	{series}    series title         {seriesId}  series ID
+//	{title}     episode title        {episode}   episode ID
+//	{number}    episode number       {date}      download date (YYYY-MM-DD)
+//	{page}      page number          {ext}       file extension
+//
+// Expanded values are sanitized so they are safe as file names on every
+// platform; the literal text of the template is used as written.
+type OutputTemplate struct {
+	raw  string
+	dirs [][]templatePart
+	page []templatePart
+}
+
+type templatePart struct {
+	literal string
+	field   string
+	width   int
+}
+
+var chapterTemplateFields = map[string]bool{
+	"series": true, "seriesId": true, "title": true, "episode": true, "number": true, "date": true,
+}
+
+// ParseOutputTemplate parses and validates a template.
+func ParseOutputTemplate(raw string) (*OutputTemplate, error) {
+	elems := strings.Split(filepath.ToSlash(raw), "/")
+	if len(elems) < 2 {
+		return nil, fmt.Errorf("output template %q must contain a chapter folder and a page file name, e.g. {series}/{title}/{page:03}.{ext}", raw)
+	}
+	t := &OutputTemplate{raw: raw}
+	for i, elem := range elems {
+		if elem == "" || elem == "." || elem == ".." {
+			return nil, fmt.Errorf("output template %q has an empty, . or .. path element", raw)
+		}
+		parts, err := parseTemplateElement(elem)
+		if err != nil {
+			return nil, fmt.Errorf("output template %q: %w", raw, err)
+		}
+		last := i == len(elems)-1
+		for _, p := range parts {
+			if p.field == "" {
+				continue
+			}
+			if !last && !chapterTemplateFields[p.field] {
+				return nil, fmt.Errorf("output template %q: {%s} can only be used in the page file name", raw, p.field)
+			}
+		}
+		if last {
+			if !hasField(parts, "page") {
+				return nil, fmt.Errorf("output template %q: the page file name must contain {page}", raw)
+			}
+			t.page = parts
+		} else {
+			t.dirs = append(t.dirs, parts)
+		}
+	}
+	return t, nil
+}
+
+func hasField(parts []templatePart, field string) bool {
+	for _, p := range parts {
+		if p.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTemplateElement(elem string) ([]templatePart, error) {
+	var parts []templatePart
+	for elem != "" {
+		open := strings.IndexByte(elem, '{')
+		if open < 0 {
+			if strings.ContainsRune(elem, '}') {
+				return nil, fmt.Errorf("unmatched }")
+			}
+			parts = append(parts, templatePart{literal: elem})
+			break
+		}
+		if open > 0 {
+			if strings.ContainsRune(elem[:open], '}') {
+				return nil, fmt.Errorf("unmatched }")
+			}
+			parts = append(parts, templatePart{literal: elem[:open]})
+		}
+		end := strings.IndexByte(elem[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unmatched {")
+		}
+		spec := elem[open+1 : open+end]
+		elem = elem[open+end+1:]
+
+		name, width, hasWidth := strings.Cut(spec, ":")
+		part := templatePart{field: name}
+		if !chapterTemplateFields[name] && name != "page" && name != "ext" {
+			return nil, fmt.Errorf("unknown field {%s}", name)
+		}
+		if hasWidth {
+			n, err := strconv.Atoi(width)
+			if err != nil || n < 1 || n > 9 {
+				return nil, fmt.Errorf("invalid width in {%s}", spec)
+			}
+			part.width = n
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// String returns the template as it was written.
+func (t *OutputTemplate) String() string { return t.raw }
+
+// ChapterDir expands the chapter folder for episode, relative to the output
+// root.
+func (t *OutputTemplate) ChapterDir(episode Episode, downloaded time.Time) string {
+	values := map[string]string{
+		"series":   episode.SeriesTitle,
+		"seriesId": episode.SeriesID,
+		"title":    episode.Title,
+		"episode":  episode.ID,
+		"date":     downloaded.Format("2006-01-02"),
+	}
+	if episode.Number > 0 {
+		values["number"] = strconv.Itoa(episode.Number)
+	}
+	elems := make([]string, len(t.dirs))
+	for i, parts := range t.dirs {
+		elems[i] = expandTemplate(parts, values)
+	}
+	return filepath.Join(elems...)
+}
+
+// PageFile expands the page file name for page pageNum.
+func (t *OutputTemplate) PageFile(pageNum int, ext string) string {
+	return expandTemplate(t.page, map[string]string{"page": strconv.Itoa(pageNum), "ext": ext})
+}
+
+func expandTemplate(parts []templatePart, values map[string]string) string {
+	var b strings.Builder
+	for _, p := range parts {
+		if p.field == "" {
+			b.WriteString(p.literal)
+			continue
+		}
+		v := values[p.field]
+		if p.width > 0 && v != "" && isDigits(v) && len(v) < p.width {
+			v = strings.Repeat("0", p.width-len(v)) + v
+		}
+		b.WriteString(sanitizeFileComponent(v))
+	}
+	return finishFileName(b.String())
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// fullwidthReplacements maps characters that are reserved in file names on
+// some platform to their full-width forms, which read naturally next to the
+// Japanese text of most titles.
+var fullwidthReplacements = map[rune]rune{
+	'/': '／', '\\': '＼', ':': '：', '*': '＊', '?': '？',
+	'"': '＂', '<': '＜', '>': '＞', '|': '｜',
+}
+
+// maxFileNameBytes keeps names safely below the 255 byte limit of common
+// file systems, leaving room for suffixes such as " (2)" or temp files.
+const maxFileNameBytes = 200
+
+// sanitizeFileComponent makes an expanded field value safe to use inside a
+// single path element: reserved characters become their full-width forms,
+// line breaks and tabs become spaces and other control characters are
+// dropped.
+func sanitizeFileComponent(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case fullwidthReplacements[r] != 0:
+			b.WriteRune(fullwidthReplacements[r])
+		case unicode.IsSpace(r):
+			b.WriteByte(' ')
+		case r == utf8.RuneError || unicode.IsControl(r):
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// windowsReservedNames cannot be used as file names on Windows, with or
+// without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// finishFileName applies the rules that concern a whole path element: no
+// leading or trailing spaces, no trailing dots (Windows drops them), no
+// reserved device names, a bounded length, and never empty.
+func finishFileName(name string) string {
+	name = strings.TrimSpace(name)
+	name = strings.TrimRight(name, ". ")
+	if len(name) > maxFileNameBytes {
+		cut := maxFileNameBytes
+		for cut > 0 && !utf8.RuneStart(name[cut]) {
+			cut--
+		}
+		name = strings.TrimRight(name[:cut], ". ")
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if windowsReservedNames[strings.ToUpper(base)] {
+		name = "_" + name
+	}
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
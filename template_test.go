@@ -0,0 +1,141 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputTemplateExpandsFields(t *testing.T) {
+	tmpl, err := ParseOutputTemplate("{series}/{number:03} - {title}/{page:03}.{ext}")
+	if err != nil {
+		t.Fatalf("ParseOutputTemplate returned error: %v", err)
+	}
+	episode := Episode{ID: "123", Title: "第7話", Number: 7, SeriesTitle: "ワンパンマン"}
+	downloaded := time.Date(2025, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	if got, want := tmpl.ChapterDir(episode, downloaded), filepath.Join("ワンパンマン", "007 - 第7話"); got != want {
+		t.Fatalf("ChapterDir = %q, want %q", got, want)
+	}
+	if got := tmpl.PageFile(12, "png"); got != "012.png" {
+		t.Fatalf("PageFile = %q, want 012.png", got)
+	}
+	if got := tmpl.PageFile(1000, "png"); got != "1000.png" {
+		t.Fatalf("PageFile = %q, want 1000.png", got)
+	}
+
+	dated, err := ParseOutputTemplate("{date} {episode}/p{page}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dated.ChapterDir(episode, downloaded); got != "2025-03-04 123" {
+		t.Fatalf("ChapterDir = %q, want %q", got, "2025-03-04 123")
+	}
+}
+
+func TestOutputTemplateSanitizesValues(t *testing.T) {
+	tmpl, err := ParseOutputTemplate("{series}/{title}/{page}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		episode Episode
+		want    string
+	}{
+		{"reserved characters", Episode{SeriesTitle: "A/B", Title: `Q: "why?" <1|2>`}, filepath.Join("A／B", "Q： ＂why？＂ ＜1｜2＞")},
+		{"traversal", Episode{SeriesTitle: "..", Title: "../x"}, filepath.Join("_", "..／x")},
+		{"trailing dots and spaces", Episode{SeriesTitle: " Series... ", Title: "end.\t"}, filepath.Join("Series", "end")},
+		{"reserved device name", Episode{SeriesTitle: "con", Title: "NUL.txt"}, filepath.Join("_con", "_NUL.txt")},
+		{"control characters", Episode{SeriesTitle: "a\x00b", Title: "c\nd"}, filepath.Join("ab", "c d")},
+		{"missing values", Episode{}, filepath.Join("_", "_")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tmpl.ChapterDir(tt.episode, time.Time{}); got != tt.want {
+				t.Fatalf("ChapterDir = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputTemplateShortensLongNames(t *testing.T) {
+	tmpl, err := ParseOutputTemplate("{title}/{page}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := tmpl.ChapterDir(Episode{Title: strings.Repeat("話", 100)}, time.Time{})
+	if len(got) > maxFileNameBytes || !strings.HasPrefix(got, "話") || strings.ContainsRune(got, '�') {
+		t.Fatalf("ChapterDir = %q (%d bytes), want a name of whole characters within %d bytes", got, len(got), maxFileNameBytes)
+	}
+}
+
+func TestParseOutputTemplateRejectsInvalidTemplates(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"{page}.{ext}",
+		"{series}/",
+		"/{series}/{page}.{ext}",
+		"{series}/../{page}.{ext}",
+		"{series}/{title}.{ext}",
+		"{page}/{page}.{ext}",
+		"{series}/{bogus}/{page}.{ext}",
+		"{series/{page}.{ext}",
+		"series}/{page}.{ext}",
+		"{number:x}/{page}.{ext}",
+	} {
+		if _, err := ParseOutputTemplate(raw); err == nil {
+			t.Errorf("ParseOutputTemplate(%q) succeeded, want an error", raw)
+		}
+	}
+}
+
+func TestPrepareChapterDirAvoidsOtherEpisodesFolders(t *testing.T) {
+	root := t.TempDir()
+	tmpl, err := ParseOutputTemplate("{series}/{title}/{page:03}.{ext}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := []Page{NewPage("", 1, 1)}
+	first := Episode{ID: "1", SeriesTitle: "S", Title: "Extra"}
+	second := Episode{ID: "2", SeriesTitle: "S", Title: "Extra"}
+
+	a, err := prepareChapterDir(root, tmpl, ImageFormat{}, first, pages)
+	if err != nil {
+		t.Fatalf("prepareChapterDir returned error: %v", err)
+	}
+	b, err := prepareChapterDir(root, tmpl, ImageFormat{}, second, pages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := prepareChapterDir(root, tmpl, ImageFormat{}, first, pages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Dir != filepath.Join(root, "S", "Extra") || b.Dir != filepath.Join(root, "S", "Extra (2)") {
+		t.Fatalf("dirs = %q, %q", a.Dir, b.Dir)
+	}
+	if again.Dir != a.Dir {
+		t.Fatalf("re-downloading an episode used %q, want its existing folder %q", again.Dir, a.Dir)
+	}
+	if got := b.PageFile(1); got != "001.png" {
+		t.Fatalf("PageFile = %q, want 001.png", got)
+	}
+
+	chapters, err := scanChapters(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chapters) != 0 {
+		t.Fatalf("found %d chapters before any page was saved, want 0", len(chapters))
+	}
+	writeTestFiles(t, b.Dir, "001.png")
+	chapters, err = scanChapters(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chapters) != 1 || chapters[0].Dir != filepath.Join("S", "Extra (2)") {
+		t.Fatalf("chapters = %+v, want the nested chapter", chapters)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// TransportOptions tunes how a NetworkClient talks to the site. Instead of a
+// single deadline for a whole request, every step has its own timeout, so an
+// image that keeps arriving over a slow link is never cut off while a
+// connection that stops making progress is.
+type TransportOptions struct {
+	// DialTimeout bounds opening a connection (to the proxy, if there is
+	// one), and TLSTimeout the TLS handshake that follows.
+	DialTimeout time.Duration
+	TLSTimeout  time.Duration
+	// HeaderTimeout bounds the wait for the response headers once the
+	// request has been sent.
+	HeaderTimeout time.Duration
+	// StallTimeout is how long a response body may go without delivering a
+	// single byte before it is abandoned.
+	StallTimeout time.Duration
+	// MaxIdleConnsPerHost is how many kept-alive connections to each host
+	// are kept for reuse; it should cover the downloads running at once.
+	MaxIdleConnsPerHost int
+	// HTTPVersion is "auto", "1.1" or "2".
+	HTTPVersion string
+}
+
+var defaultTransportOptions = TransportOptions{
+	DialTimeout:         15 * time.Second,
+	TLSTimeout:          15 * time.Second,
+	HeaderTimeout:       30 * time.Second,
+	StallTimeout:        30 * time.Second,
+	MaxIdleConnsPerHost: 16,
+	HTTPVersion:         "auto",
+}
+
+// addTransportFlags registers the flags that tune the HTTP transport and
+// returns a function that checks them once the flag set has been parsed.
+func addTransportFlags(flags *flag.FlagSet) func() (TransportOptions, error) {
+	d := defaultTransportOptions
+	connect := flags.Duration("connect-timeout", d.DialTimeout, "give up connecting (and the TLS handshake) after this long")
+	header := flags.Duration("response-timeout", d.HeaderTimeout, "give up on a request when the server has not started answering after this long")
+	stall := flags.Duration("stall-timeout", d.StallTimeout, "give up on a download that has received nothing for this long")
+	version := flags.String("http", d.HTTPVersion, "HTTP version to use: auto, 1.1 or 2")
+	return func() (TransportOptions, error) {
+		opts := d
+		for name, v := range map[string]time.Duration{"connect-timeout": *connect, "response-timeout": *header, "stall-timeout": *stall} {
+			if v <= 0 {
+				return TransportOptions{}, fmt.Errorf("-%s must be positive, got %v", name, v)
+			}
+		}
+		opts.DialTimeout, opts.TLSTimeout = *connect, *connect
+		opts.HeaderTimeout = *header
+		opts.StallTimeout = *stall
+		switch *version {
+		case "auto", "1.1", "2":
+			opts.HTTPVersion = *version
+		default:
+			return TransportOptions{}, fmt.Errorf("unknown -http version %q (want auto, 1.1 or 2)", *version)
+		}
+		return opts, nil
+	}
+}
+
+// newTransport builds the HTTP transport described by opts. HTTP/2 is
+// negotiated over TLS, so -http 2 only works for https URLs.
+func newTransport(opts TransportOptions) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	t.TLSHandshakeTimeout = opts.TLSTimeout
+	t.ResponseHeaderTimeout = opts.HeaderTimeout
+	t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	if t.MaxIdleConns < opts.MaxIdleConnsPerHost {
+		t.MaxIdleConns = opts.MaxIdleConnsPerHost
+	}
+	switch opts.HTTPVersion {
+	case "1.1":
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP1(true)
+	case "2":
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+	}
+	return t
+}
+
+// stallReader abandons a response body that stops arriving: when no data
+// has been read for timeout, it cancels the request, which makes the
+// pending Read fail.
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+// watchStalls wraps body, whose request is canceled by cancel, in a
+// stallReader. Closing the result releases the request's context.
+func watchStalls(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *stallReader {
+	r := &stallReader{body: body, timeout: timeout, cancel: cancel}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.stalled.Store(true)
+		cancel()
+	})
+	return r
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.timer.Reset(r.timeout)
+	}
+	if err != nil && err != io.EOF && r.stalled.Load() {
+		err = fmt.Errorf("download stalled: nothing received for %v", r.timeout)
+	}
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	err := r.body.Close()
+	r.cancel()
+	return err
+}
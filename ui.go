@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pterm/pterm"
@@ -132,16 +133,16 @@ func fatal(err error) {
 // Stage 1 — initialization helpers
 // ---------------------------------------------------------------------------
 
-// reportCookieLoad prints whether cookie.json was loaded successfully. A
+// reportCookieLoad prints whether the cookie file was loaded successfully. A
 // missing/broken cookie file is not fatal — the download simply continues
 // unauthenticated — so this only ever warns, never fails.
-func reportCookieLoad(cookies []Cookie, err error) {
+func reportCookieLoad(cookieFile string, cookies []Cookie, err error) {
 	if err != nil {
 		pterm.Warning.Printfln("🍪 Cookies not loaded: %v", err)
 		pterm.Warning.Println("   Continuing without authentication — purchased/members-only chapters will fail.")
 		return
 	}
-	pterm.Success.Printfln("🍪 Loaded %d cookie(s) from cookie.json", len(cookies))
+	pterm.Success.Printfln("🍪 Loaded %d cookie(s) from %s", len(cookies), cookieFile)
 }
 
 // printURLPrompt prints a styled prompt on the current line (no newline), so
@@ -150,15 +151,24 @@ func printURLPrompt() {
 	pterm.Print(pterm.LightCyan("🔗 Manga URL ") + pterm.Gray("(comic-days.com/episode/...): "))
 }
 
+// animateSpinners turns on the spinners' animation. The tests turn it off:
+// pterm animates a spinner in a goroutine that reads its text without
+// locking, so every UpdateText is a data race under -race.
+var animateSpinners = true
+
 // newSpinner starts a spinner using a smoother animation than pterm's
 // default, with its own timer disabled — callers that care about timing
 // report it explicitly once an operation completes.
 func newSpinner(text string) *pterm.SpinnerPrinter {
-	sp, _ := pterm.DefaultSpinner.
+	sp := pterm.DefaultSpinner.
 		WithSequence(spinnerFrames...).
 		WithDelay(90 * time.Millisecond).
-		WithShowTimer(false).
-		Start(text)
+		WithShowTimer(false)
+	if !animateSpinners {
+		// Never started, it prints each update once and nothing else.
+		return sp.WithText(text)
+	}
+	sp, _ = sp.Start(text)
 	return sp
 }
 
@@ -175,13 +185,29 @@ func spinnerRetryObserver(sp *pterm.SpinnerPrinter, label string) RetryObserver
 	}
 }
 
+// printBreakerEvent narrates the circuit breaker (see breaker.go) as
+// permanent lines, which pterm prints above whatever spinner is running.
+func printBreakerEvent(e BreakerEvent) {
+	switch e.State {
+	case breakerOpen:
+		pterm.Warning.Printfln("⚡ %d requests in a row failed (last: %v) — pausing all downloads for %v", e.Failures, e.Err, e.CoolDown)
+	case breakerProbing:
+		pterm.Info.Println("🔌 Checking whether the site is back with a single request...")
+	case breakerClosed:
+		pterm.Success.Println("The site is answering again — resuming")
+	case breakerBroken:
+		pterm.Error.Printfln("The site is still failing (%v) — stopping", e.Err)
+	}
+}
+
 // printSessionSummary renders a small info table once the chapter page has
 // been parsed, right before the download pipeline starts.
-func printSessionSummary(pageCount int, outDir string, cookieCount int) {
+func printSessionSummary(pageCount int, outDir string, cookieCount int, proxy string) {
 	rows := [][]string{
 		{"Property", "Value"},
 		{"Pages found", strconv.Itoa(pageCount)},
 		{"Cookies loaded", strconv.Itoa(cookieCount)},
+		{"Proxy", proxy},
 		{"Output directory", outDir},
 	}
 	pterm.DefaultTable.WithHasHeader().WithData(rows).WithBoxed().Render()
@@ -192,33 +218,47 @@ func printSessionSummary(pageCount int, outDir string, cookieCount int) {
 // ---------------------------------------------------------------------------
 
 // printDeobfuscationLegend draws a side-by-side "before / after" diagram of
-// Comic Days' grid-transpose scrambling, generated straight from the
-// divideNum constant in imageprocessor.go so it can never drift out of sync
-// with the real algorithm. Cells that swap places share a color; the
-// untouched diagonal is grayed out.
-func printDeobfuscationLegend() {
+// the scrambling described by spec, generated straight from the spec the
+// pages are restored with so it can never drift out of sync with the real
+// algorithm. Cells that trade places share a color; cells that never move
+// are grayed out.
+func printDeobfuscationLegend(spec ScrambleSpec) {
 	palette := []pterm.Color{
 		pterm.FgLightCyan, pterm.FgLightMagenta, pterm.FgLightYellow,
 		pterm.FgLightGreen, pterm.FgLightRed, pterm.FgLightBlue,
 	}
 
+	// Color the cells by the cycle of the permutation they belong to: the
+	// cells of one cycle rotate into each other's places.
+	cycle := make([]int, len(spec.Permutation))
+	for i := range cycle {
+		cycle[i] = -1
+	}
+	cycles := 0
+	for i := range spec.Permutation {
+		if cycle[i] >= 0 || spec.Permutation[i] == i {
+			continue
+		}
+		for j := i; cycle[j] < 0; j = spec.Permutation[j] {
+			cycle[j] = cycles
+		}
+		cycles++
+	}
 	styleFor := func(r, c int) *pterm.Style {
-		if r == c {
+		n := cycle[r*spec.Columns+c]
+		if n < 0 {
 			return pterm.NewStyle(pterm.FgGray)
 		}
-		lo, hi := r, c
-		if lo > hi {
-			lo, hi = hi, lo
-		}
-		return pterm.NewStyle(palette[(lo*divideNum+hi)%len(palette)], pterm.Bold)
+		return pterm.NewStyle(palette[n%len(palette)], pterm.Bold)
 	}
 
-	received := renderGrid(divideNum, func(r, c int) string {
+	received := renderGrid(spec.Rows, spec.Columns, func(r, c int) string {
 		return fmt.Sprintf("R%dC%d", r, c)
 	}, styleFor)
 
-	restored := renderGrid(divideNum, func(r, c int) string {
-		return fmt.Sprintf("R%dC%d", c, r) // transpose: (r,c) <- (c,r)
+	restored := renderGrid(spec.Rows, spec.Columns, func(r, c int) string {
+		from := spec.Permutation[r*spec.Columns+c] // cell (r,c) <- cell from
+		return fmt.Sprintf("R%dC%d", from/spec.Columns, from%spec.Columns)
 	}, styleFor)
 
 	leftBox := pterm.DefaultBox.WithTitle(pterm.LightRed("① received (scrambled)")).WithTitleTopCenter().Sprint(received)
@@ -228,12 +268,25 @@ func printDeobfuscationLegend() {
 		{{Data: leftBox}, {Data: rightBox}},
 	}).Srender()
 
-	explanation := fmt.Sprintf(
-		"Comic Days splits every page into a %[1]dx%[1]d grid and swaps cell (row,col)\n"+
-			"with cell (col,row) before serving it. Same-colored cells below are swapped\n"+
-			"with each other to undo it; gray cells sit on the diagonal and never move.\n",
-		divideNum,
-	)
+	var explanation string
+	switch {
+	case spec.isTranspose():
+		explanation = fmt.Sprintf(
+			"Comic Days splits every page into a %[1]dx%[1]d grid and swaps cell (row,col)\n"+
+				"with cell (col,row) before serving it. Same-colored cells below are swapped\n"+
+				"with each other to undo it; gray cells sit on the diagonal and never move.\n",
+			spec.Columns,
+		)
+	case spec.IsIdentity():
+		explanation = "These pages are served unscrambled, so they are saved as they are.\n"
+	default:
+		explanation = fmt.Sprintf(
+			"Pages are split into a %dx%d grid whose cells are shuffled before being\n"+
+				"served. Same-colored cells below trade places to undo it; gray cells\n"+
+				"never move.\n",
+			spec.Columns, spec.Rows,
+		)
+	}
 
 	body := explanation
 	if err == nil {
@@ -248,12 +301,12 @@ func printDeobfuscationLegend() {
 		Println(body)
 }
 
-// renderGrid draws a divide x divide box-drawing grid, one cell per (row,
-// col), using label() for its text and styleFor() (optional) for its color.
-func renderGrid(divide int, label func(r, c int) string, styleFor func(r, c int) *pterm.Style) string {
+// renderGrid draws a rows x cols box-drawing grid, one cell per (row, col),
+// using label() for its text and styleFor() (optional) for its color.
+func renderGrid(rows, cols int, label func(r, c int) string, styleFor func(r, c int) *pterm.Style) string {
 	cellWidth := 0
-	for r := 0; r < divide; r++ {
-		for c := 0; c < divide; c++ {
+	for r := 0; r < rows; r++ {
+		for c := 0; c < cols; c++ {
 			if l := len([]rune(label(r, c))); l > cellWidth {
 				cellWidth = l
 			}
@@ -262,22 +315,22 @@ func renderGrid(divide int, label func(r, c int) string, styleFor func(r, c int)
 	cellWidth += 2
 
 	hBar := strings.Repeat("─", cellWidth)
-	top := "┌" + strings.Repeat(hBar+"┬", divide-1) + hBar + "┐"
-	mid := "├" + strings.Repeat(hBar+"┼", divide-1) + hBar + "┤"
-	bot := "└" + strings.Repeat(hBar+"┴", divide-1) + hBar + "┘"
+	top := "┌" + strings.Repeat(hBar+"┬", cols-1) + hBar + "┐"
+	mid := "├" + strings.Repeat(hBar+"┼", cols-1) + hBar + "┤"
+	bot := "└" + strings.Repeat(hBar+"┴", cols-1) + hBar + "┘"
 
 	var b strings.Builder
 	b.WriteString(top)
-	for r := 0; r < divide; r++ {
+	for r := 0; r < rows; r++ {
 		b.WriteString("\n│")
-		for c := 0; c < divide; c++ {
+		for c := 0; c < cols; c++ {
 			cell := centerText(label(r, c), cellWidth)
 			if styleFor != nil {
 				cell = styleFor(r, c).Sprint(cell)
 			}
 			b.WriteString(cell + "│")
 		}
-		if r != divide-1 {
+		if r != rows-1 {
 			b.WriteString("\n" + mid)
 		}
 	}
@@ -302,6 +355,12 @@ func centerText(s string, width int) string {
 type pageResult struct {
 	pageNum       int
 	width, height int
+	file          string
+	format        string
+	scramble      scrambleDetection
+	sha256        string
+	// original is the kept copy of the server's image, if any.
+	original      *ManifestOriginal
 	downloadBytes int64
 	savedBytes    int64
 	elapsed       time.Duration
@@ -317,10 +376,19 @@ type pageResult struct {
 // those per-page lines twice. A single spinner with a bar baked into its
 // text gets the same visual result without that pitfall.
 type Pipeline struct {
+	// mu guards everything below: pages are encoded in the background while
+	// the next one downloads, so reports arrive from several goroutines.
+	mu sync.Mutex
+
 	total   int
 	done    int
 	spinner *pterm.SpinnerPrinter
 	start   time.Time
+	// page and status are what the line last said, so the throughput on it
+	// can be kept current while a page downloads.
+	page   int
+	status string
+	stop   chan struct{}
 
 	okCount, failCount             int
 	totalDownloadBytes, totalSaved int64
@@ -331,11 +399,29 @@ const barWidth = 24
 
 // StartPipeline begins tracking `total` pages.
 func StartPipeline(total int) *Pipeline {
-	pl := &Pipeline{total: total, start: time.Now()}
-	pl.spinner = newSpinner(pl.render(0, "warming up..."))
+	pl := &Pipeline{total: total, start: time.Now(), status: "warming up...", stop: make(chan struct{})}
+	pl.spinner = newSpinner(pl.render(0, pl.status))
+	go pl.refresh()
 	return pl
 }
 
+// refresh redraws the line twice a second until Finish, so the throughput
+// it shows stays current during a long download.
+func (pl *Pipeline) refresh() {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pl.stop:
+			return
+		case <-ticker.C:
+			pl.mu.Lock()
+			pl.spinner.UpdateText(pl.render(pl.page, pl.status))
+			pl.mu.Unlock()
+		}
+	}
+}
+
 // progressBar renders a filled/empty block bar for current out of total.
 func progressBar(current, total, width int) string {
 	if total <= 0 {
@@ -348,22 +434,30 @@ func progressBar(current, total, width int) string {
 	return pterm.LightCyan(strings.Repeat("█", filled)) + pterm.Gray(strings.Repeat("░", width-filled))
 }
 
-// render composes the bar, percentage, page counter and status text into the
-// single line shown by the spinner.
+// render composes the bar, percentage, download speed, page counter and
+// status text into the single line shown by the spinner. It remembers
+// pageNum and status for refresh; pl.mu must be held.
 func (pl *Pipeline) render(pageNum int, status string) string {
+	pl.page, pl.status = pageNum, status
 	pct := 0
 	if pl.total > 0 {
 		pct = pl.done * 100 / pl.total
 	}
 	bar := progressBar(pl.done, pl.total, barWidth)
+	line := fmt.Sprintf("%s %3d%%", bar, pct)
+	if rate := describeThroughput(downloadRate); rate != "" {
+		line += "  " + rate
+	}
 	if pageNum <= 0 {
-		return fmt.Sprintf("%s %3d%%  %s", bar, pct, status)
+		return fmt.Sprintf("%s  %s", line, status)
 	}
-	return fmt.Sprintf("%s %3d%%  page %d/%d · %s", bar, pct, pageNum, pl.total, status)
+	return fmt.Sprintf("%s  page %d/%d · %s", line, pageNum, pl.total, status)
 }
 
 // Status updates the spinner for the page currently being processed.
 func (pl *Pipeline) Status(pageNum int, format string, a ...any) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
 	pl.spinner.UpdateText(pl.render(pageNum, fmt.Sprintf(format, a...)))
 }
 
@@ -371,6 +465,8 @@ func (pl *Pipeline) Status(pageNum int, format string, a ...any) {
 // through the pipeline's spinner instead of printing new lines.
 func (pl *Pipeline) RetryObserver(pageNum int, phase string) RetryObserver {
 	return func(attempt, maxAttempts int, err error, delay time.Duration) {
+		pl.mu.Lock()
+		defer pl.mu.Unlock()
 		if delay <= 0 {
 			pl.spinner.UpdateText(pl.render(pageNum, fmt.Sprintf("%s timed out: %v", phase, err)))
 			return
@@ -384,20 +480,50 @@ func (pl *Pipeline) RetryObserver(pageNum int, phase string) RetryObserver {
 // PageSucceeded logs a permanent success line for a page and advances the
 // hand-drawn progress bar.
 func (pl *Pipeline) PageSucceeded(r pageResult) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
 	pl.okCount++
 	pl.done++
 	pl.totalDownloadBytes += r.downloadBytes
 	pl.totalSaved += r.savedBytes
 	pterm.Success.Printfln(
-		"[%d/%d] %03d.png saved · %dx%d · %s → %s PNG · %v",
-		r.pageNum, pl.total, r.pageNum, r.width, r.height,
-		humanBytes(r.downloadBytes), humanBytes(r.savedBytes), r.elapsed.Round(time.Millisecond),
+		"[%d/%d] %s saved · %dx%d · %s · %s → %s %s · %v",
+		r.pageNum, pl.total, r.file, r.width, r.height, r.scramble.Describe(),
+		humanBytes(r.downloadBytes), humanBytes(r.savedBytes), r.format, r.elapsed.Round(time.Millisecond),
 	)
+	if !r.scramble.Certain {
+		pterm.Warning.Printfln("[%d/%d] could not tell how %s was scrambled — check that it looks right", r.pageNum, pl.total, r.file)
+	}
+}
+
+// AlreadySaved counts n pages an earlier, resumed download saved as done,
+// so the bar and the totals cover the whole chapter.
+func (pl *Pipeline) AlreadySaved(n int) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.okCount += n
+	pl.done += n
+}
+
+// SkipPages logs a single line for pages the run gave up on without trying
+// them, and counts them as failed.
+func (pl *Pipeline) SkipPages(pageNums []int, err error) {
+	if len(pageNums) == 0 {
+		return
+	}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.failCount += len(pageNums)
+	pl.done += len(pageNums)
+	first, last := pageNums[0], pageNums[len(pageNums)-1]
+	pterm.Error.Printfln("[%d-%d/%d] skipped: %v", first, last, pl.total, err)
 }
 
 // PageFailed logs a permanent failure line for a page and advances the
 // hand-drawn progress bar (a failed page still counts as "handled").
 func (pl *Pipeline) PageFailed(pageNum int, err error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
 	pl.failCount++
 	pl.done++
 	pterm.Error.Printfln("[%d/%d] giving up: %v", pageNum, pl.total, err)
@@ -405,6 +531,9 @@ func (pl *Pipeline) PageFailed(pageNum int, err error) {
 
 // Finish stops the spinner and returns the run's statistics.
 func (pl *Pipeline) Finish(outDir string) RunStats {
+	close(pl.stop)
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
 	if pl.failCount == 0 {
 		pl.spinner.Success(fmt.Sprintf("All %d page(s) processed", pl.total))
 	} else {
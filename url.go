@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -9,6 +10,23 @@ import (
 
 const comicDaysHost = "comic-days.com"
 
+// defaultSiteURL is the site the downloader talks to.
+const defaultSiteURL = "https://" + comicDaysHost
+
+// siteURL is the site every chapter and page image URL must belong to (its
+// subdomains, which serve the images, included). The program only ever
+// talks to defaultSiteURL; the end-to-end tests point it at their fake site
+// with useSiteURL (see fakesite_test.go).
+var siteURL = mustParseSiteURL(defaultSiteURL)
+
+func mustParseSiteURL(raw string) *url.URL {
+	u, err := url.Parse(raw)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
 func normalizeComicDaysURL(raw string) (string, error) {
 	return normalizeTrustedHTTPSURL(raw, "URL")
 }
@@ -23,31 +41,38 @@ func normalizeTrustedHTTPSURL(raw, label string) (string, error) {
 		return "", fmt.Errorf("%s is empty", label)
 	}
 	if strings.HasPrefix(raw, "//") {
-		raw = "https:" + raw
+		raw = siteURL.Scheme + ":" + raw
 	} else if !strings.Contains(raw, "://") {
-		raw = "https://" + raw
+		raw = siteURL.Scheme + "://" + raw
 	}
 
 	u, err := url.Parse(raw)
 	if err != nil {
 		return "", fmt.Errorf("invalid %s: %w", label, err)
 	}
-	if u.Scheme != "https" {
-		return "", fmt.Errorf("%s must use https", label)
+	if u.Scheme != siteURL.Scheme {
+		return "", fmt.Errorf("%s must use %s", label, siteURL.Scheme)
 	}
 	if !isComicDaysHost(u.Hostname()) {
-		return "", fmt.Errorf("%s host must be %s or its subdomain", label, comicDaysHost)
+		return "", fmt.Errorf("%s host must be %s or its subdomain", label, siteURL.Hostname())
 	}
 	if u.Path == "" || u.Path == "/" {
 		return "", fmt.Errorf("%s must include a path", label)
 	}
+	// Spell the host one way only, so a trusted URL always looks trusted.
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if port := u.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	u.Host = host
 	u.Fragment = ""
 	return u.String(), nil
 }
 
 func isComicDaysHost(host string) bool {
+	site := strings.ToLower(siteURL.Hostname())
 	host = strings.TrimSuffix(strings.ToLower(host), ".")
-	return host == comicDaysHost || strings.HasSuffix(host, "."+comicDaysHost)
+	return host == site || strings.HasSuffix(host, "."+site)
 }
 
 func addCookies(req *http.Request, cookies []Cookie) {
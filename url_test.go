@@ -2,6 +2,8 @@ package main
 
 import (
 	"net/http"
+	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -43,3 +45,69 @@ func TestAddCookiesOnlyForComicDaysHosts(t *testing.T) {
 		t.Fatalf("unexpected cookies on untrusted host: %q", got)
 	}
 }
+
+// FuzzNormalizeTrustedHTTPSURL checks the property cookies depend on: any URL
+// normalizeTrustedHTTPSURL accepts is https on a Comic Days host, and stays
+// so when it is parsed again, as net/http does before sending a request.
+func FuzzNormalizeTrustedHTTPSURL(f *testing.F) {
+	for _, seed := range []string{
+		"https://comic-days.com/episode/3269754496306260262",
+		"comic-days.com/episode/123#ignored",
+		"//cdn-img.comic-days.com/public/page/2/3269754496306260263-0a1b2c3d4e5f",
+		"https://cdn-img.comic-days.com/public/page/2/1?width=822",
+		"  https://COMIC-DAYS.COM./episode/1  ",
+		"https://comic-days.com:443/episode/1",
+		"http://comic-days.com/episode/1",
+		"https://example.com/episode/1",
+		"https://comic-days.com.example.com/episode/1",
+		"https://evilcomic-days.com/episode/1",
+		"https://comic-days.com@example.com/episode/1",
+		"https://example.com\\@comic-days.com/episode/1",
+		"https://example.com#@comic-days.com/episode/1",
+		"https://[::1]/episode/1",
+		"https://comic-days.com",
+		"javascript:alert(1)//comic-days.com/x",
+		"",
+	} {
+		f.Add(seed)
+	}
+
+	// Another test must not leave the fake site in place.
+	if err := useSiteURL(""); err != nil {
+		f.Fatal(err)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		got, err := normalizeTrustedHTTPSURL(raw, "URL")
+		if err != nil {
+			return
+		}
+		u, err := url.Parse(got)
+		if err != nil {
+			t.Fatalf("normalized %q to %q, which does not parse: %v", raw, got, err)
+		}
+		if u.Scheme != "https" {
+			t.Fatalf("normalized %q to %q with scheme %q", raw, got, u.Scheme)
+		}
+		// Checked independently of isComicDaysHost, which the code under
+		// test relies on.
+		if host := strings.ToLower(u.Hostname()); host != "comic-days.com" && !strings.HasSuffix(host, ".comic-days.com") {
+			t.Fatalf("normalized %q to %q on untrusted host %q", raw, got, u.Hostname())
+		}
+		if u.Fragment != "" {
+			t.Fatalf("normalized %q to %q, which keeps a fragment", raw, got)
+		}
+		again, err := normalizeTrustedHTTPSURL(got, "URL")
+		if err != nil || again != got {
+			t.Fatalf("normalizing %q again gave %q, %v", got, again, err)
+		}
+
+		req, err := http.NewRequest("GET", got, nil)
+		if err != nil {
+			t.Fatalf("http.NewRequest(%q): %v", got, err)
+		}
+		addCookies(req, []Cookie{{Name: "session", Value: "secret"}})
+		if req.Header.Get("Cookie") == "" {
+			t.Fatalf("no cookies added for trusted URL %q", got)
+		}
+	})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/imaging"
+	"github.com/pterm/pterm"
+)
+
+func runVerify(args []string) error {
+	flags := subcommandFlagSet("verify", "[flags] [dir...]")
+	dataDir := flags.String("data-dir", defaultDataDir(), "directory the library of downloaded episodes is kept in")
+	openCache := addCacheFlags(flags)
+	openProxies := addProxyFlags(flags)
+	transportOptions := addTransportFlags(flags)
+	applyRateLimit := addRateLimitFlags(flags)
+	openBreaker := addBreakerFlags(flags)
+	repair := flags.Bool("repair", false, "re-download broken or missing pages")
+	cookieFile := flags.String("cookies", "cookie.json", "cookie file used when repairing")
+	applyImageLimits := addImageLimitFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := applyImageLimits(); err != nil {
+		return err
+	}
+
+	lib, err := OpenLibrary(*dataDir)
+	if err != nil {
+		return err
+	}
+	cache, err := openCache()
+	if err != nil {
+		return err
+	}
+	proxies, err := openProxies(*dataDir)
+	if err != nil {
+		return err
+	}
+	transport, err := transportOptions()
+	if err != nil {
+		return err
+	}
+	if err := applyRateLimit(); err != nil {
+		return err
+	}
+	breaker, err := openBreaker()
+	if err != nil {
+		return err
+	}
+	if breaker != nil {
+		breaker.OnChange = printBreakerEvent
+	}
+
+	// Without arguments the whole library is checked; otherwise every
+	// argument is a chapter folder or a folder of chapters.
+	var dirs []string
+	if flags.NArg() == 0 {
+		for _, e := range lib.Entries() {
+			dirs = append(dirs, e.Path)
+		}
+		if len(dirs) == 0 {
+			pterm.Info.Println("The library is empty — pass a directory to verify instead.")
+			return nil
+		}
+	} else {
+		for _, arg := range flags.Args() {
+			found, err := findChapterDirs(arg)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, found...)
+		}
+	}
+
+	var repairer *pageRepairer
+	if *repair {
+		cookies, err := NewFileCookieLoader(*cookieFile).Load()
+		reportCookieLoad(*cookieFile, cookies, err)
+		repairer = &pageRepairer{client: NewNetworkClient(transport).UseProxies(proxies).UseCircuitBreaker(breaker).UseCache(cache), cookies: cookies, lib: lib}
+	}
+
+	broken := 0
+	for _, dir := range dirs {
+		report := verifyChapter(dir, lib)
+		if len(report.Problems) > 0 && repairer != nil {
+			report = repairer.Repair(report)
+		}
+		printVerifyReport(report)
+		if len(report.Problems) > 0 {
+			broken++
+		}
+	}
+
+	if broken > 0 {
+		return fmt.Errorf("%d of %d chapter(s) have problems", broken, len(dirs))
+	}
+	pterm.Success.Printfln("All %d chapter(s) verified", len(dirs))
+	return nil
+}
+
+// findChapterDirs returns dir itself when it is a chapter folder, or else the
+// chapter folders beneath it.
+func findChapterDirs(dir string) ([]string, error) {
+	if isChapterDir(dir) {
+		return []string{dir}, nil
+	}
+	if _, err := os.ReadDir(dir); err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", dir, err)
+	}
+	var dirs []string
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || path == dir {
+			return nil
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if isChapterDir(path) {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		if rel, err := filepath.Rel(dir, path); err == nil && strings.Count(filepath.ToSlash(rel), "/")+1 >= maxChapterDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("%s contains no chapters", dir)
+	}
+	return dirs, nil
+}
+
+// pageProblem is something wrong with one page of a chapter.
+type pageProblem struct {
+	Page    int
+	File    string
+	Problem string
+}
+
+// verifyReport is the outcome of checking one chapter folder.
+type verifyReport struct {
+	Dir      string
+	Title    string
+	Pages    int
+	Manifest *Manifest
+	Problems []pageProblem
+}
+
+// verifyChapter checks every page of the chapter in dir: that it exists,
+// decodes completely, has the dimensions recorded for it and, when a hash
+// was recorded, still has the same content. Folders without a manifest can
+// only be checked for decodability and gaps in their page numbers.
+func verifyChapter(dir string, lib *Library) verifyReport {
+	report := verifyReport{Dir: dir, Title: filepath.Base(dir)}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			report.Problems = append(report.Problems, pageProblem{File: manifestFile, Problem: err.Error()})
+		}
+		verifyLegacyChapter(dir, &report)
+		return report
+	}
+	report.Manifest = &m
+	if title := m.DisplayTitle(); title != "" {
+		report.Title = title
+	}
+	report.Pages = len(m.Pages)
+
+	// Older manifests may lack hashes the library has.
+	var libPages []LibraryPage
+	if entry, ok := lib.Has(m.Episode); ok && len(entry.Pages) == len(m.Pages) {
+		libPages = entry.Pages
+	}
+
+	for i, mp := range m.Pages {
+		file := mp.File
+		if file == "" {
+			file = fmt.Sprintf("%03d.png", i+1)
+		}
+		want := mp.SHA256
+		if want == "" && libPages != nil {
+			want = libPages[i].SHA256
+		}
+		if problem := verifyPage(filepath.Join(dir, file), mp.Width, mp.Height, want); problem != "" {
+			report.Problems = append(report.Problems, pageProblem{Page: i + 1, File: file, Problem: problem})
+		}
+	}
+	return report
+}
+
+func verifyLegacyChapter(dir string, report *verifyReport) {
+	files, err := listPageFiles(dir)
+	if err != nil {
+		report.Problems = append(report.Problems, pageProblem{Problem: err.Error()})
+		return
+	}
+	present := map[int]string{}
+	last := 0
+	for _, f := range files {
+		n, _ := strconv.Atoi(strings.TrimSuffix(f, filepath.Ext(f)))
+		present[n] = f
+		if n > last {
+			last = n
+		}
+	}
+	report.Pages = last
+	for n := 1; n <= last; n++ {
+		file, ok := present[n]
+		if !ok {
+			report.Problems = append(report.Problems, pageProblem{Page: n, File: fmt.Sprintf("%03d.png", n), Problem: "missing"})
+			continue
+		}
+		if problem := verifyPage(filepath.Join(dir, file), 0, 0, ""); problem != "" {
+			report.Problems = append(report.Problems, pageProblem{Page: n, File: file, Problem: problem})
+		}
+	}
+}
+
+// verifyPage checks a single page file and describes what is wrong with it,
+// or returns "" when it is fine. A zero width/height or empty hash skips
+// that check.
+func verifyPage(path string, width, height int, sha256 string) string {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return "missing"
+		}
+		return err.Error()
+	}
+	if sha256 != "" {
+		_, sum, err := fileDigest(path)
+		if err != nil {
+			return err.Error()
+		}
+		if sum != sha256 {
+			return "content does not match the recorded hash"
+		}
+	}
+	img, err := imaging.Open(path)
+	if err != nil {
+		return fmt.Sprintf("cannot be decoded: %v", err)
+	}
+	b := img.Bounds()
+	if width > 0 && height > 0 && (b.Dx() != width || b.Dy() != height) {
+		return fmt.Sprintf("is %dx%d, expected %dx%d", b.Dx(), b.Dy(), width, height)
+	}
+	return ""
+}
+
+func printVerifyReport(r verifyReport) {
+	if len(r.Problems) == 0 {
+		pterm.Success.Printfln("%s — %d page(s) OK", r.Title, r.Pages)
+		return
+	}
+	pterm.Error.Printfln("%s — %d problem(s) in %s", r.Title, len(r.Problems), r.Dir)
+	for _, p := range r.Problems {
+		if p.Page > 0 {
+			pterm.Println(pterm.Gray(fmt.Sprintf("    page %d (%s): %s", p.Page, p.File, p.Problem)))
+		} else {
+			pterm.Println(pterm.Gray(fmt.Sprintf("    %s: %s", p.File, p.Problem)))
+		}
+	}
+}
+
+// pageRepairer re-downloads the broken pages of a chapter. The page image
+// URLs are not kept on disk, so the episode page is fetched again for a
+// fresh page list.
+type pageRepairer struct {
+	client  HTTPFetcher
+	cookies []Cookie
+	lib     *Library
+}
+
+// Repair re-downloads every broken page of r and returns the report of
+// whatever is still wrong afterwards.
+func (pr *pageRepairer) Repair(r verifyReport) verifyReport {
+	if r.Manifest == nil || r.Manifest.Episode.URL == "" {
+		pterm.Warning.Printfln("%s: cannot repair a chapter without a manifest", r.Title)
+		return r
+	}
+	m := *r.Manifest
+	doc, err := fetchComicHTML(m.Episode.URL, pr.cookies, pr.client, nil)
+	if err != nil {
+		pterm.Warning.Printfln("%s: cannot repair: %v", r.Title, err)
+		return r
+	}
+	_, pages, err := loadEpisode(doc, m.Episode.URL)
+	if err != nil {
+		pterm.Warning.Printfln("%s: cannot repair: %v", r.Title, err)
+		return r
+	}
+	if len(pages) != len(m.Pages) {
+		pterm.Warning.Printfln("%s: cannot repair: the episode now has %d page(s), the folder %d", r.Title, len(pages), len(m.Pages))
+		return r
+	}
+
+	rep := &lineReporter{total: len(pages)}
+	for _, p := range r.Problems {
+		if p.Page < 1 {
+			continue
+		}
+		res, err := pages[p.Page-1].Process(pr.client, pr.cookies, outputFromManifest(r.Dir, m), p.Page, rep)
+		if err != nil {
+			continue
+		}
+		// The page may have landed under another name than the file that
+		// was checked, say when a lossless JPEG had to fall back to PNG.
+		if res.file != p.File {
+			if err := os.Remove(filepath.Join(r.Dir, p.File)); err != nil && !os.IsNotExist(err) {
+				pterm.Warning.Printfln("%s: %v", r.Title, err)
+			}
+		}
+		mp := &m.Pages[p.Page-1]
+		mp.File, mp.Size, mp.SHA256 = res.file, res.savedBytes, res.sha256
+		mp.Width, mp.Height = res.width, res.height
+		mp.Scramble, mp.ScrambleUncertain = res.scramble.Spec.String(), !res.scramble.Certain
+	}
+	if err := writeManifest(r.Dir, m); err != nil {
+		pterm.Warning.Printfln("%s: %v", r.Title, err)
+	}
+	if _, ok := pr.lib.Has(m.Episode); ok {
+		if err := pr.lib.Put(newLibraryEntry(m, r.Dir)); err != nil {
+			pterm.Warning.Printfln("%s: %v", r.Title, err)
+		}
+	}
+	return verifyChapter(r.Dir, pr.lib)
+}
+
+// lineReporter is a PageReporter that prints one line per finished page and
+// nothing in between, for commands that touch a few scattered pages rather
+// than a whole chapter.
+type lineReporter struct {
+	total int
+}
+
+func (r *lineReporter) Status(pageNum int, format string, a ...any) {}
+
+func (r *lineReporter) RetryObserver(pageNum int, phase string) RetryObserver { return nil }
+
+func (r *lineReporter) PageSucceeded(res pageResult) {
+	pterm.Success.Printfln("[%d/%d] %s re-downloaded · %s · %s", res.pageNum, r.total, res.file, res.scramble.Describe(), humanBytes(res.savedBytes))
+}
+
+func (r *lineReporter) PageFailed(pageNum int, err error) {
+	pterm.Error.Printfln("[%d/%d] could not re-download: %v", pageNum, r.total, err)
+}
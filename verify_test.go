@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyChapterFindsBrokenPages(t *testing.T) {
+	dir := t.TempDir()
+	good := testPNG(t, 4, 3)
+	writeBytes(t, filepath.Join(dir, "001.png"), good)
+	writeBytes(t, filepath.Join(dir, "002.png"), good[:len(good)/2])
+	writeBytes(t, filepath.Join(dir, "004.png"), testPNG(t, 2, 2))
+	writeBytes(t, filepath.Join(dir, "005.png"), good)
+
+	pages := make([]Page, 5)
+	for i := range pages {
+		pages[i] = NewPage("", 4, 3)
+	}
+	m := newManifest(ChapterOutput{Episode: Episode{Title: "第1話"}}, pages)
+	_, sum, err := fileDigest(filepath.Join(dir, "001.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Pages[0].SHA256 = sum
+	m.Pages[4].SHA256 = "0000"
+	if err := writeManifest(dir, m); err != nil {
+		t.Fatal(err)
+	}
+
+	report := verifyChapter(dir, nil)
+	got := map[int]string{}
+	for _, p := range report.Problems {
+		got[p.Page] = p.Problem
+	}
+	if len(got) != 4 || got[1] != "" {
+		t.Fatalf("problems = %+v, want pages 2-5 broken", report.Problems)
+	}
+	if got[3] != "missing" {
+		t.Fatalf("page 3 problem = %q, want missing", got[3])
+	}
+	if got[4] != "is 2x2, expected 4x3" {
+		t.Fatalf("page 4 problem = %q", got[4])
+	}
+	if got[5] != "content does not match the recorded hash" {
+		t.Fatalf("page 5 problem = %q", got[5])
+	}
+}
+
+func TestVerifyChapterWithoutManifestDetectsGaps(t *testing.T) {
+	dir := t.TempDir()
+	writeBytes(t, filepath.Join(dir, "001.png"), testPNG(t, 1, 1))
+	writeBytes(t, filepath.Join(dir, "003.png"), testPNG(t, 1, 1))
+
+	report := verifyChapter(dir, nil)
+	if len(report.Problems) != 1 || report.Problems[0].Page != 2 {
+		t.Fatalf("problems = %+v, want page 2 missing", report.Problems)
+	}
+}
+
+func writeBytes(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRepairRecordsTheRepairedPage(t *testing.T) {
+	episode := &fakeEpisode{ID: "4001", Title: "Repaired", Series: "Fake Series", Pages: []fakePage{
+		{Width: 96, Height: 128, JPEG: true},
+		{Width: 96, Height: 128, JPEG: true},
+	}}
+	site := newFakeSite(t, episode)
+	dir := t.TempDir()
+
+	var page1 bytes.Buffer
+	if err := jpeg.Encode(&page1, testPicture(96, 128), nil); err != nil {
+		t.Fatal(err)
+	}
+	writeBytes(t, filepath.Join(dir, "001.jpg"), page1.Bytes())
+	// Page 2 is a broken file from an older download, recorded without a
+	// name and with the dimensions the site used to give it.
+	writeBytes(t, filepath.Join(dir, "002.png"), testPNG(t, 64, 64)[:20])
+	m := Manifest{Episode: Episode{URL: site.EpisodeURL("4001")}, Pages: []ManifestPage{
+		{File: "001.jpg", Width: 96, Height: 128},
+		{Width: 64, Height: 64},
+	}}
+	if err := writeManifest(dir, m); err != nil {
+		t.Fatal(err)
+	}
+
+	pr := &pageRepairer{client: NewNetworkClient(defaultTransportOptions)}
+	if report := pr.Repair(verifyChapter(dir, nil)); len(report.Problems) != 0 {
+		t.Fatalf("problems after repair = %+v", report.Problems)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Pages[1]; got.File != "002.jpg" || got.Width != 96 || got.Height != 128 {
+		t.Fatalf("page 2 recorded as %s %dx%d, want 002.jpg 96x128", got.File, got.Width, got.Height)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "002.png")); !os.IsNotExist(err) {
+		t.Fatalf("the replaced 002.png is still there: %v", err)
+	}
+}
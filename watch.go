@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pterm/pterm"
+)
+
+// watchStateFile records, inside the data directory, which episodes the
+// watch command has already downloaded.
+const watchStateFile = "watch.json"
+
+func runWatch(args []string) error {
+	flags := subcommandFlagSet("watch", "[flags] [series-or-episode-url...]")
+	cookieFile := flags.String("cookies", "cookie.json", "cookie file exported from the browser")
+	outRoot := flags.String("out", ".", "directory chapter folders are created in")
+	template := flags.String("output-template", "", "lay out chapter folders and page names, e.g. {series}/{number:03} - {title}/{page:03}.{ext}")
+	imageFormatFlag := addImageFormatFlags(flags)
+	applyImageLimits := addImageLimitFlags(flags)
+	keepOriginal := addKeepOriginalFlag(flags)
+	dataDir := flags.String("data-dir", defaultDataDir(), "directory the record of downloaded episodes is kept in")
+	openCache := addCacheFlags(flags)
+	openProxies := addProxyFlags(flags)
+	transportOptions := addTransportFlags(flags)
+	applyRateLimit := addRateLimitFlags(flags)
+	openBreaker := addBreakerFlags(flags)
+	listFile := flags.String("list", "", "file with one series or episode URL per line (# starts a comment)")
+	interval := flags.Duration("interval", time.Hour, "how often to check every series")
+	once := flags.Bool("once", false, "check every series once and exit")
+	force := flags.Bool("force", false, "download new episodes even if the library already has them")
+	backfill := flags.Bool("backfill", false, "also download episodes published before a series was first watched")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	entries := flags.Args()
+	if *listFile != "" {
+		listed, err := readWatchList(*listFile)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, listed...)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no series to watch: pass series URLs or -list")
+	}
+	if *interval < time.Minute {
+		return fmt.Errorf("-interval must be at least 1m, got %v", *interval)
+	}
+
+	tmpl, err := parseTemplateFlag(*template)
+	if err != nil {
+		return err
+	}
+	imageFormat, err := imageFormatFlag()
+	if err != nil {
+		return err
+	}
+	if err := applyImageLimits(); err != nil {
+		return err
+	}
+	lib, err := OpenLibrary(*dataDir)
+	if err != nil {
+		return err
+	}
+	cache, err := openCache()
+	if err != nil {
+		return err
+	}
+	proxies, err := openProxies(*dataDir)
+	if err != nil {
+		return err
+	}
+	transport, err := transportOptions()
+	if err != nil {
+		return err
+	}
+	if err := applyRateLimit(); err != nil {
+		return err
+	}
+	breaker, err := openBreaker()
+	if err != nil {
+		return err
+	}
+	if breaker != nil {
+		breaker.OnChange = printBreakerEvent
+	}
+
+	printBanner()
+	cookies, err := NewFileCookieLoader(*cookieFile).Load()
+	reportCookieLoad(*cookieFile, cookies, err)
+
+	w := &watcher{
+		client:        NewNetworkClient(transport).UseProxies(proxies).UseCircuitBreaker(breaker).UseCache(cache),
+		cookies:       cookies,
+		outRoot:       *outRoot,
+		template:      tmpl,
+		format:        imageFormat,
+		keepOriginals: *keepOriginal,
+		statePath:     filepath.Join(*dataDir, watchStateFile),
+		lib:           lib,
+		force:         *force,
+		backfill:      *backfill,
+		entries:       entries,
+		breaker:       breaker,
+	}
+	w.download = w.downloadEpisode
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	for {
+		if err := w.Poll(ctx); err != nil {
+			return err
+		}
+		if *once {
+			return nil
+		}
+		pterm.Info.Printfln("💤 Next check at %s", time.Now().Add(*interval).Format("15:04"))
+		select {
+		case <-ctx.Done():
+			pterm.Info.Println("Stopped watching.")
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// readWatchList reads one series or episode URL per line, skipping blank
+// lines and # comments.
+func readWatchList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open watch list: %v", err)
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line != "" {
+			entries = append(entries, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read watch list: %v", err)
+	}
+	return entries, nil
+}
+
+// watchState is the watch command's persistent memory.
+type watchState struct {
+	Series map[string]*watchedSeries `json:"series"`
+}
+
+// watchedSeries is the state of one series, keyed by its feed URL.
+type watchedSeries struct {
+	Title string `json:"title,omitempty"`
+	// Since is when the series was first watched. Episodes published before
+	// it are only downloaded with -backfill.
+	Since time.Time `json:"since"`
+	// Downloaded maps episode URLs to when they were downloaded.
+	Downloaded map[string]time.Time `json:"downloaded"`
+}
+
+func loadWatchState(path string) (*watchState, error) {
+	state := &watchState{}
+	if err := readJSONFile(path, state); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if state.Series == nil {
+		state.Series = map[string]*watchedSeries{}
+	}
+	return state, nil
+}
+
+func (s *watchState) series(feedURL string) *watchedSeries {
+	ws, ok := s.Series[feedURL]
+	if !ok {
+		ws = &watchedSeries{Since: time.Now().UTC(), Downloaded: map[string]time.Time{}}
+		s.Series[feedURL] = ws
+	}
+	if ws.Downloaded == nil {
+		ws.Downloaded = map[string]time.Time{}
+	}
+	return ws
+}
+
+// feedItem is one episode announced by a series feed.
+type feedItem struct {
+	Title     string
+	URL       string
+	Published time.Time
+}
+
+// watcher checks a list of series for new episodes and downloads them.
+type watcher struct {
+	client   HTTPFetcher
+	cookies  []Cookie
+	outRoot  string
+	template *OutputTemplate
+	format   ImageFormat
+	// keepOriginals keeps the server's images next to the pages.
+	keepOriginals bool
+	statePath     string
+	lib           *Library
+	force         bool
+	backfill      bool
+	entries       []string
+	// breaker, if set, is the client's circuit breaker; a poll stops when
+	// it gives up on the site, and the next poll starts afresh.
+	breaker *CircuitBreaker
+
+	// feeds caches the series feed URL resolved for each entry.
+	feeds map[string]string
+	// download fetches and saves one episode; it reports errPendingEpisode
+	// for episodes that are listed but cannot be read yet.
+	download func(item feedItem) error
+}
+
+// errPendingEpisode marks an episode that is announced but not readable yet
+// (for example still behind a paywall); it is tried again next time.
+var errPendingEpisode = errors.New("episode is not readable yet")
+
+// Poll checks every watched series once and downloads whatever is new. It
+// only fails on problems with the local state; problems with individual
+// series or episodes are reported and retried on the next poll.
+func (w *watcher) Poll(ctx context.Context) error {
+	state, err := loadWatchState(w.statePath)
+	if err != nil {
+		return err
+	}
+	if w.feeds == nil {
+		w.feeds = map[string]string{}
+	}
+	w.breaker.Reset()
+
+	for _, entry := range w.entries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := w.breaker.Err(); err != nil {
+			pterm.Warning.Printfln("%v — will check again next time", err)
+			return nil
+		}
+		feedURL, ok := w.feeds[entry]
+		if !ok {
+			feedURL, err = w.resolveFeed(entry)
+			if err != nil {
+				pterm.Warning.Printfln("%s: %v", entry, err)
+				continue
+			}
+			w.feeds[entry] = feedURL
+		}
+
+		title, items, err := w.fetchFeed(feedURL)
+		if err != nil {
+			pterm.Warning.Printfln("%s: %v", entry, err)
+			continue
+		}
+		ws := state.series(feedURL)
+		if title != "" {
+			ws.Title = title
+		}
+		pending := pendingItems(ws, items, w.backfill)
+		pterm.Info.Printfln("📡 %s — %d episode(s) listed, %d new", seriesTitleOr(ws.Title, feedURL), len(items), len(pending))
+
+		for _, item := range pending {
+			if ctx.Err() != nil || w.breaker.Err() != nil {
+				break
+			}
+			err := w.download(item)
+			if errors.Is(err, errPendingEpisode) {
+				continue
+			}
+			if err != nil {
+				pterm.Warning.Printfln("%s: %v — will retry next check", item.Title, err)
+				continue
+			}
+			ws.Downloaded[item.URL] = time.Now().UTC()
+			// Save after every episode so an interrupted run never
+			// downloads the same episode twice.
+			if err := writeJSONFile(w.statePath, state); err != nil {
+				return err
+			}
+		}
+		if err := writeJSONFile(w.statePath, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingItems returns the feed items that have not been downloaded yet,
+// oldest first. Items published before the series was first watched are
+// skipped unless backfill is set.
+func pendingItems(ws *watchedSeries, items []feedItem, backfill bool) []feedItem {
+	var pending []feedItem
+	for _, item := range items {
+		if _, done := ws.Downloaded[item.URL]; done {
+			continue
+		}
+		if !backfill && !item.Published.IsZero() && item.Published.Before(ws.Since) {
+			continue
+		}
+		pending = append(pending, item)
+	}
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].Published.Before(pending[j].Published)
+	})
+	return pending
+}
+
+// resolveFeed turns a watch list entry into the series' RSS feed URL. An
+// entry may be the feed itself or any episode of the series, in which case
+// the series is looked up from the episode JSON.
+func (w *watcher) resolveFeed(entry string) (string, error) {
+	normalized, err := normalizeComicDaysURL(entry)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(normalized)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case strings.HasPrefix(u.Path, "/rss/series/"):
+		return normalized, nil
+	case strings.HasPrefix(u.Path, "/episode/"):
+		doc, err := fetchComicHTML(normalized, w.cookies, w.client, nil)
+		if err != nil {
+			return "", fmt.Errorf("could not load the episode: %w", err)
+		}
+		jsonData, err := extractEpisodeJSON(doc)
+		if err != nil {
+			return "", err
+		}
+		episode := parseEpisode(jsonData, normalized)
+		if episode.SeriesID == "" {
+			return "", fmt.Errorf("the episode data does not name its series")
+		}
+		return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/rss/series/" + episode.SeriesID}).String(), nil
+	default:
+		return "", fmt.Errorf("expected a series feed (/rss/series/...) or an episode URL (/episode/...)")
+	}
+}
+
+// fetchFeed downloads and parses a series RSS feed.
+func (w *watcher) fetchFeed(feedURL string) (string, []feedItem, error) {
+	req, err := http.NewRequest("GET", feedURL, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("User-Agent", defaultUserAgent)
+	addCookies(req, w.cookies)
+
+	resp, err := w.client.FetchWithRetries(req, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to fetch the series feed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var feed rssFeed
+	if err := xml.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return "", nil, fmt.Errorf("error parsing the series feed: %v", err)
+	}
+	title, items := parseFeed(feed)
+	return title, items, nil
+}
+
+type rssFeed struct {
+	Channel struct {
+		Title string `xml:"title"`
+		Items []struct {
+			Title   string `xml:"title"`
+			Link    string `xml:"link"`
+			PubDate string `xml:"pubDate"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// parseFeed validates the episode links of a feed. Links that do not point
+// at the site are dropped rather than trusted.
+func parseFeed(feed rssFeed) (string, []feedItem) {
+	var items []feedItem
+	for _, it := range feed.Channel.Items {
+		link, err := normalizeComicDaysURL(it.Link)
+		if err != nil {
+			continue
+		}
+		items = append(items, feedItem{
+			Title:     strings.TrimSpace(it.Title),
+			URL:       link,
+			Published: parseFeedTime(it.PubDate),
+		})
+	}
+	return strings.TrimSpace(feed.Channel.Title), items
+}
+
+// parseFeedTime parses an RSS pubDate, returning the zero time when it is
+// missing or malformed.
+func parseFeedTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{time.RFC1123Z, time.RFC1123} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// downloadEpisode runs the regular download pipeline for one episode,
+// narrated in the terminal like a command-line run.
+func (w *watcher) downloadEpisode(item feedItem) error {
+	doc, err := fetchComicHTML(item.URL, w.cookies, w.client, nil)
+	if errors.Is(err, ErrSiteDown) {
+		return err
+	}
+	if IsPermanent(err) {
+		return errPendingEpisode
+	}
+	if err != nil {
+		return fmt.Errorf("could not load the page: %w", err)
+	}
+	episode, pages, err := loadEpisode(doc, item.URL)
+	if err != nil {
+		// Episodes that are not free (yet) are served without their pages.
+		return errPendingEpisode
+	}
+	if entry, ok := w.lib.Has(episode); ok && !w.force {
+		pterm.Info.Printfln("📚 %s is already in the library at %s", seriesTitleOr(item.Title, item.URL), entry.Path)
+		return nil
+	}
+	// An episode with failed pages is tried again on every poll; carry on
+	// in the folder the last try left instead of starting another one.
+	out, missing, resumed := findPartialChapter(w.outRoot, w.template, w.format, episode, pages)
+	if resumed {
+		pterm.Info.Printfln("⬇️  %s — %d of %d page(s) still missing in %s", seriesTitleOr(item.Title, item.URL), len(missing), len(pages), out.Dir)
+	} else {
+		out, err = prepareChapterDir(w.outRoot, w.template, w.format, episode, pages)
+		if err != nil {
+			return err
+		}
+		pterm.Info.Printfln("⬇️  %s — %d page(s)", seriesTitleOr(item.Title, item.URL), len(pages))
+	}
+	out.KeepOriginals = w.keepOriginals
+
+	pl := StartPipeline(len(pages))
+	if resumed {
+		pl.AlreadySaved(len(pages) - len(missing))
+	}
+	results, _ := downloadSomePages(pages, missing, w.client, w.cookies, out, pl)
+	stats := pl.Finish(out.Dir)
+	if err := finishChapter(w.lib, out, pages, results); err != nil {
+		return err
+	}
+	if stats.Failed > 0 {
+		return fmt.Errorf("%d page(s) failed", stats.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <title>作品名</title>
+    <item>
+      <title>第3話</title>
+      <link>https://comic-days.com/episode/3</link>
+      <pubDate>Mon, 03 Mar 2025 12:00:00 +0900</pubDate>
+    </item>
+    <item>
+      <title>第2話</title>
+      <link>https://comic-days.com/episode/2</link>
+      <pubDate>Mon, 24 Feb 2025 12:00:00 +0900</pubDate>
+    </item>
+    <item>
+      <title>phishing</title>
+      <link>https://example.com/episode/1</link>
+      <pubDate>Mon, 17 Feb 2025 12:00:00 +0900</pubDate>
+    </item>
+  </channel>
+</rss>`
+
+func TestParseFeedDropsUntrustedLinks(t *testing.T) {
+	var feed rssFeed
+	if err := xml.Unmarshal([]byte(testFeed), &feed); err != nil {
+		t.Fatal(err)
+	}
+	title, items := parseFeed(feed)
+	if title != "作品名" {
+		t.Fatalf("title = %q", title)
+	}
+	if len(items) != 2 {
+		t.Fatalf("len(items) = %d, want 2", len(items))
+	}
+	if items[1].Published.IsZero() {
+		t.Fatal("pubDate was not parsed")
+	}
+}
+
+func TestPendingItemsSkipsDownloadedAndOlderEpisodes(t *testing.T) {
+	since := time.Date(2025, 2, 20, 0, 0, 0, 0, time.UTC)
+	ws := &watchedSeries{Since: since, Downloaded: map[string]time.Time{"https://comic-days.com/episode/4": since}}
+	items := []feedItem{
+		{URL: "https://comic-days.com/episode/4", Published: since.AddDate(0, 0, 14)},
+		{URL: "https://comic-days.com/episode/3", Published: since.AddDate(0, 0, 7)},
+		{URL: "https://comic-days.com/episode/2", Published: since.AddDate(0, 0, 1)},
+		{URL: "https://comic-days.com/episode/1", Published: since.AddDate(0, 0, -6)},
+	}
+
+	got := pendingItems(ws, items, false)
+	if len(got) != 2 || got[0].URL != items[2].URL || got[1].URL != items[1].URL {
+		t.Fatalf("pendingItems() = %+v, want episodes 2 and 3, oldest first", got)
+	}
+	if got := pendingItems(ws, items, true); len(got) != 3 {
+		t.Fatalf("pendingItems(backfill) returned %d item(s), want 3", len(got))
+	}
+}
+
+func TestWatcherPollRecordsDownloadsAndRetriesPendingEpisodes(t *testing.T) {
+	fetcher := &fakeFetcher{resp: testResponse("application/rss+xml", strings.NewReader(testFeed))}
+	statePath := filepath.Join(t.TempDir(), watchStateFile)
+	feedURL := "https://comic-days.com/rss/series/1"
+	state := &watchState{Series: map[string]*watchedSeries{
+		feedURL: {Since: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}}
+	if err := writeJSONFile(statePath, state); err != nil {
+		t.Fatal(err)
+	}
+
+	var attempted []string
+	w := &watcher{
+		client:    fetcher,
+		statePath: statePath,
+		entries:   []string{feedURL},
+		download: func(item feedItem) error {
+			attempted = append(attempted, item.URL)
+			if strings.HasSuffix(item.URL, "/3") {
+				return errPendingEpisode
+			}
+			return nil
+		},
+	}
+	if err := w.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll returned error: %v", err)
+	}
+	if len(attempted) != 2 {
+		t.Fatalf("attempted %v, want both episodes", attempted)
+	}
+
+	saved, err := loadWatchState(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded := saved.Series[feedURL].Downloaded
+	if _, ok := downloaded["https://comic-days.com/episode/2"]; !ok {
+		t.Fatal("downloaded episode was not recorded")
+	}
+	if _, ok := downloaded["https://comic-days.com/episode/3"]; ok {
+		t.Fatal("pending episode was recorded as downloaded")
+	}
+}
+
+func TestWatcherResumesAnEpisodeWithFailedPages(t *testing.T) {
+	broken := make([]fakeFault, maxRetries*maxPageDownloadAttempts)
+	for i := range broken {
+		broken[i] = faultServerError
+	}
+	episode := &fakeEpisode{ID: "3005", Title: "Resumed", Series: "Fake Series", Pages: []fakePage{
+		{Width: 96, Height: 128},
+		{Width: 96, Height: 128, Faults: broken},
+		{Width: 96, Height: 128},
+	}}
+	site := newFakeSite(t, episode)
+	out, data := t.TempDir(), t.TempDir()
+	lib, err := OpenLibrary(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format, err := ParseImageFormat("png", 0, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &watcher{client: NewNetworkClient(defaultTransportOptions), outRoot: out, format: format, lib: lib}
+	item := feedItem{Title: "Resumed", URL: site.EpisodeURL("3005")}
+
+	if err := w.downloadEpisode(item); err == nil {
+		t.Fatal("the first poll succeeded although page 2 kept failing")
+	}
+	if err := w.downloadEpisode(item); err != nil {
+		t.Fatalf("the second poll failed: %v", err)
+	}
+
+	// One folder, in which only page 2 was downloaded again.
+	m, pages := readChapter(t, out)
+	if len(pages) != 3 || len(m.missingPages()) != 0 {
+		t.Fatalf("chapter has %d page(s), %v missing", len(pages), m.missingPages())
+	}
+	for _, n := range []int{1, 3} {
+		if got := site.Requests("/images/3005/" + strconv.Itoa(n)); got != 1 {
+			t.Errorf("page %d requested %d times, want 1", n, got)
+		}
+	}
+	if got := site.Requests("/images/3005/2"); got != len(broken)+1 {
+		t.Errorf("page 2 requested %d times, want %d", got, len(broken)+1)
+	}
+	if len(lib.Entries()) != 1 {
+		t.Fatal("the finished chapter was not recorded in the library")
+	}
+}
@@ -0,0 +1,163 @@
+"use strict";
+
+// The page talks to serve.go's JSON API and keeps itself up to date through
+// the /api/events server-sent event stream, so it never has to poll.
+
+const jobs = new Map();
+const jobList = document.getElementById("jobs");
+const chapterGrid = document.getElementById("chapters");
+const queueErrors = document.getElementById("queue-errors");
+
+document.getElementById("queue-form").addEventListener("submit", async (event) => {
+  event.preventDefault();
+  const form = event.target;
+  const urls = form.urls.value.split(/\s+/).filter(Boolean);
+  if (urls.length === 0) {
+    return;
+  }
+  const resp = await fetch("api/jobs", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ urls }),
+  });
+  const body = await resp.json();
+  const problems = body.errors || (body.error ? [body.error] : []);
+  queueErrors.hidden = problems.length === 0;
+  queueErrors.textContent = problems.join("\n");
+  if (resp.ok) {
+    form.reset();
+  }
+});
+
+function renderJob(job) {
+  jobs.set(job.id, job);
+  let item = document.getElementById(`job-${job.id}`);
+  if (!item) {
+    item = document.createElement("li");
+    item.id = `job-${job.id}`;
+    item.className = "job";
+    item.innerHTML = `
+      <div class="job-head"><span class="job-url"></span><span class="job-state"></span></div>
+      <div class="job-status"></div>
+      <div class="pages"></div>`;
+    jobList.prepend(item);
+  }
+
+  item.querySelector(".job-url").textContent = job.url;
+  const state = item.querySelector(".job-state");
+  state.className = `job-state ${job.state}`;
+  const done = job.pages.filter((p) => p.state === "done").length;
+  state.textContent = job.pages.length > 0 ? `${job.state} · ${done}/${job.pages.length}` : job.state;
+  item.querySelector(".job-status").textContent = job.error || job.status || currentPageMessage(job);
+
+  const pages = item.querySelector(".pages");
+  while (pages.children.length < job.pages.length) {
+    pages.appendChild(document.createElement("span"));
+  }
+  job.pages.forEach((page, i) => {
+    const cell = pages.children[i];
+    cell.className = `page ${page.state}`;
+    cell.title = `page ${i + 1}: ${page.message || page.state}`;
+  });
+}
+
+function currentPageMessage(job) {
+  const i = job.pages.findIndex((p) => p.state === "working");
+  return i >= 0 ? `page ${i + 1}: ${job.pages[i].message}` : "";
+}
+
+async function loadChapters() {
+  const resp = await fetch("api/chapters");
+  if (!resp.ok) {
+    return;
+  }
+  const chapters = await resp.json();
+  chapterGrid.replaceChildren(...chapters.map((chapter) => {
+    const card = document.createElement("div");
+    card.className = "chapter";
+    const img = document.createElement("img");
+    img.loading = "lazy";
+    img.src = `api/chapters/${chapter.id}/thumbnail`;
+    img.alt = chapter.name;
+    const caption = document.createElement("div");
+    caption.className = "caption";
+    caption.textContent = `${chapter.name} · ${chapter.pages}p`;
+    card.append(img, caption);
+    card.addEventListener("click", () => openReader(chapter));
+    return card;
+  }));
+}
+
+// --- reader -----------------------------------------------------------------
+
+const reader = document.getElementById("reader");
+const readerPage = document.getElementById("reader-page");
+let current = null;
+let pageIndex = 0;
+
+function openReader(chapter) {
+  current = chapter;
+  pageIndex = 0;
+  document.getElementById("reader-title").textContent = chapter.name;
+  reader.hidden = false;
+  showPage();
+}
+
+function closeReader() {
+  reader.hidden = true;
+  current = null;
+}
+
+function showPage() {
+  readerPage.src = `api/chapters/${current.id}/pages/${pageIndex + 1}`;
+  document.getElementById("reader-position").textContent = `${pageIndex + 1} / ${current.pages}`;
+  if (pageIndex + 1 < current.pages) {
+    new Image().src = `api/chapters/${current.id}/pages/${pageIndex + 2}`;
+  }
+}
+
+function turn(delta) {
+  const next = pageIndex + delta;
+  if (next >= 0 && next < current.pages) {
+    pageIndex = next;
+    showPage();
+  }
+}
+
+// Manga reads right to left, so the left side of the page moves forward.
+readerPage.addEventListener("click", (event) => {
+  const rect = readerPage.getBoundingClientRect();
+  turn(event.clientX - rect.left < rect.width / 2 ? 1 : -1);
+});
+
+document.getElementById("reader-close").addEventListener("click", closeReader);
+
+document.addEventListener("keydown", (event) => {
+  if (!current) {
+    return;
+  }
+  switch (event.key) {
+    case "ArrowLeft":
+      turn(1);
+      break;
+    case "ArrowRight":
+      turn(-1);
+      break;
+    case "Escape":
+      closeReader();
+      break;
+  }
+});
+
+// --- live updates -------------------------------------------------------------
+
+const events = new EventSource("api/events");
+events.addEventListener("jobs", (event) => {
+  JSON.parse(event.data).forEach(renderJob);
+});
+events.addEventListener("job", (event) => {
+  renderJob(JSON.parse(event.data));
+});
+events.addEventListener("chapters", loadChapters);
+
+loadChapters();